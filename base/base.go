@@ -2,9 +2,9 @@
 package base
 
 import (
+	"image"
 	"math"
 	"net"
-	"log"
 	"time"
 
 	"periph.io/x/periph/host"
@@ -12,25 +12,54 @@ import (
 	"periph.io/x/periph/conn/i2c/i2creg"
 	"github.com/usedbytes/bno055"
 	"github.com/usedbytes/bot_matrix/datalink/netconn"
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
 	"github.com/usedbytes/mini_mouse/bot/base/dev"
 	"github.com/usedbytes/mini_mouse/bot/base/motor"
+	"github.com/usedbytes/mini_mouse/bot/base/rangefinder"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/recorder"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
 	"github.com/usedbytes/picamera"
 )
 
+var (
+	logger = logging.New("base")
+	// For problems which can happen every tick
+	tickLogger = logger.Every(time.Second)
+
+	eulerTopic = telemetry.NewTopic("imu/euler", []float64{})
+	// The full frame, row 0 nearest
+	frameTopic = telemetry.NewTopic("camera/frame", &image.Gray{})
+)
+
 type Platform struct {
 	dev *dev.Dev
 	mmPerRev float32
 	wheelbase float32
 
 	Motors *motor.Motors
+	Ranges *rangefinder.Rangefinders
 
 	i2cBus i2c.BusCloser
-	imu *bno055.Dev
+	imu IMU
 	vec []float64
+	clock func() time.Time
+	now time.Time
 
-	Camera *picamera.Camera
-	frame *picamera.Frame
+	Camera Camera
+	Calibration *camera.Calibration
+	frame *image.Gray
+	colour *image.YCbCr
 	frameTime time.Time
+
+	recorder *recorder.Recorder
+}
+
+// SetRecorder records the datalink packets, IMU readings and camera frames
+// from now on
+func (p *Platform) SetRecorder(r *recorder.Recorder) {
+	p.recorder = r
+	p.dev.SetTransactor(r.Transactor(p.dev.Transactor()))
 }
 
 func (p *Platform) SetVelocity(a, b float32) {
@@ -102,19 +131,59 @@ func (p *Platform) GetRot() float32 {
 	return 0.0
 }
 
-func (p *Platform) GetFrame() (*picamera.Frame, time.Time) {
+// HasIMU returns whether GetRot has a reading from the IMU
+func (p *Platform) HasIMU() bool {
+	return p.vec != nil
+}
+
+func (p *Platform) GetRanges() []rangefinder.Reading {
+	return p.Ranges.Readings()
+}
+
+// Now returns the time the current tick started, which is the recorded
+// time when replaying. Use it instead of time.Now for anything which affects
+// what the robot does.
+func (p *Platform) Now() time.Time {
+	return p.now
+}
+
+// GetFullFrame returns the whole camera frame, with row 0 nearest
+func (p *Platform) GetFullFrame() (*image.Gray, time.Time) {
 	return p.frame, p.frameTime
 }
 
+// GetFrame returns the part of the camera frame used for following the
+// line, given by Calibration.Crop
+func (p *Platform) GetFrame() (*image.Gray, time.Time) {
+	full, t := p.GetFullFrame()
+	if full == nil {
+		return nil, t
+	}
+	return full.SubImage(p.Calibration.Crop.Pixels(full.Bounds())).(*image.Gray), t
+}
+
+// GetFullColourFrame returns the whole camera frame in colour, or nil if the
+// camera only provides grayscale
+func (p *Platform) GetFullColourFrame() *image.YCbCr {
+	return p.colour
+}
+
+// GetColourFrame is GetFrame in colour
+func (p *Platform) GetColourFrame() *image.YCbCr {
+	full := p.GetFullColourFrame()
+	if full == nil {
+		return nil
+	}
+	return full.SubImage(p.Calibration.Crop.Pixels(full.Bounds())).(*image.YCbCr)
+}
+
 func (p *Platform) EnableCamera() {
 	p.Camera.Enable()
 }
 
 func (p *Platform) DisableCamera() {
-	if p.frame != nil {
-		p.frame.Release()
-		p.frame = nil
-	}
+	p.frame = nil
+	p.colour = nil
 	p.Camera.Disable()
 }
 
@@ -122,90 +191,171 @@ func (p *Platform) CameraEnabled() bool {
 	return p.Camera.Enabled()
 }
 
-func NewPlatform(/* Some config */) (*Platform, error) {
+// Config is the set-up of the robot which can change between runs
+type Config struct {
+	// Camera resolution, only used by NewPlatform. Line following is
+	// happy with very few pixels, but fiducial tags need around 3 pixels
+	// per cell (21 across, after foreshortening) to be decoded.
+	CameraWidth, CameraHeight int
+	// Defaults to camera.Default
+	Calibration *camera.Calibration
+}
+
+// NewPlatformWith makes a Platform which uses 'hw'
+func NewPlatformWith(hw Hardware, cfg Config) *Platform {
+	p := &Platform{
+		dev: dev.NewDev(hw.Transactor),
+		mmPerRev: (30.5 * math.Pi),
+		wheelbase: 76,
+		imu: hw.IMU,
+		clock: hw.Clock,
+		Camera: hw.Camera,
+	}
+	if p.clock == nil {
+		p.clock = time.Now
+	}
+	p.now = p.clock().Round(0)
+
+	p.Motors = motor.NewMotors(p.dev)
+	// FIXME: Should be configurable
+	p.Ranges = rangefinder.NewRangefinders(p.dev, []rangefinder.Sensor{
+		{ Mount: rangefinder.Mount{ X: 30, Y: 0, Angle: 0 }, MaxRange: 300 },
+		{ Mount: rangefinder.Mount{ X: 20, Y: 25, Angle: math.Pi / 2 }, MaxRange: 300 },
+		{ Mount: rangefinder.Mount{ X: 20, Y: -25, Angle: -math.Pi / 2 }, MaxRange: 300 },
+	})
+	p.Calibration = cfg.Calibration
+	if p.Calibration == nil {
+		p.Calibration = camera.Default()
+	}
+
+	return p
+}
+
+// NewPlatform makes a Platform for the real robot
+func NewPlatform(cfg Config) (*Platform, error) {
 	_, err := host.Init()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Initialising host", "err", err)
 	}
 
 	b, err := i2creg.Open("")
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Opening I2C", "err", err)
 	}
 
 	c, err := net.Dial("unix", "/tmp/sock")
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Connecting to the datalink", "err", err)
 	}
-	t := netconn.NewNetconn(c)
-	dev := dev.NewDev(t)
 
-	p := &Platform{
-		dev: dev,
-		mmPerRev: (30.5 * math.Pi),
-		wheelbase: 76,
-		i2cBus: b,
+	// The line task only looks at the Calibration.Crop part of the frame,
+	// but obstacle detection needs all of it
+	cam := picamera.NewCamera(cfg.CameraWidth, cfg.CameraHeight, 60)
+	if cam == nil {
+		logger.Fatal("Couldn't open camera")
 	}
+	cam.SetTransform(0, true, true)
+	cam.SetCrop(picamera.Rect(0, 0, 1, 1))
 
-	p.Motors = motor.NewMotors(dev)
+	pc := &piCamera{ Camera: cam, clock: time.Now }
+	if !pc.requestYUV() {
+		logger.Warn("Camera can't provide chroma, colour markers are disabled")
+	}
 
-	p.Camera = picamera.NewCamera(16, 16, 60)
-	if p.Camera == nil {
-		log.Fatal("Couldn't open camera")
+	hw := Hardware{
+		Transactor: netconn.NewNetconn(c),
+		Camera: pc,
 	}
-	p.Camera.SetTransform(0, true, true)
-	// FIXME: Should be configurable
-	p.Camera.SetCrop(picamera.Rect(0, 0.5, 1.0, 1.0))
 
 	imu, err := bno055.NewI2C(b, 0x29)
 	if err != nil {
-		log.Println("Couldn't get BNO055")
+		logger.Warn("Couldn't get BNO055", "err", err)
 	} else {
-		p.imu = imu
-		err = p.imu.SetUseExternalCrystal(true)
+		err = imu.SetUseExternalCrystal(true)
 		if err != nil {
-			log.Println("IMU: SetUseExternalCrystal failed")
+			logger.Warn("IMU: SetUseExternalCrystal failed", "err", err)
 		}
+		hw.IMU = bnoIMU{ imu }
 	}
 
+	p := NewPlatformWith(hw, cfg)
+	p.i2cBus = b
+
 	return p, nil
 }
 
+// IMUPoller returns a function which reads the IMU, for running on its own
+// goroutine. From then on Update uses the newest reading, instead of
+// waiting for the IMU every tick. It returns nil if there's no IMU.
+func (p *Platform) IMUPoller() func() {
+	if p.imu == nil {
+		return nil
+	}
+
+	l, ok := p.imu.(*latestIMU)
+	if !ok {
+		l = &latestIMU{ imu: p.imu }
+		p.imu = l
+	}
+	return l.poll
+}
+
 func (p *Platform) Update() error {
+	// Wall clock only, so replays see exactly the same times
+	p.now = p.clock().Round(0)
+	p.recorder.Tick(p.now)
+
 	pkts, err := p.dev.Poll()
 	if err != nil {
 		return err
 	}
 
 	if p.Camera != nil {
-		frame, _ := p.Camera.GetFrame(0)
+		frame, colour, t := p.Camera.Frame()
 		if frame != nil {
-			if p.frame != nil {
-				p.frame.Release()
-			}
 			p.frame = frame
-			p.frameTime = time.Now()
+			p.colour = colour
+			p.frameTime = t.Round(0)
+
+			w, h := frame.Bounds().Dx(), frame.Bounds().Dy()
+			img := image.NewGray(image.Rect(0, 0, w, h))
+			for y := 0; y < h; y++ {
+				copy(img.Pix[img.Stride * y : img.Stride * y + w], frame.Pix[frame.Stride * y:])
+			}
+			frameTopic.Publish(img)
+
+			p.recorder.Frame(img, p.frameTime)
+			if colour != nil {
+				p.recorder.ColourFrame(colour, p.frameTime)
+			}
 		}
 	}
 
+	p.Ranges.Flush()
 	for _, pkt := range pkts {
 		switch t := pkt.(type) {
 		case (*motor.StepReport):
 			p.Motors.AddSteps(t)
+		case (*rangefinder.RangeReport):
+			p.Ranges.AddReport(t)
 		default:
 			if pkt != nil {
-				log.Printf("%v\n", pkt)
+				tickLogger.Warn("Unhandled packet", "packet", pkt)
 			}
 		}
 	}
 
 	if p.imu != nil {
-		vec, err := p.imu.GetVector(bno055.VECTOR_EULER)
+		vec, err := p.imu.Euler()
 		if err != nil {
-			log.Println("IMU: GetVector failed", err)
+			tickLogger.Warn("IMU: GetVector failed", "err", err)
 		}
 
 		p.vec = vec
+		p.recorder.IMU(vec)
+		if vec != nil {
+			eulerTopic.Publish(append([]float64(nil), vec...))
+		}
 	}
 
 	return nil
@@ -0,0 +1,145 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package camera
+
+import (
+	"image"
+	"math"
+)
+
+// Rect is a region of the full camera frame, normalised to 0..1 with Y0 at
+// the top (furthest away)
+type Rect struct {
+	X0, Y0, X1, Y1 float32
+}
+
+// FullFrame is the whole of the camera frame
+var FullFrame = Rect{ 0, 0, 1, 1 }
+
+// Pixels returns the part of an image with bounds 'b' covered by r. Images
+// have row 0 nearest, so the Y axis is flipped.
+func (r Rect) Pixels(b image.Rectangle) image.Rectangle {
+	w, h := float32(b.Dx()), float32(b.Dy())
+	ret := image.Rect(int(r.X0 * w), int((1 - r.Y1) * h), int(r.X1 * w), int((1 - r.Y0) * h))
+	return ret.Add(b.Min).Intersect(b)
+}
+
+// Calibration describes where the camera is on the robot, so that image
+// positions can be mapped onto the floor.
+//
+// Image positions are given the same way as algo.FindLine's output: a
+// column 'u' from -0.5 (left) to 0.5 (right) and a row 'r' from 0 (nearest)
+// to 1 (furthest), both relative to the cropped frame.
+//
+// Floor positions are in mm relative to the robot centre, with X forwards
+// and Y to the left.
+type Calibration struct {
+	// Lens height above the floor, mm
+	Height float32
+	// Angle of the optical axis below horizontal, radians
+	Tilt float32
+	// Lens position forwards of the robot centre, mm
+	Offset float32
+	// Full-frame field of view, radians
+	HFOV, VFOV float32
+	// The part of the frame the line is followed in. Image positions are
+	// relative to this.
+	Crop Rect
+}
+
+func tan32(x float32) float32 {
+	return float32(math.Tan(float64(x)))
+}
+
+func sin32(x float32) float32 {
+	return float32(math.Sin(float64(x)))
+}
+
+func cos32(x float32) float32 {
+	return float32(math.Cos(float64(x)))
+}
+
+// Convert a cropped image position to a full-frame position, -1..1 with
+// +y downwards (nearer)
+func (c *Calibration) toFull(u, r float32) (float32, float32) {
+	fx := c.Crop.X0 + (u + 0.5) * (c.Crop.X1 - c.Crop.X0)
+	fy := c.Crop.Y1 - r * (c.Crop.Y1 - c.Crop.Y0)
+	return 2 * fx - 1, 2 * fy - 1
+}
+
+func (c *Calibration) fromFull(x, y float32) (float32, float32) {
+	fx := (x + 1) / 2
+	fy := (y + 1) / 2
+	u := (fx - c.Crop.X0) / (c.Crop.X1 - c.Crop.X0) - 0.5
+	r := (c.Crop.Y1 - fy) / (c.Crop.Y1 - c.Crop.Y0)
+	return u, r
+}
+
+// ToFloor maps an image position onto the floor. It returns false if the
+// position is at or above the horizon.
+func (c *Calibration) ToFloor(u, r float32) (float32, float32, bool) {
+	x, y := c.toFull(u, r)
+
+	// Ray direction in the camera frame: right, down, forwards
+	rx := x * tan32(c.HFOV / 2)
+	ry := y * tan32(c.VFOV / 2)
+
+	// Pitch it down by Tilt
+	down := sin32(c.Tilt) + cos32(c.Tilt) * ry
+	fwd := cos32(c.Tilt) - sin32(c.Tilt) * ry
+	if down <= 1e-6 {
+		return 0, 0, false
+	}
+
+	s := c.Height / down
+	return c.Offset + s * fwd, -s * rx, true
+}
+
+// ToImage maps a floor position back into the image. It returns false if
+// the position is behind the camera.
+func (c *Calibration) ToImage(fx, fy float32) (float32, float32, bool) {
+	fwd := fx - c.Offset
+	down := c.Height
+	right := -fy
+
+	// Un-pitch into the camera frame
+	cz := cos32(c.Tilt) * fwd + sin32(c.Tilt) * down
+	cy := -sin32(c.Tilt) * fwd + cos32(c.Tilt) * down
+	if cz <= 1e-6 {
+		return 0, 0, false
+	}
+
+	x := (right / cz) / tan32(c.HFOV / 2)
+	y := (cy / cz) / tan32(c.VFOV / 2)
+	u, r := c.fromFull(x, y)
+	return u, r, true
+}
+
+// Width of one image column on the floor at row r, in mm. Useful for
+// converting widths and offsets near a particular row.
+func (c *Calibration) ColumnWidth(r float32, columns int) float32 {
+	x0, y0, ok0 := c.ToFloor(-0.5, r)
+	x1, y1, ok1 := c.ToFloor(0.5, r)
+	if !ok0 || !ok1 {
+		return float32(math.Inf(1))
+	}
+	return float32(math.Hypot(float64(x1 - x0), float64(y1 - y0))) / float32(columns)
+}
+
+// WithCrop returns a copy of c for images cropped to 'crop'
+func (c *Calibration) WithCrop(crop Rect) *Calibration {
+	ret := *c
+	ret.Crop = crop
+	return &ret
+}
+
+// Default is a Raspberry Pi camera v2, looking down the front of the robot
+func Default() *Calibration {
+	return &Calibration{
+		Height: 50,
+		Tilt: 30 * math.Pi / 180,
+		Offset: 35,
+		HFOV: 62.2 * math.Pi / 180,
+		VFOV: 48.8 * math.Pi / 180,
+		Crop: Rect{ 0, 0.5, 1.0, 1.0 },
+	}
+}
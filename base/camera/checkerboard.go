@@ -0,0 +1,207 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package camera
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+// Checkerboard describes a printed calibration board lying flat on the
+// floor, square to the robot and centred in front of it.
+type Checkerboard struct {
+	// Inner corners across (left to right) and along (near to far)
+	Cols, Rows int
+	// Side of each square, mm
+	Square float32
+	// Distance from the robot centre to the nearest row of inner corners
+	Distance float32
+}
+
+// Floor position of inner corner (col, row)
+func (b Checkerboard) corner(col, row int) (float32, float32) {
+	x := b.Distance + float32(row) * b.Square
+	y := (float32(b.Cols - 1) / 2 - float32(col)) * b.Square
+	return x, y
+}
+
+type corner struct {
+	x, y int
+	score int
+}
+
+func mean(img *image.Gray, x0, y0, x1, y1 int) int {
+	sum, n := 0, 0
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			sum += int(img.Pix[img.Stride * y + x])
+			n++
+		}
+	}
+	return sum / n
+}
+
+func absInt(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// findCorners looks for checkerboard "saddle" points, where diagonally
+// opposite quadrants match and neighbouring quadrants differ
+func findCorners(img *image.Gray, r int) []corner {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	scores := make([]int, w * h)
+
+	for y := r; y < h - r; y++ {
+		for x := r; x < w - r; x++ {
+			tl := mean(img, x - r, y - r, x, y)
+			tr := mean(img, x, y - r, x + r, y)
+			bl := mean(img, x - r, y, x, y + r)
+			br := mean(img, x, y, x + r, y + r)
+
+			across := (tl + br) - (tr + bl)
+			diag := absInt(tl - br) + absInt(tr - bl)
+			scores[y * w + x] = absInt(across) - 2 * diag
+		}
+	}
+
+	var corners []corner
+	for y := r; y < h - r; y++ {
+		for x := r; x < w - r; x++ {
+			s := scores[y * w + x]
+			if s <= 0 {
+				continue
+			}
+
+			// Non-maximum suppression
+			max := true
+			for dy := -r; dy <= r && max; dy++ {
+				for dx := -r; dx <= r; dx++ {
+					nx, ny := x + dx, y + dy
+					if nx < 0 || ny < 0 || nx >= w || ny >= h || (dx == 0 && dy == 0) {
+						continue
+					}
+					ns := scores[ny * w + nx]
+					if ns > s || (ns == s && (dy < 0 || (dy == 0 && dx < 0))) {
+						max = false
+						break
+					}
+				}
+			}
+			if max {
+				corners = append(corners, corner{ x, y, s })
+			}
+		}
+	}
+
+	return corners
+}
+
+type match struct {
+	u, r float32
+	fx, fy float32
+}
+
+// Sort the strongest corners into the board's grid, nearest row first
+func (b Checkerboard) matchCorners(img *image.Gray, corners []corner) ([]match, error) {
+	n := b.Cols * b.Rows
+	if len(corners) < n {
+		return nil, fmt.Errorf("Found %d corners, need %d", len(corners), n)
+	}
+
+	sort.Slice(corners, func(i, j int) bool { return corners[i].score > corners[j].score })
+	corners = corners[:n]
+
+	// Row 0 is nearest, so the board's nearest row has the smallest y
+	sort.Slice(corners, func(i, j int) bool { return corners[i].y < corners[j].y })
+
+	w, h := float32(img.Bounds().Dx()), float32(img.Bounds().Dy())
+	matches := make([]match, 0, n)
+	for row := 0; row < b.Rows; row++ {
+		line := corners[row * b.Cols : (row + 1) * b.Cols]
+		sort.Slice(line, func(i, j int) bool { return line[i].x < line[j].x })
+
+		for col, c := range line {
+			fx, fy := b.corner(col, row)
+			matches = append(matches, match{
+				u: float32(c.x) / w - 0.5,
+				r: float32(c.y) / h,
+				fx: fx,
+				fy: fy,
+			})
+		}
+	}
+
+	return matches, nil
+}
+
+func (c *Calibration) reprojectionError(matches []match) float64 {
+	var sum float64
+	for _, m := range matches {
+		u, r, ok := c.ToImage(m.fx, m.fy)
+		if !ok {
+			return math.Inf(1)
+		}
+		du, dr := float64(u - m.u), float64(r - m.r)
+		sum += du * du + dr * dr
+	}
+	return sum / float64(len(matches))
+}
+
+// Calibrate estimates Height and Tilt from an image of 'board', keeping the
+// other parameters of c. 'img' is a frame as passed to algo.FindLine, with
+// row 0 nearest. It returns the RMS reprojection error, in normalised image
+// units.
+func (c *Calibration) Calibrate(img *image.Gray, board Checkerboard) (float32, error) {
+	r := img.Bounds().Dx() / 32
+	if r < 2 {
+		r = 2
+	}
+
+	matches, err := board.matchCorners(img, findCorners(img, r))
+	if err != nil {
+		return 0, err
+	}
+
+	// Coarse grid search, then refine around the best
+	best := *c
+	bestErr := math.Inf(1)
+	try := func(height, tilt float32) {
+		cand := *c
+		cand.Height, cand.Tilt = height, tilt
+		if e := cand.reprojectionError(matches); e < bestErr {
+			bestErr = e
+			best = cand
+		}
+	}
+
+	for height := float32(10); height <= 300; height += 5 {
+		for tilt := float32(0); tilt < math.Pi / 2; tilt += math.Pi / 180 {
+			try(height, tilt)
+		}
+	}
+
+	hStep, tStep := float32(2.5), float32(math.Pi / 360)
+	for i := 0; i < 20; i++ {
+		h0, t0 := best.Height, best.Tilt
+		for _, dh := range []float32{ -hStep, 0, hStep } {
+			for _, dt := range []float32{ -tStep, 0, tStep } {
+				try(h0 + dh, t0 + dt)
+			}
+		}
+		hStep /= 2
+		tStep /= 2
+	}
+
+	if math.IsInf(bestErr, 1) {
+		return 0, fmt.Errorf("Calibration failed")
+	}
+
+	c.Height = best.Height
+	c.Tilt = best.Tilt
+
+	return float32(math.Sqrt(bestErr)), nil
+}
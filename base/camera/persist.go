@@ -0,0 +1,55 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package camera
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Calibrations are saved as JSON, with the same fields as Calibration
+
+// Load reads a calibration saved with Save. If 'path' doesn't exist, it
+// returns Default. Fields missing from the file are taken from Default too.
+func Load(path string) (*Calibration, error) {
+	c := Default()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// Not calibrated yet
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes c to 'path'
+func (c *Calibration) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write a new file and move it into place, so a crash can't leave a
+	// half-written one
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
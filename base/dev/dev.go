@@ -61,6 +61,16 @@ func (c Component) Remove() error {
 	return c.d.remove(c.ep)
 }
 
+func (d *Dev) Transactor() datalink.Transactor {
+	return d.transactor
+}
+
+// SetTransactor changes what packets are exchanged with, e.g. to wrap the
+// current one
+func (d *Dev) SetTransactor(t datalink.Transactor) {
+	d.transactor = t
+}
+
 func (d *Dev) Queue(p *datalink.Packet) {
 	d.toSend = append(d.toSend, *p)
 }
@@ -0,0 +1,147 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package base
+
+import (
+	"image"
+	"sync"
+	"time"
+
+	"github.com/usedbytes/bno055"
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/picamera"
+)
+
+type Camera interface {
+	Enable()
+	Disable()
+	Enabled() bool
+	// Frame returns the newest frame if there's been one since the last
+	// call, and when it was taken. The images are only valid until the
+	// next call, or Disable. 'colour' is nil if there's no chroma.
+	Frame() (gray *image.Gray, colour *image.YCbCr, t time.Time)
+}
+
+type IMU interface {
+	// Euler returns the heading, roll and pitch, in radians
+	Euler() ([]float64, error)
+}
+
+// latestIMU keeps the newest reading from an IMU which is read on another
+// goroutine, so that Euler never waits on the bus
+type latestIMU struct {
+	imu IMU
+
+	lock sync.Mutex
+	vec []float64
+	err error
+}
+
+func (l *latestIMU) poll() {
+	vec, err := l.imu.Euler()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.vec, l.err = vec, err
+}
+
+func (l *latestIMU) Euler() ([]float64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.vec == nil {
+		return nil, l.err
+	}
+	return append([]float64(nil), l.vec...), l.err
+}
+
+// Hardware is what a Platform gets its data from, and sends its commands to
+type Hardware struct {
+	Transactor datalink.Transactor
+	Camera Camera
+	// May be nil if there isn't one
+	IMU IMU
+	// Returns the current time. Defaults to time.Now
+	Clock func() time.Time
+}
+
+// Frames which carry chroma as well as luma implement this
+type colourFrame interface {
+	YCbCr() *image.YCbCr
+}
+
+// Cameras which can capture YUV implement this. Otherwise, or until it's
+// asked for, frames are luma only.
+type yuvCamera interface {
+	SetYUV(enable bool) error
+}
+
+type piCamera struct {
+	*picamera.Camera
+	clock func() time.Time
+	frame *picamera.Frame
+
+	// YUV was asked for, and whether a frame without it has been warned
+	// about yet
+	yuv bool
+	warned bool
+}
+
+// requestYUV asks the camera for YUV frames, so the chroma can be used.
+// It returns false if it can't provide them.
+func (c *piCamera) requestYUV() bool {
+	yc, ok := interface{}(c.Camera).(yuvCamera)
+	if !ok {
+		return false
+	}
+
+	if err := yc.SetYUV(true); err != nil {
+		logger.Warn("Requesting YUV frames", "err", err)
+		return false
+	}
+
+	c.yuv = true
+	return true
+}
+
+func (c *piCamera) release() {
+	if c.frame != nil {
+		c.frame.Release()
+		c.frame = nil
+	}
+}
+
+func (c *piCamera) Disable() {
+	c.release()
+	c.Camera.Disable()
+}
+
+func (c *piCamera) Frame() (*image.Gray, *image.YCbCr, time.Time) {
+	frame, _ := c.Camera.GetFrame(0)
+	if frame == nil {
+		return nil, nil, time.Time{}
+	}
+
+	c.release()
+	c.frame = frame
+
+	var colour *image.YCbCr
+	if c.yuv {
+		if cf, ok := interface{}(frame).(colourFrame); ok {
+			colour = cf.YCbCr()
+		} else if !c.warned {
+			logger.Warn("Asked for YUV, but the camera's frames have no chroma")
+			c.warned = true
+		}
+	}
+
+	return &frame.Gray, colour, c.clock()
+}
+
+type bnoIMU struct {
+	*bno055.Dev
+}
+
+func (i bnoIMU) Euler() ([]float64, error) {
+	return i.GetVector(bno055.VECTOR_EULER)
+}
@@ -8,6 +8,13 @@ import (
 
 	"github.com/usedbytes/bot_matrix/datalink"
 	"github.com/usedbytes/mini_mouse/bot/base/dev"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+)
+
+// Wheel speeds in revolutions per second, motor A then B
+var (
+	targetTopic = telemetry.NewTopic("motors/target", [2]float32{})
+	measuredTopic = telemetry.NewTopic("motors/measured", [2]float32{})
 )
 
 type motor struct {
@@ -53,7 +60,26 @@ func (m *Motors) setRadss(id int32, speed float64) {
 	m.dev.Queue(&p)
 }
 
+// ParseSpeed decodes a speed command sent by SetRPS, returning which motor
+// it's for (0 for A, 1 for B) and the speed asked for in revolutions per
+// second, in the same sense as SetRPS's arguments
+func ParseSpeed(p *datalink.Packet) (int, float32, bool) {
+	if p.Endpoint != 1 || len(p.Data) < 8 {
+		return 0, 0, false
+	}
+
+	id := int(p.Data[0])
+	radss := float64(int32(binary.LittleEndian.Uint32(p.Data[4:]))) / 65536.0
+	rps := float32(radss / (2 * math.Pi))
+	if id == 0 {
+		rps = -rps
+	}
+	return id, rps, true
+}
+
 func (m *Motors) SetRPS(a, b float32) {
+	targetTopic.Publish([2]float32{ a, b })
+
 	pa := float64(m.rpsToRadss(a))
 	pb := float64(m.rpsToRadss(b))
 
@@ -92,6 +118,7 @@ func (m *Motors) AddSteps(steps *StepReport) {
 		m.bRevs += m.motors[1].stepsToRevs(steps.Steps)
 		m.bRPS = m.motors[1].stepsToRps(steps.Steps)
 	}
+	measuredTopic.Publish([2]float32{ m.aRPS, m.bRPS })
 }
 
 func (m *Motors) rpsToRadss(rps float32) float32 {
@@ -0,0 +1,114 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package rangefinder
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/mini_mouse/bot/base/dev"
+)
+
+const endpoint = 0x13
+
+// Position and direction of a sensor relative to the robot centre.
+// X is forwards, Y is to the left, Angle is anti-clockwise from X.
+type Mount struct {
+	X, Y float32
+	Angle float32
+}
+
+type Sensor struct {
+	Mount
+	MaxRange float32
+}
+
+type RangeReport struct {
+	Id uint32
+	Millimetres uint32
+}
+
+type Reading struct {
+	Sensor
+	Id int
+	Distance float32
+}
+
+// Anything at or beyond MaxRange means nothing was seen
+func (r Reading) Hit() bool {
+	return r.Distance < r.MaxRange
+}
+
+type Rangefinders struct {
+	dev *dev.Dev
+	sensors []Sensor
+
+	last []float32
+	readings []Reading
+}
+
+func rxRangeReport(p *datalink.Packet) interface{} {
+	if p.Endpoint != endpoint {
+		return nil
+	}
+
+	rep := &RangeReport{}
+	buf := bytes.NewBuffer(p.Data)
+	binary.Read(buf, binary.LittleEndian, &rep.Id)
+	binary.Read(buf, binary.LittleEndian, &rep.Millimetres)
+
+	return rep
+}
+
+func (r *Rangefinders) Receive(pkt *datalink.Packet) interface{} {
+	return rxRangeReport(pkt)
+}
+
+func (r *Rangefinders) AddReport(rep *RangeReport) {
+	if int(rep.Id) >= len(r.sensors) {
+		return
+	}
+
+	s := r.sensors[rep.Id]
+	dist := float32(rep.Millimetres)
+	if dist > s.MaxRange {
+		dist = s.MaxRange
+	}
+
+	r.last[rep.Id] = dist
+	r.readings = append(r.readings, Reading{Sensor: s, Id: int(rep.Id), Distance: dist})
+}
+
+// Readings returns the readings received since the last call to Flush()
+func (r *Rangefinders) Readings() []Reading {
+	return r.readings
+}
+
+func (r *Rangefinders) Flush() {
+	r.readings = r.readings[:0]
+}
+
+// Last returns the most recent distance for sensor 'id'
+func (r *Rangefinders) Last(id int) float32 {
+	return r.last[id]
+}
+
+func (r *Rangefinders) Sensors() []Sensor {
+	return r.sensors
+}
+
+func NewRangefinders(dev *dev.Dev, sensors []Sensor) *Rangefinders {
+	r := &Rangefinders{
+		dev: dev,
+		sensors: sensors,
+		last: make([]float32, len(sensors)),
+	}
+
+	for i, s := range sensors {
+		r.last[i] = s.MaxRange
+	}
+
+	dev.Add(endpoint, r.Receive)
+
+	return r
+}
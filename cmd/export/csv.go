@@ -0,0 +1,72 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+)
+
+var csvHeader = []string{
+	"time", "tick", "task",
+	"measured_a_rps", "measured_b_rps", "target_a_rps", "target_b_rps",
+	"x", "y", "heading", "imu_heading",
+}
+
+// One row per tick. Columns are left empty when there's nothing recorded
+// for them, e.g. pose in recordings made before it was recorded.
+type csvOutput struct {
+	file *os.File
+	w *csv.Writer
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatFloat32(v float32) string {
+	return strconv.FormatFloat(float64(v), 'f', -1, 32)
+}
+
+func (o *csvOutput) Write(s *sample) error {
+	row := []string{
+		formatFloat(s.Elapsed),
+		strconv.FormatUint(uint64(s.N), 10),
+		s.CurrentTask,
+		formatFloat32(s.Measured[0]), formatFloat32(s.Measured[1]),
+		formatFloat32(s.Target[0]), formatFloat32(s.Target[1]),
+		"", "", "", "",
+	}
+
+	if s.HasPose {
+		row[7], row[8], row[9] = formatFloat32(s.X), formatFloat32(s.Y), formatFloat32(s.Heading)
+	}
+	if len(s.IMU) > 0 {
+		row[10] = formatFloat(s.IMU[0])
+	}
+
+	return o.w.Write(row)
+}
+
+func (o *csvOutput) Close() error {
+	o.w.Flush()
+	err := o.w.Error()
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func newCSVOutput(path string) (output, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &csvOutput{ file: f, w: csv.NewWriter(f) }
+	if err := o.w.Write(csvHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return o, nil
+}
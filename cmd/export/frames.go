@@ -0,0 +1,222 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/plan/line/algo"
+)
+
+// Grays first, then the overlay colours
+const (
+	grays = 252
+	red = grays + iota - 1
+	green
+	blue
+	yellow
+)
+
+var palette = func() color.Palette {
+	p := make(color.Palette, 0, 256)
+	for i := 0; i < grays; i++ {
+		v := uint8(i * 255 / (grays - 1))
+		p = append(p, color.Gray{ v })
+	}
+	return append(p,
+		color.RGBA{ 0xff, 0x00, 0x00, 0xff },
+		color.RGBA{ 0x00, 0xe0, 0x00, 0xff },
+		color.RGBA{ 0x20, 0x60, 0xff, 0xff },
+		color.RGBA{ 0xff, 0xe0, 0x00, 0xff },
+	)
+}()
+
+func fill(img *image.Paletted, r image.Rectangle, c uint8) {
+	r = r.Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(r.Min.X, y):img.PixOffset(r.Max.X, y)]
+		for x := range row {
+			row[x] = c
+		}
+	}
+}
+
+func outline(img *image.Paletted, r image.Rectangle, c uint8) {
+	fill(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y + 1), c)
+	fill(img, image.Rect(r.Min.X, r.Max.Y - 1, r.Max.X, r.Max.Y), c)
+	fill(img, image.Rect(r.Min.X, r.Min.Y, r.Min.X + 1, r.Max.Y), c)
+	fill(img, image.Rect(r.Max.X - 1, r.Min.Y, r.Max.X, r.Max.Y), c)
+}
+
+// Draw the camera frame 'scale' times bigger, with the crop in blue, the
+// line segments in each row in green, the followed line in red and any
+// junction in yellow. Frames have row 0 nearest, so they're flipped to put
+// it at the bottom, the way the camera sees it.
+func render(s *sample, scale int) *image.Paletted {
+	src := s.Frame
+	b := src.Bounds()
+	h := b.Dy()
+	img := image.NewPaletted(image.Rect(0, 0, b.Dx() * scale, h * scale), palette)
+
+	for y := 0; y < h; y++ {
+		dy := h - 1 - y
+		for x := 0; x < b.Dx(); x++ {
+			v := int(src.Pix[src.PixOffset(b.Min.X + x, b.Min.Y + y)])
+			c := uint8((v * (grays - 1) + 127) / 255)
+			fill(img, image.Rect(x * scale, dy * scale, (x + 1) * scale, (dy + 1) * scale), c)
+		}
+	}
+
+	if s.Line == nil {
+		return img
+	}
+
+	cropped := s.Crop.Sub(b.Min)
+	crop := image.Rect(cropped.Min.X * scale, (h - cropped.Max.Y) * scale, cropped.Max.X * scale, (h - cropped.Min.Y) * scale)
+	outline(img, crop, blue)
+
+	// Positions in the crop are -0.5 to 0.5 across it
+	toX := func(u float32) int {
+		return crop.Min.X + int((u + 0.5) * float32(crop.Dx()))
+	}
+	// Row 0 of the crop is its nearest, so the bottom
+	rowY := func(row int) int {
+		return (h - 1 - (cropped.Min.Y + row)) * scale + scale / 2
+	}
+
+	for i, row := range s.Line.Rows {
+		y := rowY(i)
+		for _, seg := range row {
+			fill(img, image.Rect(toX(seg.Left), y, toX(seg.Right), y + 1), green)
+		}
+	}
+
+	if s.Line.Junction != algo.NoJunction {
+		y := rowY(s.Line.JunctionRow)
+		fill(img, image.Rect(crop.Min.X, y, crop.Max.X, y + 1), yellow)
+	}
+
+	dot := scale / 2 + 1
+	for i, p := range s.Line.Points {
+		if math.IsNaN(float64(p)) {
+			continue
+		}
+		x, y := toX(p), rowY(i)
+		fill(img, image.Rect(x - dot / 2, y - dot / 2, x - dot / 2 + dot, y - dot / 2 + dot), red)
+	}
+
+	return img
+}
+
+// Keeps every Nth frame
+type frameFilter struct {
+	every int
+	n int
+}
+
+func (f *frameFilter) keep(s *sample) bool {
+	if s.Frame == nil {
+		return false
+	}
+	f.n++
+	return (f.n - 1) % f.every == 0
+}
+
+// The whole animation is held in memory until Close, so long runs want a
+// bigger 'every'
+type gifOutput struct {
+	path string
+	scale int
+	filter frameFilter
+
+	anim gif.GIF
+	last time.Time
+}
+
+func (o *gifOutput) Write(s *sample) error {
+	if !o.filter.keep(s) {
+		return nil
+	}
+
+	// Each frame is shown until the next was taken
+	if n := len(o.anim.Delay); n > 0 {
+		o.anim.Delay[n - 1] = int(s.FrameTime.Sub(o.last) / (10 * time.Millisecond))
+	}
+	o.last = s.FrameTime
+
+	o.anim.Image = append(o.anim.Image, render(s, o.scale))
+	o.anim.Delay = append(o.anim.Delay, 10)
+	return nil
+}
+
+func (o *gifOutput) Close() error {
+	if len(o.anim.Image) == 0 {
+		return fmt.Errorf("No camera frames for %s", o.path)
+	}
+
+	f, err := os.Create(o.path)
+	if err != nil {
+		return err
+	}
+
+	err = gif.EncodeAll(f, &o.anim)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func newGIFOutput(path string, scale, every int) (output, error) {
+	return &gifOutput{
+		path: path,
+		scale: scale,
+		filter: frameFilter{ every: every },
+	}, nil
+}
+
+// Files are named by tick, to match up with the CSV
+type pngOutput struct {
+	dir string
+	scale int
+	filter frameFilter
+}
+
+func (o *pngOutput) Write(s *sample) error {
+	if !o.filter.keep(s) {
+		return nil
+	}
+
+	f, err := os.Create(filepath.Join(o.dir, fmt.Sprintf("tick-%06d.png", s.N)))
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(f, render(s, o.scale))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (o *pngOutput) Close() error {
+	return nil
+}
+
+func newPNGOutput(dir string, scale, every int) (output, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &pngOutput{
+		dir: dir,
+		scale: scale,
+		filter: frameFilter{ every: every },
+	}, nil
+}
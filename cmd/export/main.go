@@ -0,0 +1,268 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+
+// Command export converts a run recorded with -record into formats other
+// tools can read: CSV time series, MCAP for Foxglove and friends, and an
+// animated GIF or PNG sequence of the camera frames with the line detection
+// drawn on top.
+//
+//	export -csv run.csv -mcap run.mcap -gif run.gif recordings/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/base/dev"
+	"github.com/usedbytes/mini_mouse/bot/base/motor"
+	"github.com/usedbytes/mini_mouse/bot/plan/line/algo"
+	"github.com/usedbytes/mini_mouse/bot/recorder"
+	"github.com/usedbytes/mini_mouse/bot/replay"
+)
+
+// What the outputs are given for each tick
+type sample struct {
+	*replay.Tick
+	// Seconds since the first tick
+	Elapsed float64
+
+	// Wheel speeds in revolutions per second, motor A then B
+	Measured, Target [2]float32
+	// The planner's task, carried over from the last change
+	CurrentTask string
+
+	// The line found in Frame, if there is one, and the part of the frame
+	// it was looked for in
+	Line *algo.Result
+	Crop image.Rectangle
+}
+
+type output interface {
+	Write(s *sample) error
+	Close() error
+}
+
+// Tracks the state which is only recorded when it changes, and works out
+// what the robot would have made of each tick
+type decoder struct {
+	start *replay.Tick
+	motors *motor.Motors
+	target [2]float32
+	task string
+
+	crop camera.Rect
+	detector algo.Detector
+}
+
+func (d *decoder) decode(t *replay.Tick) *sample {
+	if d.start == nil {
+		d.start = t
+	}
+
+	for i := range t.Received {
+		if rep, ok := d.motors.Receive(&t.Received[i]).(*motor.StepReport); ok {
+			d.motors.AddSteps(rep)
+		}
+	}
+	for i := range t.Sent {
+		if id, rps, ok := motor.ParseSpeed(&t.Sent[i]); ok && id < len(d.target) {
+			d.target[id] = rps
+		}
+	}
+	if t.Task != "" {
+		d.task = t.Task
+	}
+
+	s := &sample{
+		Tick: t,
+		Elapsed: t.Time.Sub(d.start.Time).Seconds(),
+		Target: d.target,
+		CurrentTask: d.task,
+	}
+	s.Measured[0], s.Measured[1] = d.motors.GetRPS()
+
+	if t.Frame != nil {
+		s.Crop = d.crop.Pixels(t.Frame.Bounds())
+		img := t.Frame.SubImage(s.Crop).(*image.Gray)
+		if !img.Rect.Empty() {
+			res := d.detector.FindLine(img, algo.Straight).Clone()
+			s.Line = &res
+		}
+	}
+
+	return s
+}
+
+// newDecoder looks for the line in the part of each frame the robot did, using
+// the crop from 'cal'
+func newDecoder(cal *camera.Calibration) *decoder {
+	return &decoder{
+		// Only used to decode step reports, nothing is sent
+		motors: motor.NewMotors(dev.NewDev(nil)),
+		crop: cal.Crop,
+		// The same as the line following task
+		detector: algo.Detector{
+			Threshold: algo.AdaptiveRow,
+			Smoothing: 0.3,
+		},
+	}
+}
+
+// Files are taken as they are, directories are expanded to the recordings
+// from run 'run' in them, or the latest run if it's ""
+func expand(args []string, run string) ([]string, error) {
+	var paths []string
+	for _, a := range args {
+		fi, err := os.Stat(a)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			paths = append(paths, a)
+			continue
+		}
+
+		runs, err := recorder.Runs(a)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for i, r := range runs {
+			if r.ID != run && (run != "" || i != len(runs) - 1) {
+				continue
+			}
+			// Fine for exporting, the pose and task just start off
+			// unknown
+			if !r.Complete {
+				log.Printf("The start of run %s in %s has been deleted\n", r.ID, a)
+			}
+			paths = append(paths, r.Files...)
+			found = true
+		}
+		if !found && run != "" {
+			return nil, fmt.Errorf("No run '%s' in %s", run, a)
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No recordings found")
+	}
+	return paths, nil
+}
+
+func run(paths []string, cal *camera.Calibration, outputs []output) error {
+	r := replay.NewReader(paths)
+	defer r.Close()
+
+	d := newDecoder(cal)
+	ticks, skipped := 0, 0
+	for {
+		t, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// Still decoded, to keep track of the state
+		s := d.decode(t)
+		if t.Dropped > 0 {
+			// Part of this tick is missing, and it may have the next
+			// tick's records in it too
+			skipped++
+			continue
+		}
+
+		for _, o := range outputs {
+			if err := o.Write(s); err != nil {
+				return err
+			}
+		}
+		ticks++
+	}
+
+	log.Printf("Exported %d ticks\n", ticks)
+	if skipped > 0 {
+		log.Printf("Skipped %d ticks with records missing from the recording\n", skipped)
+	}
+	return nil
+}
+
+func main() {
+	csvFile := flag.String("csv", "", "Write wheel speeds, pose, heading and commands to this CSV file")
+	mcapFile := flag.String("mcap", "", "Write everything to this MCAP file")
+	gifFile := flag.String("gif", "", "Write the camera frames to this animated GIF")
+	framesDir := flag.String("frames", "", "Write the camera frames to numbered PNGs in this directory")
+	scale := flag.Int("scale", 4, "How much to enlarge camera frames by")
+	every := flag.Int("every", 1, "Only keep every Nth camera frame")
+	runID := flag.String("run", "", "Run to export from directories, e.g. \"20180512-143005.120\". Defaults to the latest")
+	calibrationFile := flag.String("calibration", "calibration.json", "The robot's camera calibration file, for where to look for the line. \"\" to use the default calibration")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] recording...\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Recordings are files from one run, oldest first, or directories to take a run's files from (see -run).\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || *scale < 1 || *every < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	paths, err := expand(flag.Args(), *runID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cal := camera.Default()
+	if *calibrationFile != "" {
+		cal, err = camera.Load(*calibrationFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var outputs []output
+	closeAll := func() {
+		for _, o := range outputs {
+			if err := o.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	add := func(o output, err error) {
+		if err != nil {
+			closeAll()
+			log.Fatal(err)
+		}
+		outputs = append(outputs, o)
+	}
+
+	if *csvFile != "" {
+		add(newCSVOutput(*csvFile))
+	}
+	if *mcapFile != "" {
+		add(newMCAPOutput(*mcapFile))
+	}
+	if *gifFile != "" {
+		add(newGIFOutput(*gifFile, *scale, *every))
+	}
+	if *framesDir != "" {
+		add(newPNGOutput(*framesDir, *scale, *every))
+	}
+
+	if len(outputs) == 0 {
+		log.Fatal("Nothing to do, give at least one of -csv, -mcap, -gif or -frames")
+	}
+
+	err = run(paths, cal, outputs)
+	closeAll()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+)
+
+// Just enough of https://mcap.dev to write a file which can be read back:
+// the data section with no chunks, and no summary section. Readers which
+// need the summary (for seeking) build it from the data themselves.
+const mcapMagic = "\x89MCAP0\r\n"
+
+const (
+	mcapHeader = 0x01
+	mcapFooter = 0x02
+	mcapSchema = 0x03
+	mcapChannel = 0x04
+	mcapMessage = 0x05
+	mcapDataEnd = 0x0f
+)
+
+type mcapWriter struct {
+	file *os.File
+	w *bufio.Writer
+	buf bytes.Buffer
+	err error
+
+	schemas, channels uint16
+	seq uint32
+}
+
+func (m *mcapWriter) putString(s string) {
+	binary.Write(&m.buf, binary.LittleEndian, uint32(len(s)))
+	m.buf.WriteString(s)
+}
+
+func (m *mcapWriter) put(v interface{}) {
+	binary.Write(&m.buf, binary.LittleEndian, v)
+}
+
+// Write out the record built up in buf
+func (m *mcapWriter) record(op uint8) {
+	if m.err == nil {
+		m.w.WriteByte(op)
+		binary.Write(m.w, binary.LittleEndian, uint64(m.buf.Len()))
+		_, m.err = m.w.Write(m.buf.Bytes())
+	}
+	m.buf.Reset()
+}
+
+func (m *mcapWriter) Schema(name, encoding string, data []byte) uint16 {
+	m.schemas++
+	m.put(m.schemas)
+	m.putString(name)
+	m.putString(encoding)
+	m.put(uint32(len(data)))
+	m.buf.Write(data)
+	m.record(mcapSchema)
+	return m.schemas
+}
+
+func (m *mcapWriter) Channel(schema uint16, topic, encoding string) uint16 {
+	m.channels++
+	m.put(m.channels)
+	m.put(schema)
+	m.putString(topic)
+	m.putString(encoding)
+	// No metadata
+	m.put(uint32(0))
+	m.record(mcapChannel)
+	return m.channels
+}
+
+func (m *mcapWriter) Message(channel uint16, t time.Time, data []byte) error {
+	m.seq++
+	m.put(channel)
+	m.put(m.seq)
+	m.put([]uint64{ uint64(t.UnixNano()), uint64(t.UnixNano()) })
+	m.buf.Write(data)
+	m.record(mcapMessage)
+	return m.err
+}
+
+func (m *mcapWriter) Close() error {
+	// CRCs of 0 mean they weren't calculated
+	m.put(uint32(0))
+	m.record(mcapDataEnd)
+	m.put([]uint64{ 0, 0 })
+	m.put(uint32(0))
+	m.record(mcapFooter)
+
+	if m.err == nil {
+		_, m.err = m.w.WriteString(mcapMagic)
+	}
+	if m.err == nil {
+		m.err = m.w.Flush()
+	}
+	if err := m.file.Close(); m.err == nil {
+		m.err = err
+	}
+	return m.err
+}
+
+func newMCAPWriter(path, library string) (*mcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mcapWriter{ file: f, w: bufio.NewWriter(f) }
+	m.w.WriteString(mcapMagic)
+	m.putString("")
+	m.putString(library)
+	m.record(mcapHeader)
+	return m, nil
+}
+
+// Every topic is JSON, described by a JSON schema
+type mcapTopic struct {
+	name string
+	schema string
+	properties string
+}
+
+var mcapTopics = []mcapTopic{
+	{ "/wheels", "mini_mouse.Wheels", `{
+		"measured": { "type": "array", "items": { "type": "number" }, "description": "rev/s, motor A then B" },
+		"target": { "type": "array", "items": { "type": "number" }, "description": "rev/s, motor A then B" }
+	}` },
+	{ "/pose", "mini_mouse.Pose", `{
+		"x": { "type": "number" }, "y": { "type": "number" }, "heading": { "type": "number" }
+	}` },
+	{ "/imu", "mini_mouse.Euler", `{
+		"heading": { "type": "number" }, "roll": { "type": "number" }, "pitch": { "type": "number" }
+	}` },
+	{ "/input", "mini_mouse.Input", `{
+		"left": { "type": "number" }, "right": { "type": "number" },
+		"buttons": { "type": "object", "additionalProperties": { "type": "integer" } }
+	}` },
+	{ "/task", "mini_mouse.Task", `{
+		"name": { "type": "string" }
+	}` },
+	{ "/camera", "foxglove.RawImage", `{
+		"timestamp": { "type": "object", "properties": { "sec": { "type": "integer" }, "nsec": { "type": "integer" } } },
+		"frame_id": { "type": "string" },
+		"width": { "type": "integer" }, "height": { "type": "integer" },
+		"encoding": { "type": "string" }, "step": { "type": "integer" },
+		"data": { "type": "string", "contentEncoding": "base64" }
+	}` },
+	{ "/line", "mini_mouse.Line", `{
+		"points": { "type": "array", "items": { "type": ["number", "null"] }, "description": "-0.5 to 0.5 across the cropped frame, nearest row first" },
+		"angle": { "type": "number" }
+	}` },
+}
+
+type mcapTime struct {
+	Sec uint32 `json:"sec"`
+	Nsec uint32 `json:"nsec"`
+}
+
+type mcapImage struct {
+	Timestamp mcapTime `json:"timestamp"`
+	FrameID string `json:"frame_id"`
+	Width int `json:"width"`
+	Height int `json:"height"`
+	Encoding string `json:"encoding"`
+	Step int `json:"step"`
+	Data []byte `json:"data"`
+}
+
+type mcapOutput struct {
+	w *mcapWriter
+	channels map[string]uint16
+}
+
+func (o *mcapOutput) message(topic string, t time.Time, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return o.w.Message(o.channels[topic], t, data)
+}
+
+func (o *mcapOutput) Write(s *sample) error {
+	type msg struct {
+		topic string
+		v interface{}
+	}
+	msgs := []msg{
+		{ "/wheels", map[string]interface{}{ "measured": s.Measured, "target": s.Target } },
+	}
+
+	if s.HasPose {
+		msgs = append(msgs, msg{ "/pose", map[string]float32{ "x": s.X, "y": s.Y, "heading": s.Heading } })
+	}
+	if len(s.IMU) >= 3 {
+		msgs = append(msgs, msg{ "/imu", map[string]float64{ "heading": s.IMU[0], "roll": s.IMU[1], "pitch": s.IMU[2] } })
+	}
+	if s.HasInput {
+		msgs = append(msgs, msg{ "/input", map[string]interface{}{ "left": s.Left, "right": s.Right, "buttons": s.Buttons } })
+	}
+	if s.Task != "" {
+		msgs = append(msgs, msg{ "/task", map[string]string{ "name": s.Task } })
+	}
+
+	for _, m := range msgs {
+		if err := o.message(m.topic, s.Time, m.v); err != nil {
+			return err
+		}
+	}
+
+	if s.Frame == nil {
+		return nil
+	}
+
+	// Frames have row 0 nearest, so flip them to put it at the bottom,
+	// like the GIF and PNG frames
+	b := s.Frame.Bounds()
+	w, h := b.Dx(), b.Dy()
+	pix := make([]byte, w * h)
+	for y := 0; y < h; y++ {
+		off := s.Frame.PixOffset(b.Min.X, b.Min.Y + y)
+		copy(pix[w * (h - 1 - y) : w * (h - y)], s.Frame.Pix[off : off + w])
+	}
+
+	img := mcapImage{
+		Timestamp: mcapTime{ uint32(s.FrameTime.Unix()), uint32(s.FrameTime.Nanosecond()) },
+		FrameID: "camera",
+		Width: w,
+		Height: h,
+		Encoding: "mono8",
+		Step: w,
+		Data: pix,
+	}
+	if err := o.message("/camera", s.FrameTime, img); err != nil {
+		return err
+	}
+
+	if s.Line != nil {
+		// JSON has no NaN, rows without the line are null
+		points := make([]*float32, len(s.Line.Points))
+		for i := range s.Line.Points {
+			if !math.IsNaN(float64(s.Line.Points[i])) {
+				points[i] = &s.Line.Points[i]
+			}
+		}
+		line := map[string]interface{}{ "points": points, "angle": s.Line.Angle }
+		if err := o.message("/line", s.FrameTime, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *mcapOutput) Close() error {
+	return o.w.Close()
+}
+
+func newMCAPOutput(path string) (output, error) {
+	w, err := newMCAPWriter(path, "mini_mouse export")
+	if err != nil {
+		return nil, err
+	}
+
+	o := &mcapOutput{ w: w, channels: make(map[string]uint16) }
+	for _, t := range mcapTopics {
+		schema := `{ "type": "object", "properties": ` + t.properties + ` }`
+		id := w.Schema(t.schema, "jsonschema", []byte(schema))
+		o.channels[t.name] = w.Channel(id, t.name, "json")
+	}
+	return o, nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package control
+
+import (
+	"fmt"
+	"image"
+	"sync/atomic"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan"
+	"github.com/usedbytes/mini_mouse/bot/plan/line"
+	"github.com/usedbytes/mini_mouse/bot/plan/waypoint"
+	"github.com/usedbytes/mini_mouse/bot/tunable"
+)
+
+const (
+	// Commands waiting for the main loop. More than this are refused.
+	commandQueue = 8
+	// How long to wait for the main loop to run a command
+	commandTimeout = time.Second
+)
+
+// Robot is everything which can be controlled remotely
+type Robot struct {
+	Planner *plan.Planner
+	Model *model.Model
+	Platform *base.Platform
+	Line *line.Task
+	Waypoint *waypoint.Task
+	Tunables *tunable.Registry
+}
+
+// Where a command has got to. Commands which time out in the queue are
+// cancelled, so they can't run after their caller has given up on them.
+const (
+	queued int32 = iota
+	running
+	cancelled
+)
+
+type command struct {
+	run func() error
+	done chan error
+	state int32
+}
+
+// TaskList is the registered planner tasks, and which one is running
+type TaskList struct {
+	Tasks []string
+	Current string
+}
+
+// TunableValue is a request to set a tunable. Value can be a number, bool,
+// or a string to be parsed.
+type TunableValue struct {
+	Name string
+	Value interface{}
+}
+
+// CalibrationResult is a camera calibration fitted by Calibrate
+type CalibrationResult struct {
+	Calibration camera.Calibration
+	// RMS reprojection error, in normalised image units
+	Error float32
+	// Where it was saved, if anywhere
+	File string
+}
+
+// Control lets other goroutines drive the robot. Nothing in Robot is safe
+// to touch from outside the main loop, so commands are queued, and run when
+// the main loop calls Run.
+//
+// Its methods are suitable for net/rpc, and Server serves them over HTTP.
+type Control struct {
+	robot Robot
+	commands chan *command
+	calibrationFile string
+}
+
+// SetCalibrationFile sets where Calibrate saves its results
+func (c *Control) SetCalibrationFile(path string) {
+	c.calibrationFile = path
+}
+
+// Queue 'fn' for the main loop, and wait for it to finish
+func (c *Control) do(fn func() error) error {
+	cmd := &command{ run: fn, done: make(chan error, 1) }
+
+	select {
+	case c.commands <- cmd:
+	default:
+		return fmt.Errorf("Busy")
+	}
+
+	select {
+	case err := <-cmd.done:
+		return err
+	case <-time.After(commandTimeout):
+	}
+
+	if atomic.CompareAndSwapInt32(&cmd.state, queued, cancelled) {
+		return fmt.Errorf("Timed out waiting for the main loop")
+	}
+
+	// It started just in time, so it's too late to cancel
+	return <-cmd.done
+}
+
+// Run executes all the queued commands. It must be called from the main
+// loop, before the planner ticks.
+func (c *Control) Run() {
+	for {
+		select {
+		case cmd := <-c.commands:
+			if !atomic.CompareAndSwapInt32(&cmd.state, queued, running) {
+				continue
+			}
+			cmd.done <- cmd.run()
+		default:
+			return
+		}
+	}
+}
+
+func (c *Control) Tasks(ignored bool, list *TaskList) error {
+	return c.do(func() error {
+		*list = TaskList{ c.robot.Planner.Tasks(), c.robot.Planner.Current() }
+		return nil
+	})
+}
+
+func (c *Control) SetTask(name string, ignored *bool) error {
+	return c.do(func() error {
+		return c.robot.Planner.SetTask(name)
+	})
+}
+
+// SetRoute gives the waypoint task a list of points to visit, and switches
+// to it
+func (c *Control) SetRoute(route []model.Coord, ignored *bool) error {
+	if len(route) == 0 {
+		return fmt.Errorf("Empty route")
+	}
+
+	return c.do(func() error {
+		c.robot.Waypoint.SetRoute(route)
+		return c.robot.Planner.SetTask(waypoint.TaskName)
+	})
+}
+
+func (c *Control) GetRoute(ignored bool, route *[]model.Coord) error {
+	return c.do(func() error {
+		*route = append([]model.Coord(nil), c.robot.Waypoint.Route()...)
+		return nil
+	})
+}
+
+// SetLineRunning starts or stops the line follower. Starting it switches to
+// the line task first.
+func (c *Control) SetLineRunning(run bool, ignored *bool) error {
+	return c.do(func() error {
+		if !run {
+			c.robot.Line.Stop()
+			return nil
+		}
+
+		if c.robot.Planner.Current() != line.TaskName {
+			if err := c.robot.Planner.SetTask(line.TaskName); err != nil {
+				return err
+			}
+		}
+		c.robot.Line.Start()
+		return nil
+	})
+}
+
+func (c *Control) LineRunning(ignored bool, running *bool) error {
+	return c.do(func() error {
+		*running = c.robot.Line.Running()
+		return nil
+	})
+}
+
+func (c *Control) ResetOrientation(ignored bool, ignored2 *bool) error {
+	return c.do(func() error {
+		c.robot.Model.ResetOrientation()
+		return nil
+	})
+}
+
+func (c *Control) SetCamera(enable bool, ignored *bool) error {
+	return c.do(func() error {
+		if enable {
+			c.robot.Platform.EnableCamera()
+		} else {
+			c.robot.Platform.DisableCamera()
+		}
+		return nil
+	})
+}
+
+func (c *Control) CameraEnabled(ignored bool, enabled *bool) error {
+	return c.do(func() error {
+		*enabled = c.robot.Platform.CameraEnabled()
+		return nil
+	})
+}
+
+func (c *Control) Tunables(ignored bool, list *[]tunable.Info) error {
+	return c.do(func() error {
+		*list = c.robot.Tunables.List()
+		return nil
+	})
+}
+
+func (c *Control) GetTunable(name string, info *tunable.Info) error {
+	return c.do(func() error {
+		var err error
+		*info, err = c.robot.Tunables.Get(name)
+		return err
+	})
+}
+
+func (c *Control) SetTunable(v TunableValue, ignored *bool) error {
+	return c.do(func() error {
+		return c.robot.Tunables.Set(v.Name, v.Value)
+	})
+}
+
+// Calibrate fits the camera's height and tilt to 'board', lying on the
+// floor in front of the robot, and saves the result to the calibration
+// file. The vision stages keep their own copies of the calibration, so it's
+// only used from the next start.
+func (c *Control) Calibrate(board camera.Checkerboard, result *CalibrationResult) error {
+	var frame *image.Gray
+	var cal camera.Calibration
+	err := c.do(func() error {
+		full, _ := c.robot.Platform.GetFullFrame()
+		if full == nil {
+			return fmt.Errorf("No camera frame")
+		}
+		frame = &image.Gray{
+			Pix: append([]uint8(nil), full.Pix...),
+			Stride: full.Stride,
+			Rect: full.Rect,
+		}
+		cal = *c.robot.Platform.Calibration
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Fitting takes a while, so it's done here rather than in the main
+	// loop. Use the whole frame, for as many corners as possible.
+	full := cal.WithCrop(camera.FullFrame)
+	rms, err := full.Calibrate(frame, board)
+	if err != nil {
+		return err
+	}
+	cal.Height, cal.Tilt = full.Height, full.Tilt
+
+	*result = CalibrationResult{ Calibration: cal, Error: rms }
+	if c.calibrationFile == "" {
+		return nil
+	}
+	if err := cal.Save(c.calibrationFile); err != nil {
+		return err
+	}
+	result.File = c.calibrationFile
+	logger.Info("Saved calibration", "file", c.calibrationFile, "height", cal.Height, "tilt", cal.Tilt, "error", rms)
+
+	return nil
+}
+
+func NewControl(robot Robot) *Control {
+	return &Control{
+		robot: robot,
+		commands: make(chan *command, commandQueue),
+	}
+}
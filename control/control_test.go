@@ -0,0 +1,46 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package control
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestTimedOutCommandIsCancelled(t *testing.T) {
+	c := NewControl(Robot{})
+
+	ran := false
+	err := c.do(func() error {
+		ran = true
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Expected a timeout, with nothing running the main loop")
+	}
+
+	// The main loop finally gets round to it
+	c.Run()
+	if ran {
+		t.Error("Command ran after it timed out")
+	}
+
+	// ...and it doesn't get in the way of the next one
+	done := make(chan error)
+	go func() {
+		done <- c.do(func() error {
+			ran = true
+			return nil
+		})
+	}()
+	for len(c.commands) == 0 {
+		runtime.Gosched()
+	}
+	c.Run()
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if !ran {
+		t.Error("Command didn't run")
+	}
+}
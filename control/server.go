@@ -0,0 +1,271 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/tunable"
+)
+
+var logger = logging.New("control")
+
+var (
+	errNotFound = errors.New("Not found")
+	errMethod = errors.New("Use POST")
+)
+
+// Server serves a Control over HTTP. Under its prefix:
+//
+//	tasks               GET the TaskList
+//	task?name=          POST to switch task
+//	route               GET the remaining waypoints, or POST a JSON list
+//	                    of {"X": x, "Y": y} to visit
+//	waypoint?x=&y=      POST to visit a single point
+//	line?run=           GET whether the line follower is running, or POST
+//	                    true/false to start/stop it
+//	reset-orientation   POST
+//	camera?enable=      GET whether the camera is on, or POST to change it
+//	tunables            GET all the tunables
+//	tunable?name=       GET one tunable, or POST with value= to set it
+//	calibrate?cols=&rows=&square=&distance=
+//	                    POST to fit the camera calibration to a
+//	                    camera.Checkerboard in front of the robot, and
+//	                    save it. Returns the CalibrationResult.
+//
+// Errors are returned as plain text, everything else as JSON.
+type Server struct {
+	control *Control
+	prefix string
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("Encoding response", "err", err)
+	}
+}
+
+func parseBool(r *http.Request, key string) (bool, error) {
+	b, err := strconv.ParseBool(r.FormValue(key))
+	if err != nil {
+		return false, fmt.Errorf("Bad %s '%s'", key, r.FormValue(key))
+	}
+	return b, nil
+}
+
+func parseFloat(r *http.Request, key string) (float32, error) {
+	f, err := strconv.ParseFloat(r.FormValue(key), 32)
+	if err != nil {
+		return 0, fmt.Errorf("Bad %s '%s'", key, r.FormValue(key))
+	}
+	return float32(f), nil
+}
+
+func parseInt(r *http.Request, key string) (int, error) {
+	i, err := strconv.Atoi(r.FormValue(key))
+	if err != nil {
+		return 0, fmt.Errorf("Bad %s '%s'", key, r.FormValue(key))
+	}
+	return i, nil
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		var route []model.Coord
+		if err := s.control.GetRoute(false, &route); err != nil {
+			return err
+		}
+		writeJSON(w, route)
+		return nil
+	}
+
+	var route []model.Coord
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+		return fmt.Errorf("Bad route: %v", err)
+	}
+	return s.control.SetRoute(route, nil)
+}
+
+func (s *Server) waypoint(w http.ResponseWriter, r *http.Request) error {
+	x, err := parseFloat(r, "x")
+	if err != nil {
+		return err
+	}
+	y, err := parseFloat(r, "y")
+	if err != nil {
+		return err
+	}
+	return s.control.SetRoute([]model.Coord{ { x, y } }, nil)
+}
+
+func (s *Server) line(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		var running bool
+		if err := s.control.LineRunning(false, &running); err != nil {
+			return err
+		}
+		writeJSON(w, running)
+		return nil
+	}
+
+	run, err := parseBool(r, "run")
+	if err != nil {
+		return err
+	}
+	return s.control.SetLineRunning(run, nil)
+}
+
+func (s *Server) camera(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		var enabled bool
+		if err := s.control.CameraEnabled(false, &enabled); err != nil {
+			return err
+		}
+		writeJSON(w, enabled)
+		return nil
+	}
+
+	enable, err := parseBool(r, "enable")
+	if err != nil {
+		return err
+	}
+	return s.control.SetCamera(enable, nil)
+}
+
+func (s *Server) tunable(w http.ResponseWriter, r *http.Request) error {
+	name := r.FormValue("name")
+	if r.Method != http.MethodPost {
+		var info tunable.Info
+		if err := s.control.GetTunable(name, &info); err != nil {
+			return err
+		}
+		writeJSON(w, info)
+		return nil
+	}
+
+	return s.control.SetTunable(TunableValue{ name, r.FormValue("value") }, nil)
+}
+
+func (s *Server) calibrate(w http.ResponseWriter, r *http.Request) error {
+	var board camera.Checkerboard
+	var err error
+	if board.Cols, err = parseInt(r, "cols"); err != nil {
+		return err
+	}
+	if board.Rows, err = parseInt(r, "rows"); err != nil {
+		return err
+	}
+	if board.Square, err = parseFloat(r, "square"); err != nil {
+		return err
+	}
+	if board.Distance, err = parseFloat(r, "distance"); err != nil {
+		return err
+	}
+
+	var result CalibrationResult
+	if err := s.control.Calibrate(board, &result); err != nil {
+		return err
+	}
+	writeJSON(w, result)
+	return nil
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) error {
+	post := r.Method == http.MethodPost
+
+	switch strings.TrimPrefix(r.URL.Path, s.prefix) {
+	case "tasks":
+		var list TaskList
+		if err := s.control.Tasks(false, &list); err != nil {
+			return err
+		}
+		writeJSON(w, list)
+		return nil
+	case "task":
+		if !post {
+			return errMethod
+		}
+		return s.control.SetTask(r.FormValue("name"), nil)
+	case "route":
+		return s.route(w, r)
+	case "waypoint":
+		if !post {
+			return errMethod
+		}
+		return s.waypoint(w, r)
+	case "line":
+		return s.line(w, r)
+	case "reset-orientation":
+		if !post {
+			return errMethod
+		}
+		return s.control.ResetOrientation(false, nil)
+	case "camera":
+		return s.camera(w, r)
+	case "tunables":
+		var list []tunable.Info
+		if err := s.control.Tunables(false, &list); err != nil {
+			return err
+		}
+		writeJSON(w, list)
+		return nil
+	case "tunable":
+		return s.tunable(w, r)
+	case "calibrate":
+		if !post {
+			return errMethod
+		}
+		return s.calibrate(w, r)
+	}
+
+	return errNotFound
+}
+
+// Keeps track of whether a handler has written a response
+type responseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w := &responseWriter{ ResponseWriter: rw }
+	err := s.handle(w, r)
+	switch err {
+	case nil:
+		if r.Method == http.MethodPost && !w.written {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case errNotFound:
+		http.NotFound(w, r)
+	case errMethod:
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// NewServer serves 'control' under 'prefix', which should end in '/'
+func NewServer(control *Control, prefix string) *Server {
+	return &Server{
+		control: control,
+		prefix: prefix,
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package dashboard
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+)
+
+//go:embed static
+var static embed.FS
+
+var logger = logging.New("dashboard")
+
+// Config tells the page what it can ask for, and how to draw the frame
+type Config struct {
+	Tasks []string
+	// Part of the camera frame the line is found in
+	Crop camera.Rect
+	// Where the telemetry and control servers are
+	Telemetry string
+	Control string
+}
+
+// Server serves a web page showing the robot's telemetry, live. Under its
+// prefix it serves the page, and "config", the Config as JSON.
+type Server struct {
+	prefix string
+	config Config
+	files http.Handler
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, s.prefix) {
+	case "config":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.config); err != nil {
+			logger.Warn("Encoding config", "err", err)
+		}
+	default:
+		http.StripPrefix(s.prefix, s.files).ServeHTTP(w, r)
+	}
+}
+
+// NewServer serves the dashboard under 'prefix', which should end in '/'.
+// 'telemetry' and 'control' are the prefixes of the telemetry.Server to get
+// data from, and the control.Server to send commands to.
+func NewServer(prefix string, tasks []string, crop camera.Rect, telemetry, control string) *Server {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return &Server{
+		prefix: prefix,
+		config: Config{
+			Tasks: tasks,
+			Crop: crop,
+			Telemetry: telemetry,
+			Control: control,
+		},
+		files: http.FileServer(http.FS(files)),
+	}
+}
@@ -1,7 +1,7 @@
 package input
 
 import (
-	"log"
+	"sync"
 	"time"
 
 	"github.com/gvalkov/golang-evdev"
@@ -9,8 +9,24 @@ import (
 	"github.com/usedbytes/input2/button"
 	"github.com/usedbytes/input2/gamepad/thumbstick"
 	"github.com/usedbytes/input2/factory"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/tunable"
 )
 
+var logger = logging.New("input")
+
+var (
+	// Stick movements smaller than this (0 to 1) are ignored. Changes apply
+	// to gamepads connected afterwards.
+	deadzone = tunable.NewFloat("input/deadzone", 0.2, 0, 0.9)
+	// A second press within this many seconds of the first is a DoubleTap
+	doubleTapTime = tunable.NewFloat("input/double_tap_time", 0.3, 0.05, 1)
+)
+
+// Events waiting for the main loop. It's drained every tick, so this only
+// fills up if the loop has stalled.
+const queueLen = 256
+
 type Button int
 const (
 	Cross Button = iota
@@ -28,19 +44,104 @@ const (
 	R3
 )
 
-type State int
+// State is what happened to a button during a tick. It's a set of flags,
+// as more than one thing can happen in a tick, e.g. a quick tap is Pressed
+// and Released.
+type State uint8
 const (
-	None State = iota
-	Pressed
-	Held
+	None State = 0
+	// Went down
+	Pressed State = 1 << 0
+	// Has been down for the hold time. Only reported once per press.
+	Held State = 1 << 1
+	// Came back up
+	Released State = 1 << 2
+	// Pressed soon after the last press. Always comes with Pressed.
+	DoubleTap State = 1 << 3
+	// Is down at the end of the tick
+	Down State = 1 << 4
 )
 
+func (s State) Has(flags State) bool {
+	return s & flags == flags
+}
+
+// ButtonState holds the State of every button which isn't None
 type ButtonState map[Button]State
 
+func (b ButtonState) Pressed(btn Button) bool {
+	return b[btn].Has(Pressed)
+}
+
+func (b ButtonState) Held(btn Button) bool {
+	return b[btn].Has(Held)
+}
+
+func (b ButtonState) Released(btn Button) bool {
+	return b[btn].Has(Released)
+}
+
+func (b ButtonState) DoubleTapped(btn Button) bool {
+	return b[btn].Has(DoubleTap)
+}
+
+func (b ButtonState) Down(btn Button) bool {
+	return b[btn].Has(Down)
+}
+
+// One edge: Pressed (maybe with DoubleTap), Held or Released
+type event struct {
+	button Button
+	state State
+}
+
+// Collector gathers gamepad events on their own goroutines, for the main
+// loop to pick up once a tick
 type Collector struct {
+	lock sync.Mutex
 	leftStick, rightStick float32
-	buttons ButtonState
-	held map[Button]bool
+	events []event
+	dropped int
+	lastPress map[Button]time.Time
+	// Whether each button is down, as of the events Buttons has returned
+	down map[Button]bool
+
+	// Set by Feed, for detached Collectors
+	fed ButtonState
+}
+
+// Must hold the lock
+func (c *Collector) queue(e event) {
+	if len(c.events) >= queueLen {
+		c.events = c.events[1:]
+		c.dropped++
+	}
+	c.events = append(c.events, e)
+}
+
+func (c *Collector) handleButton(e button.Event) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b := Button(e.Keycode)
+	switch e.Value {
+	case button.Pressed:
+		now := time.Now()
+		state := Pressed
+		last, ok := c.lastPress[b]
+		if ok && now.Sub(last).Seconds() < doubleTapTime.Float() {
+			state |= DoubleTap
+			// A third tap starts a new pair
+			delete(c.lastPress, b)
+		} else {
+			c.lastPress[b] = now
+		}
+		c.queue(event{ b, state })
+	case button.Held:
+		c.queue(event{ b, Held })
+	case button.Released:
+		c.queue(event{ b, Released })
+	}
 }
 
 func (c *Collector) handleEvents(ch <-chan input2.InputEvent) {
@@ -49,6 +150,7 @@ func (c *Collector) handleEvents(ch <-chan input2.InputEvent) {
 		case thumbstick.Event:
 			mag := float32(e.Arg)
 
+			c.lock.Lock()
 			if e.Stick == 0 {
 				if (e.Theta > 90) && (e.Theta < 270) {
 					mag = -mag
@@ -60,26 +162,82 @@ func (c *Collector) handleEvents(ch <-chan input2.InputEvent) {
 				}
 				c.rightStick = mag
 			}
+			c.lock.Unlock()
 
 		case button.Event:
-			if e.Value == button.Pressed {
-				c.buttons[Button(e.Keycode)] = Pressed
-			} else if e.Value == button.Held {
-				c.buttons[Button(e.Keycode)] = Held
-			}
+			c.handleButton(e)
 		}
 	}
 }
 
 func (c *Collector) GetSticks() (float32, float32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	return c.leftStick, c.rightStick
 }
 
+// Buttons returns what happened to the buttons since the last call. If the
+// same thing happened to a button more than once (e.g. two presses), the
+// later ones are kept for the following calls, so none are lost.
 func (c *Collector) Buttons() ButtonState {
-	defer func() {
-		c.buttons = make(ButtonState)
-	}()
-	return c.buttons
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.fed != nil {
+		ret := c.fed
+		c.fed = nil
+		return ret
+	}
+
+	if c.dropped > 0 {
+		logger.Warn("Dropped button events", "count", c.dropped)
+		c.dropped = 0
+	}
+
+	ret := make(ButtonState)
+	deferred := make(map[Button]bool)
+	kept := c.events[:0]
+	for _, e := range c.events {
+		// Keep events in order: once one is deferred, so is the rest
+		// for that button
+		edges := ret[e.button] &^ Down
+		if deferred[e.button] || edges & e.state != 0 {
+			deferred[e.button] = true
+			kept = append(kept, e)
+			continue
+		}
+
+		ret[e.button] |= e.state
+		if e.state.Has(Pressed) {
+			c.down[e.button] = true
+		} else if e.state.Has(Released) {
+			c.down[e.button] = false
+		}
+	}
+	c.events = kept
+
+	for b, d := range c.down {
+		if d {
+			ret[b] |= Down
+		} else {
+			delete(c.down, b)
+		}
+	}
+	return ret
+}
+
+// Feed sets the sticks, and what the next call to Buttons returns. It's
+// for Collectors without a gamepad, see NewDetachedCollector.
+func (c *Collector) Feed(left, right float32, buttons ButtonState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.leftStick, c.rightStick = left, right
+	c.fed = make(ButtonState)
+	for b, s := range buttons {
+		c.fed[b] = s
+	}
 }
 
 type buttonMap struct {
@@ -87,18 +245,26 @@ type buttonMap struct {
 	button Button
 }
 
-func NewCollector() *Collector {
-	c := &Collector{
-		buttons: make(ButtonState),
+// NewDetachedCollector makes a Collector which doesn't look for gamepads,
+// and only has the state given to Feed, e.g. from a recording
+func NewDetachedCollector() *Collector {
+	return &Collector{
+		lastPress: make(map[Button]time.Time),
+		down: make(map[Button]bool),
 	}
+}
+
+func NewCollector() *Collector {
+	c := NewDetachedCollector()
 
 	stopChan := make(chan bool)
 
 	go func() {
 		sources := factory.Monitor()
 		for s := range sources {
-			log.Println("Source: ", s)
+			logger.Info("New source", "source", s)
 			conn := s.NewConnection()
+			dz := deadzone.Float()
 
 			btnMap := []buttonMap{
 				{ evdev.BTN_MODE, PS },
@@ -130,14 +296,14 @@ func NewCollector() *Collector {
 					X: thumbstick.Axis{ Code: evdev.ABS_X },
 					Y: thumbstick.Axis{ Code: evdev.ABS_Y, Invert: true },
 					Stick: thumbstick.Left,
-					Algo: thumbstick.CrossDeadzone{ XDeadzone: 0.2, YDeadzone: 0.2 },
+					Algo: thumbstick.CrossDeadzone{ XDeadzone: dz, YDeadzone: dz },
 				})
 			thumbstick.MapThumbstick(conn,
 				&thumbstick.Thumbstick{
 					X: thumbstick.Axis{ Code: evdev.ABS_RX },
 					Y: thumbstick.Axis{ Code: evdev.ABS_RY, Invert: true },
 					Stick: thumbstick.Right,
-					Algo: thumbstick.CrossDeadzone{ XDeadzone: 0.2, YDeadzone: 0.2 },
+					Algo: thumbstick.CrossDeadzone{ XDeadzone: dz, YDeadzone: dz },
 				})
 
 			sub := conn.Subscribe(stopChan)
@@ -0,0 +1,201 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package input
+
+import (
+	"testing"
+	"time"
+
+	"github.com/usedbytes/input2/button"
+)
+
+func press(c *Collector, b Button) {
+	c.handleButton(button.Event{ Keycode: int(b), Value: button.Pressed })
+}
+
+func hold(c *Collector, b Button) {
+	c.handleButton(button.Event{ Keycode: int(b), Value: button.Held })
+}
+
+func release(c *Collector, b Button) {
+	c.handleButton(button.Event{ Keycode: int(b), Value: button.Released })
+}
+
+// Check each call to Buttons returns the next of 'ticks'
+func expect(t *testing.T, name string, c *Collector, ticks ...ButtonState) {
+	t.Helper()
+
+	for i, want := range ticks {
+		got := c.Buttons()
+		if len(got) != len(want) {
+			t.Errorf("%s: tick %d got %v, expected %v", name, i, got, want)
+			continue
+		}
+		for b, s := range want {
+			if got[b] != s {
+				t.Errorf("%s: tick %d got %v, expected %v", name, i, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestButtons(t *testing.T) {
+	tests := []struct {
+		name string
+		events func(c *Collector)
+		ticks []ButtonState
+	}{
+		{
+			"Tap",
+			func(c *Collector) {
+				press(c, Cross)
+				release(c, Cross)
+			},
+			[]ButtonState{
+				{ Cross: Pressed | Released },
+				{},
+			},
+		},
+		{
+			// The second press waits for the next tick, and is the
+			// second half of a DoubleTap
+			"Two taps in one tick",
+			func(c *Collector) {
+				press(c, Cross)
+				release(c, Cross)
+				press(c, Cross)
+				release(c, Cross)
+			},
+			[]ButtonState{
+				{ Cross: Pressed | Released },
+				{ Cross: Pressed | DoubleTap | Released },
+				{},
+			},
+		},
+		{
+			// Only Cross's second press is held back
+			"Other buttons",
+			func(c *Collector) {
+				press(c, Cross)
+				press(c, Cross)
+				press(c, Square)
+			},
+			[]ButtonState{
+				{ Cross: Pressed | Down, Square: Pressed | Down },
+				{ Cross: Pressed | DoubleTap | Down, Square: Down },
+			},
+		},
+		{
+			"Third tap",
+			func(c *Collector) {
+				for i := 0; i < 3; i++ {
+					press(c, Circle)
+					release(c, Circle)
+				}
+			},
+			[]ButtonState{
+				{ Circle: Pressed | Released },
+				{ Circle: Pressed | DoubleTap | Released },
+				{ Circle: Pressed | Released },
+				{},
+			},
+		},
+		{
+			"Down across ticks",
+			func(c *Collector) {
+				press(c, L1)
+			},
+			[]ButtonState{
+				{ L1: Pressed | Down },
+				{ L1: Down },
+				{ L1: Down },
+			},
+		},
+	}
+
+	for _, test := range tests {
+		c := NewDetachedCollector()
+		test.events(c)
+		expect(t, test.name, c, test.ticks...)
+	}
+}
+
+func TestHeld(t *testing.T) {
+	c := NewDetachedCollector()
+
+	press(c, R1)
+	expect(t, "Press", c, ButtonState{ R1: Pressed | Down }, ButtonState{ R1: Down })
+
+	hold(c, R1)
+	expect(t, "Hold", c, ButtonState{ R1: Held | Down }, ButtonState{ R1: Down })
+
+	release(c, R1)
+	expect(t, "Release", c, ButtonState{ R1: Released }, ButtonState{})
+}
+
+func TestDoubleTapTime(t *testing.T) {
+	c := NewDetachedCollector()
+
+	press(c, Triangle)
+	release(c, Triangle)
+	expect(t, "First tap", c, ButtonState{ Triangle: Pressed | Released })
+
+	// Long enough ago not to count
+	c.lastPress[Triangle] = time.Now().Add(-time.Duration(doubleTapTime.Float() * 2 * float64(time.Second)))
+	press(c, Triangle)
+	release(c, Triangle)
+	expect(t, "Slow tap", c, ButtonState{ Triangle: Pressed | Released })
+
+	press(c, Triangle)
+	release(c, Triangle)
+	expect(t, "Quick tap", c, ButtonState{ Triangle: Pressed | DoubleTap | Released })
+}
+
+func TestQueueOverflow(t *testing.T) {
+	c := NewDetachedCollector()
+
+	// The oldest events go first
+	press(c, Square)
+	for i := 0; i < queueLen; i++ {
+		hold(c, Cross)
+	}
+
+	if len(c.events) != queueLen || c.dropped != 1 {
+		t.Fatalf("%d events queued, %d dropped, expected %d and 1", len(c.events), c.dropped, queueLen)
+	}
+
+	// A Held for each tick, as they can't be merged
+	expect(t, "Overflow", c, ButtonState{ Cross: Held })
+	if len(c.events) != queueLen - 1 || c.dropped != 0 {
+		t.Errorf("%d events queued, %d dropped, expected %d and 0", len(c.events), c.dropped, queueLen - 1)
+	}
+}
+
+func TestButtonsConcurrent(t *testing.T) {
+	c := NewDetachedCollector()
+
+	const taps = 100
+	go func() {
+		for i := 0; i < taps; i++ {
+			press(c, Cross)
+			release(c, Cross)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	pressed, released := 0, 0
+	for released < taps && time.Now().Before(deadline) {
+		s := c.Buttons()
+		if s.Pressed(Cross) {
+			pressed++
+		}
+		if s.Released(Cross) {
+			released++
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if pressed != taps || released != taps {
+		t.Errorf("%d presses and %d releases, expected %d", pressed, released, taps)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+
+// Package logging is a levelled, structured logger. Each package gets its
+// own Logger, whose level can be set separately, and messages carry
+// key-value fields along with whatever context the main loop has set (e.g.
+// tick, task and pose).
+//
+//	var logger = logging.New("line")
+//
+//	logger.Info("Lost line", "side", t.side)
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+	// Turns a package's logging off completely
+	Off
+)
+
+var levelNames = [...]string{ "debug", "info", "warn", "error", "off" }
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("Unknown log level '%s'", s)
+}
+
+type Field struct {
+	Key, Value string
+}
+
+// Entry is one logged message
+type Entry struct {
+	// Increases with every entry logged
+	Seq uint64
+	Time time.Time
+	Level Level
+	Package string
+	Message string
+	Fields []Field
+}
+
+func (e *Entry) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-5s %s: %s", strings.ToUpper(e.Level.String()), e.Package, e.Message)
+	for _, f := range e.Fields {
+		fmt.Fprintf(&b, " %s=%s", f.Key, f.Value)
+	}
+	return b.String()
+}
+
+// Which level each package logs at
+type pkg struct {
+	name string
+	level int32
+	// Set explicitly, rather than following the default
+	set bool
+}
+
+type root struct {
+	lock sync.Mutex
+	pkgs map[string]*pkg
+	level Level
+	sinks []Sink
+	context []interface{}
+	seq uint64
+	atExit []func()
+}
+
+var std = &root{
+	pkgs: make(map[string]*pkg),
+	level: Info,
+	sinks: []Sink{ NewWriterSink(os.Stderr) },
+}
+
+// SetLevel sets the level for package 'name', or for every package which
+// hasn't had its own set if 'name' is empty
+func SetLevel(name string, level Level) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+
+	if name == "" {
+		std.level = level
+		for _, p := range std.pkgs {
+			if !p.set {
+				atomic.StoreInt32(&p.level, int32(level))
+			}
+		}
+		return
+	}
+
+	p := std.pkg(name)
+	p.set = true
+	atomic.StoreInt32(&p.level, int32(level))
+}
+
+// SetLevels parses a list like "warn,line=debug,maze=info": a bare level
+// is the default, the others are for single packages
+func SetLevels(spec string) error {
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		name, level := "", s
+		if i := strings.Index(s, "="); i >= 0 {
+			name, level = s[:i], s[i + 1:]
+		}
+
+		l, err := ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		SetLevel(name, l)
+	}
+	return nil
+}
+
+// AddSink sends everything logged from now on to 's' as well
+func AddSink(s Sink) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+
+	std.sinks = append(std.sinks, s)
+}
+
+// SetContext sets key-value pairs to add to every message, until it's
+// next called. The values are formatted when something is logged, so
+// mustn't be changed afterwards.
+func SetContext(kv ...interface{}) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+
+	std.context = kv
+}
+
+func (r *root) pkg(name string) *pkg {
+	p, ok := r.pkgs[name]
+	if !ok {
+		p = &pkg{ name: name, level: int32(r.level) }
+		r.pkgs[name] = p
+	}
+	return p
+}
+
+func (r *root) write(e *Entry) {
+	r.lock.Lock()
+	r.seq++
+	e.Seq = r.seq
+	e.Fields = appendFields(e.Fields, r.context)
+	sinks := r.sinks
+	r.lock.Unlock()
+
+	for _, s := range sinks {
+		s.Write(e)
+	}
+}
+
+func formatValue(v interface{}) string {
+	var s string
+	switch x := v.(type) {
+	case float32:
+		s = strconv.FormatFloat(float64(x), 'g', 5, 32)
+	case float64:
+		s = strconv.FormatFloat(x, 'g', 5, 64)
+	case error:
+		s = x.Error()
+	case string:
+		s = x
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func appendFields(fields []Field, kv []interface{}) []Field {
+	for i := 0; i < len(kv); i += 2 {
+		if i + 1 == len(kv) {
+			fields = append(fields, Field{ "!extra", formatValue(kv[i]) })
+			break
+		}
+		fields = append(fields, Field{ fmt.Sprint(kv[i]), formatValue(kv[i + 1]) })
+	}
+	return fields
+}
+
+// Logger logs messages for one package. Methods take a message, then
+// alternating keys and values.
+type Logger struct {
+	pkg *pkg
+	fields []Field
+	limit *limiter
+}
+
+// Enabled returns whether messages at 'level' would be logged, for
+// skipping expensive fields
+func (l *Logger) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&l.pkg.level))
+}
+
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	now := time.Now()
+	var suppressed int
+	if l.limit != nil {
+		var ok bool
+		if suppressed, ok = l.limit.allow(msg, now); !ok {
+			return
+		}
+	}
+
+	fields := make([]Field, 0, len(kv) / 2 + len(l.fields) + 1)
+	fields = appendFields(fields, kv)
+	fields = append(fields, l.fields...)
+	if suppressed > 0 {
+		fields = append(fields, Field{ "suppressed", strconv.Itoa(suppressed) })
+	}
+
+	std.write(&Entry{
+		Time: now,
+		Level: level,
+		Package: l.pkg.name,
+		Message: msg,
+		Fields: fields,
+	})
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.Log(Debug, msg, kv...)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.Log(Info, msg, kv...)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.Log(Warn, msg, kv...)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.Log(Error, msg, kv...)
+}
+
+// AtExit adds 'fn' to the functions Fatal calls before exiting, e.g. to
+// write out files. They're called in the order they were added.
+func AtExit(fn func()) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+
+	std.atExit = append(std.atExit, fn)
+}
+
+// Fatal logs at Error, whatever the level, and exits
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	(&Logger{ pkg: &pkg{ name: l.pkg.name }, fields: l.fields }).Error(msg, kv...)
+
+	std.lock.Lock()
+	atExit := std.atExit
+	std.lock.Unlock()
+	for _, fn := range atExit {
+		fn()
+	}
+
+	os.Exit(1)
+}
+
+// With returns a Logger which adds 'kv' to every message
+func (l *Logger) With(kv ...interface{}) *Logger {
+	ret := *l
+	ret.fields = appendFields(append([]Field(nil), l.fields...), kv)
+	return &ret
+}
+
+// Every returns a Logger which logs each message at most once every
+// 'period', for things which happen every tick. How many were dropped in
+// between is added as "suppressed".
+func (l *Logger) Every(period time.Duration) *Logger {
+	ret := *l
+	ret.limit = &limiter{
+		period: period,
+		messages: make(map[string]*limitState),
+	}
+	return &ret
+}
+
+type limitState struct {
+	last time.Time
+	suppressed int
+}
+
+type limiter struct {
+	lock sync.Mutex
+	period time.Duration
+	messages map[string]*limitState
+}
+
+// Returns whether 'msg' can be logged now, and if so how many times it
+// was suppressed since it last was
+func (l *limiter) allow(msg string, now time.Time) (int, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	s, ok := l.messages[msg]
+	if !ok {
+		l.messages[msg] = &limitState{ last: now }
+		return 0, true
+	}
+
+	if now.Sub(s.last) < l.period {
+		s.suppressed++
+		return 0, false
+	}
+
+	n := s.suppressed
+	s.last, s.suppressed = now, 0
+	return n, true
+}
+
+// New returns the Logger for package 'name'
+func New(name string) *Logger {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+
+	return &Logger{ pkg: std.pkg(name) }
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Sink is somewhere log entries go. Write may be called from any
+// goroutine, and mustn't keep 'e' or modify it.
+type Sink interface {
+	Write(e *Entry)
+}
+
+type writerSink struct {
+	lock sync.Mutex
+	w io.Writer
+}
+
+func (s *writerSink) Write(e *Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fmt.Fprintf(s.w, "%s %s\n", e.Time.Format("2006/01/02 15:04:05.000"), e.String())
+}
+
+// NewWriterSink writes entries to 'w' as lines of text. The default sink
+// writes to stderr.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{ w: w }
+}
@@ -2,23 +2,48 @@
 package main
 
 import (
+	"bytes"
+	"flag"
+	"fmt"
 	"image"
-	"log"
+	"image/png"
 	"net"
 	"net/rpc"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/usedbytes/mini_mouse/bot/interface/input"
 	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/control"
+	"github.com/usedbytes/mini_mouse/bot/dashboard"
+	"github.com/usedbytes/mini_mouse/bot/logging"
 	"github.com/usedbytes/mini_mouse/bot/model"
-	"github.com/usedbytes/mini_mouse/bot/plan"
-	"github.com/usedbytes/mini_mouse/bot/plan/rc"
 	"github.com/usedbytes/mini_mouse/bot/plan/line"
-	"github.com/usedbytes/mini_mouse/bot/plan/waypoint"
+	"github.com/usedbytes/mini_mouse/bot/plan/line/algo"
+	"github.com/usedbytes/mini_mouse/bot/recorder"
+	"github.com/usedbytes/mini_mouse/bot/sched"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+	"github.com/usedbytes/mini_mouse/bot/tunable"
+	"github.com/usedbytes/mini_mouse/bot/vision"
 )
 
+// The rendered occupancy map, published on "model/map"
+type MapImage struct {
+	Image *image.Gray
+	// mm per pixel, and the world position of the bottom-left corner
+	Resolution float32
+	Origin model.Coord
+}
+
+var logger = logging.New("main")
+
+var mapTopic = telemetry.NewTopic("model/map", MapImage{})
+
 type Pose struct {
 	X, Y float64
 	Heading float64
@@ -29,6 +54,14 @@ type Telem struct {
 	Euler []float64
 	Pose Pose
 	Frame image.Gray
+	Map image.Gray
+	MapVersion int
+
+	lineTask *line.Task
+	LineQuality algo.Quality
+	LineFloor line.Floor
+
+	vision *vision.Pipeline
 }
 
 func (t *Telem) SetEuler(vec []float64) {
@@ -72,94 +105,339 @@ func (t *Telem) SetFrame(img *image.Gray) {
 	copy(t.Frame.Pix, img.Pix)
 }
 
-func (t *Telem) GetPose(ignored bool, pose *Pose) error {
+func (t *Telem) SetMap(g *model.Grid) {
+	if g.Version() == t.MapVersion {
+		return
+	}
+	img := g.Image()
+	mapTopic.Publish(MapImage{ img, g.Resolution(), g.Origin() })
+
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	*pose = t.Pose
+	t.Map = *img
+	t.MapVersion = g.Version()
+}
+
+// GetMap returns the occupancy map encoded as "png" or "pgm"
+func (t *Telem) GetMap(format string, data *[]byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.Map.Pix == nil {
+		return fmt.Errorf("No map")
+	}
+
+	buf := &bytes.Buffer{}
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(buf, &t.Map)
+	case "pgm":
+		err = model.EncodePGM(buf, &t.Map)
+	default:
+		err = fmt.Errorf("Unknown map format '%s'", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	*data = buf.Bytes()
 
 	return nil
 }
 
-func main() {
-	log.Println("Mini Mouse")
+func (t *Telem) SetLineTask(task *line.Task) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	ip := input.NewCollector()
+	t.lineTask = task
+}
 
-	telem := Telem{Euler: make([]float64, 3)}
+func (t *Telem) getLineTask() (*line.Task, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	rpc.Register(&telem)
-	rpc.HandleHTTP()
-	l, err := net.Listen("tcp", ":1234")
+	if t.lineTask == nil {
+		return nil, fmt.Errorf("No line task")
+	}
+
+	return t.lineTask, nil
+}
+
+func (t *Telem) GetLineGains(ignored bool, g *line.Gains) error {
+	task, err := t.getLineTask()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	go http.Serve(l, nil)
 
-	platform, err := base.NewPlatform()
-	if (err != nil) {
-		log.Fatalf(err.Error())
+	*g = task.Gains()
+
+	return nil
+}
+
+func (t *Telem) SetLineGains(g line.Gains, ignored *bool) error {
+	task, err := t.getLineTask()
+	if err != nil {
+		return err
 	}
-	mod := model.NewModel(platform)
 
-	wpTask := waypoint.NewTask(mod, platform)
-	wpTask.SetWaypoint(model.Coord{ 0, 0 })
+	task.SetGains(g)
 
-	lineTask := line.NewTask(platform)
+	return nil
+}
 
-	planner := plan.NewPlanner()
-	planner.AddTask(line.TaskName, lineTask)
-	planner.AddTask(waypoint.TaskName, wpTask)
-	planner.AddTask(rc.TaskName, rc.NewTask(ip, platform))
-	planner.SetTask(rc.TaskName)
+func (t *Telem) SetLineQuality(q algo.Quality) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
+	t.LineQuality = q
+}
 
-	tick := time.NewTicker(16 * time.Millisecond)
+func (t *Telem) SetLineFloor(f line.Floor) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	lastTime := time.Now()
+	t.LineFloor = f
+}
 
-	for _ = range tick.C {
-		err = platform.Update()
-		if err != nil {
-			log.Println(err.Error())
-		}
-		mod.Tick()
+func (t *Telem) GetLineFloor(ignored bool, f *line.Floor) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-		pos, angle := mod.GetPose()
-		telem.SetPose(float64(pos.X), float64(pos.Y), float64(angle))
+	*f = t.LineFloor
 
-		frame, frameTime := platform.GetFrame()
-		if frame != nil && frameTime != lastTime {
-			telem.SetFrame(&frame.Gray)
-			lastTime = frameTime
-		}
+	return nil
+}
+
+func (t *Telem) GetLineQuality(ignored bool, q *algo.Quality) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-		buttons := ip.Buttons()
-		planner.Tick(buttons)
+	*q = t.LineQuality
 
-		if buttons[input.Triangle] == input.Pressed {
-			mod.ResetOrientation()
-		}
+	return nil
+}
+
+func (t *Telem) SetVision(p *vision.Pipeline) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.vision = p
+}
+
+func (t *Telem) getVision() (*vision.Pipeline, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.vision == nil {
+		return nil, fmt.Errorf("No vision pipeline")
+	}
+
+	return t.vision, nil
+}
+
+func (t *Telem) GetVisionTimings(ignored bool, timings *[]vision.Timing) error {
+	p, err := t.getVision()
+	if err != nil {
+		return err
+	}
 
-		if buttons[input.Share] == input.Pressed {
-			if platform.CameraEnabled() {
-				platform.DisableCamera()
-			} else {
-				platform.EnableCamera()
-			}
+	*timings = p.Latest().Timings
+
+	return nil
+}
+
+func (t *Telem) SetVisionDebug(debug bool, ignored *bool) error {
+	p, err := t.getVision()
+	if err != nil {
+		return err
+	}
+
+	p.SetDebug(debug)
+
+	return nil
+}
+
+// GetVisionDebug returns the most recent frame as it was after stage 'name'
+func (t *Telem) GetVisionDebug(name string, img *image.Gray) error {
+	p, err := t.getVision()
+	if err != nil {
+		return err
+	}
+
+	dbg, err := p.DebugImage(name)
+	if err != nil {
+		return err
+	}
+
+	*img = *dbg
+
+	return nil
+}
+
+func (t *Telem) GetPose(ignored bool, pose *Pose) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	*pose = t.Pose
+
+	return nil
+}
+
+func loadTunables(path string, persist bool) {
+	if path == "" {
+		return
+	}
+
+	var err error
+	if persist {
+		err = tunable.Default.Persist(path)
+	} else {
+		err = tunable.Default.Load(path)
+	}
+	if err != nil {
+		logger.Warn("Loading tunables", "err", err)
+	}
+}
+
+// Camera resolutions. Line following only needs a few pixels across the
+// line, reading floor tags needs many more: with camera.Default, 160x120
+// reads 20 mm tags 150 mm in front of the robot.
+const (
+	lineCamera = "16x32"
+	fiducialCamera = "160x120"
+)
+
+func main() {
+	arenaFile := flag.String("arena", "", "Arena map file, for localising from floor tags")
+	recordDir := flag.String("record", "", "Directory to record runs into, for replaying later")
+	recordFileMB := flag.Int("record-file-mb", 64, "Size to start a new recording file at, in MB")
+	recordTotalMB := flag.Int("record-total-mb", 1024, "Size to keep the recording directory under, in MB")
+	replayPath := flag.String("replay", "", "Recording file or directory to replay instead of running the robot")
+	replayRun := flag.String("replay-run", "", "Run to replay from a -replay directory, e.g. \"20180512-143005.120\". Defaults to the latest")
+	replayDiffs := flag.Int("replay-diffs", 20, "How many differences to print when replaying")
+	tunablesFile := flag.String("tunables", "tunables.json", "File to keep tuned parameters in, \"\" to not save them")
+	rate := flag.Float64("rate", 62.5, "Control loop rate, in Hz")
+	calibrationFile := flag.String("calibration", "calibration.json", "File to keep the camera calibration in, fitted with the control API's calibrate. \"\" to use the default calibration")
+	cameraSize := flag.String("camera", "", "Camera resolution, e.g. \"160x120\". Defaults to " + lineCamera + ", or " + fiducialCamera + " with -arena so that tags can be read")
+	mapSize := flag.String("map", "3000x3000", "Size of the occupancy map in mm, centred on where the robot starts")
+	mapResolution := flag.Float64("map-resolution", 10, "Size of each occupancy map cell, in mm")
+	logLevels := flag.String("log", "info", "Log levels, e.g. \"warn,line=debug\" for debug from the line task and warnings from the rest")
+	flag.Parse()
+
+	if err := logging.SetLevels(*logLevels); err != nil {
+		logger.Fatal("Bad -log", "err", err)
+	}
+	if *rate <= 0 {
+		logger.Fatal("-rate must be positive")
+	}
+
+	var mcfg model.Config
+	if _, err := fmt.Sscanf(*mapSize, "%gx%g", &mcfg.MapWidth, &mcfg.MapHeight); err != nil || mcfg.MapWidth <= 0 || mcfg.MapHeight <= 0 {
+		logger.Fatal("Bad -map", "map", *mapSize)
+	}
+	if *mapResolution <= 0 {
+		logger.Fatal("-map-resolution must be positive")
+	}
+	mcfg.MapResolution = float32(*mapResolution)
+
+	var arena *model.Arena
+	if *arenaFile != "" {
+		var err error
+		arena, err = model.LoadArena(*arenaFile)
+		if err != nil {
+			logger.Fatal("Loading arena", "err", err)
 		}
+	}
 
-		if buttons[input.Square] == input.Pressed {
-			log.Println("Square.")
-			planner.SetTask("waypoint")
+	var cfg base.Config
+	if *calibrationFile != "" {
+		var err error
+		cfg.Calibration, err = camera.Load(*calibrationFile)
+		if err != nil {
+			logger.Fatal("Loading calibration", "err", err)
 		}
+	}
 
-		if buttons[input.Cross] == input.Pressed {
-			planner.SetTask(line.TaskName)
+	if *replayPath != "" {
+		os.Exit(runReplay(*replayPath, *replayRun, arena, cfg, mcfg, *tunablesFile, *replayDiffs))
+	}
+
+	if *cameraSize == "" {
+		*cameraSize = lineCamera
+		if arena != nil {
+			*cameraSize = fiducialCamera
 		}
+	}
+	if _, err := fmt.Sscanf(*cameraSize, "%dx%d", &cfg.CameraWidth, &cfg.CameraHeight); err != nil || cfg.CameraWidth <= 0 || cfg.CameraHeight <= 0 {
+		logger.Fatal("Bad -camera", "camera", *cameraSize)
+	}
+
+	logging.AddSink(telemetry.NewLogSink("log", 50))
+	logger.Info("Mini Mouse")
+
+	ip := input.NewCollector()
 
-		if buttons[input.Circle] == input.Pressed {
-			planner.SetTask("rc")
+	telem := &Telem{Euler: make([]float64, 3)}
+
+	rpc.Register(telem)
+	rpc.HandleHTTP()
+	l, err := net.Listen("tcp", ":1234")
+	if err != nil {
+		logger.Fatal("Listening", "err", err)
+	}
+	http.Handle("/telemetry/", telemetry.NewServer(telemetry.Default, "/telemetry/"))
+	go http.Serve(l, nil)
+
+	platform, err := base.NewPlatform(cfg)
+	if (err != nil) {
+		logger.Fatal("Creating platform", "err", err)
+	}
+
+	bot := newRobot(platform, ip, telem, arena, mcfg, false)
+	bot.ctl.SetCalibrationFile(*calibrationFile)
+
+	var rec *recorder.Recorder
+	if *recordDir != "" {
+		rec, err = recorder.NewRecorder(*recordDir, int64(*recordFileMB) << 20, int64(*recordTotalMB) << 20)
+		if err != nil {
+			logger.Fatal("Starting recorder", "err", err)
 		}
+		bot.SetRecorder(rec)
+		// Don't lose the end of the recording, it's the interesting part
+		logging.AtExit(func() { rec.Close() })
+	}
+
+	loadTunables(*tunablesFile, true)
+	tunable.Default.Publish()
+
+	rpc.Register(bot.ctl)
+	http.Handle("/control/", control.NewServer(bot.ctl, "/control/"))
+
+	dash := dashboard.NewServer("/dashboard/", bot.planner.Tasks(), platform.Calibration.Crop, "/telemetry/", "/control/")
+	http.Handle("/dashboard/", dash)
+
+	loop := sched.NewLoop(*rate, bot.stages...)
+	// Reading the IMU waits on the I2C bus, so keep it out of the loop
+	if poll := platform.IMUPoller(); poll != nil {
+		loop.Background("imu", 10 * time.Millisecond, poll)
+	}
+
+	// Finish the tick we're in, then shut down cleanly. A second signal
+	// kills us straight away.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		logger.Info("Stopping", "signal", sig)
+		loop.Stop()
+	}()
+
+	loop.Run()
+
+	if err := rec.Close(); err != nil {
+		logger.Error("Closing recording", "err", err)
 	}
 }
@@ -0,0 +1,160 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// ArenaTag is a fiducial tag lying flat on the arena floor
+type ArenaTag struct {
+	ID int
+	Centre Coord
+	// Direction the top of the tag faces, radians anti-clockwise from +X
+	Heading float32
+	// Side of the tag's black square, mm
+	Size float32
+}
+
+// Corners returns the corners of the tag's black square in arena
+// coordinates: top-left, top-right, bottom-right, bottom-left as printed
+func (t ArenaTag) Corners() [4]Coord {
+	up := Coord{ cos32(t.Heading), sin32(t.Heading) }.Scale(t.Size / 2)
+	right := Coord{ sin32(t.Heading), -cos32(t.Heading) }.Scale(t.Size / 2)
+
+	return [4]Coord{
+		t.Centre.Add(up).Sub(right),
+		t.Centre.Add(up).Add(right),
+		t.Centre.Sub(up).Add(right),
+		t.Centre.Sub(up).Sub(right),
+	}
+}
+
+// TagSighting is a tag seen by the robot, with its corners (in the same
+// order as ArenaTag.Corners) on the floor relative to the robot. X is
+// forwards and Y to the left.
+type TagSighting struct {
+	ID int
+	Corners [4]Coord
+}
+
+// Arena holds the positions of the tags in the arena
+type Arena struct {
+	Tags map[int]ArenaTag
+}
+
+// ParseArena reads an arena map, which has one tag per line:
+//
+//	# id  x (mm)  y (mm)  heading (degrees)  size (mm)
+//	0     500     0       90                 50
+//
+// Blank lines and anything after a '#' are ignored.
+func ParseArena(r io.Reader) (*Arena, error) {
+	a := &Arena{
+		Tags: make(map[int]ArenaTag),
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var t ArenaTag
+		var heading float32
+		_, err := fmt.Sscan(line, &t.ID, &t.Centre.X, &t.Centre.Y, &heading, &t.Size)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+		if _, ok := a.Tags[t.ID]; ok {
+			return nil, fmt.Errorf("Line %d: duplicate tag %d", n, t.ID)
+		}
+
+		t.Heading = heading * math.Pi / 180
+		a.Tags[t.ID] = t
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func LoadArena(path string) (*Arena, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseArena(f)
+}
+
+// Sightings whose corners are further than this (RMS, mm) from where the
+// map says they should be are rejected
+const maxTagError = 20
+
+// Locate finds the robot's pose in the arena from the tags it can see, by
+// fitting the sighted corners onto the mapped ones
+func (a *Arena) Locate(tags []TagSighting) (Coord, float32, error) {
+	var from, to []Coord
+	for _, s := range tags {
+		t, ok := a.Tags[s.ID]
+		if !ok {
+			continue
+		}
+		corners := t.Corners()
+		from = append(from, s.Corners[:]...)
+		to = append(to, corners[:]...)
+	}
+
+	if len(from) == 0 {
+		return Coord{}, 0, fmt.Errorf("No known tags")
+	}
+
+	var fc, tc Coord
+	for i := range from {
+		fc = fc.Add(from[i])
+		tc = tc.Add(to[i])
+	}
+	fc = fc.Scale(1 / float32(len(from)))
+	tc = tc.Scale(1 / float32(len(to)))
+
+	// Best rotation between the two sets of points, about their centres
+	var dot, cross float64
+	for i := range from {
+		f, t := from[i].Sub(fc), to[i].Sub(tc)
+		dot += float64(f.X * t.X + f.Y * t.Y)
+		cross += float64(f.X * t.Y - f.Y * t.X)
+	}
+	heading := float32(math.Atan2(cross, dot))
+
+	rotate := func(c Coord) Coord {
+		return Coord{
+			c.X * cos32(heading) - c.Y * sin32(heading),
+			c.X * sin32(heading) + c.Y * cos32(heading),
+		}
+	}
+	pos := tc.Sub(rotate(fc))
+
+	var sq float32
+	for i := range from {
+		d := pos.Add(rotate(from[i])).Sub(to[i])
+		sq += d.X * d.X + d.Y * d.Y
+	}
+	rms := float32(math.Sqrt(float64(sq / float32(len(from)))))
+	if rms > maxTagError {
+		return Coord{}, 0, fmt.Errorf("Tags don't match the map (error %.1f mm)", rms)
+	}
+
+	return pos, heading, nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+)
+
+// Log-odds increments for a cell seen occupied/free, and the clamp which
+// stops cells becoming too certain to ever change.
+const (
+	logOddsOccupied = 0.85
+	logOddsFree = -0.4
+	logOddsMax = 3.5
+)
+
+// Grid is a 2D occupancy grid, with each cell storing the log-odds of it
+// being occupied. World coordinates are in mm, with the grid centred on the
+// origin.
+type Grid struct {
+	resolution float32
+	origin Coord
+	w, h int
+
+	cells []float32
+	version int
+}
+
+func (g *Grid) Resolution() float32 {
+	return g.resolution
+}
+
+// Origin is the world position of the corner of cell (0, 0)
+func (g *Grid) Origin() Coord {
+	return g.origin
+}
+
+func (g *Grid) Size() (int, int) {
+	return g.w, g.h
+}
+
+// Version is incremented each time the grid is modified
+func (g *Grid) Version() int {
+	return g.version
+}
+
+func (g *Grid) Cell(c Coord) (int, int) {
+	x := int(math.Floor(float64((c.X - g.origin.X) / g.resolution)))
+	y := int(math.Floor(float64((c.Y - g.origin.Y) / g.resolution)))
+	return x, y
+}
+
+// Coord returns the centre of cell (x, y)
+func (g *Grid) Coord(x, y int) Coord {
+	return Coord{
+		g.origin.X + (float32(x) + 0.5) * g.resolution,
+		g.origin.Y + (float32(y) + 0.5) * g.resolution,
+	}
+}
+
+func (g *Grid) InBounds(x, y int) bool {
+	return x >= 0 && y >= 0 && x < g.w && y < g.h
+}
+
+func (g *Grid) LogOdds(x, y int) float32 {
+	if !g.InBounds(x, y) {
+		return 0
+	}
+	return g.cells[y * g.w + x]
+}
+
+func (g *Grid) Probability(x, y int) float32 {
+	l := float64(g.LogOdds(x, y))
+	return float32(1.0 - 1.0 / (1.0 + math.Exp(l)))
+}
+
+func (g *Grid) Occupied(x, y int) bool {
+	return g.LogOdds(x, y) > 0
+}
+
+func (g *Grid) update(x, y int, delta float32) {
+	if !g.InBounds(x, y) {
+		return
+	}
+
+	l := g.cells[y * g.w + x] + delta
+	if l > logOddsMax {
+		l = logOddsMax
+	} else if l < -logOddsMax {
+		l = -logOddsMax
+	}
+	g.cells[y * g.w + x] = l
+}
+
+func (g *Grid) SetOccupied(c Coord, occupied bool) {
+	x, y := g.Cell(c)
+	if !g.InBounds(x, y) {
+		return
+	}
+
+	if occupied {
+		g.cells[y * g.w + x] = logOddsMax
+	} else {
+		g.cells[y * g.w + x] = -logOddsMax
+	}
+	g.version++
+}
+
+func (g *Grid) Clear() {
+	for i := range g.cells {
+		g.cells[i] = 0
+	}
+	g.version++
+}
+
+// Walk the cells between (x0, y0) and (x1, y1) inclusive, stopping early if
+// fn returns false
+func traceLine(x0, y0, x1, y1 int, fn func(x, y int) bool) {
+	dx := abs(x1 - x0)
+	dy := -abs(y1 - y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+
+	for {
+		if !fn(x0, y0) || (x0 == x1 && y0 == y1) {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// AddRay updates the grid from a range reading taken at 'from' pointing in
+// direction 'angle'. Cells along the ray are marked free, and the cell at
+// 'dist' is marked occupied unless dist is at or beyond maxRange.
+func (g *Grid) AddRay(from Coord, angle, dist, maxRange float32) {
+	hit := dist < maxRange
+	if !hit {
+		dist = maxRange
+	}
+
+	to := from.Add(Coord{dist * cos32(angle), dist * sin32(angle)})
+	x0, y0 := g.Cell(from)
+	x1, y1 := g.Cell(to)
+
+	traceLine(x0, y0, x1, y1, func(x, y int) bool {
+		if x == x1 && y == y1 {
+			return false
+		}
+		g.update(x, y, logOddsFree)
+		return true
+	})
+
+	if hit {
+		g.update(x1, y1, logOddsOccupied)
+	}
+
+	g.version++
+}
+
+// Raycast returns the distance from 'from' along 'angle' to the first
+// occupied cell, or maxRange if there isn't one. It can be used to simulate
+// range sensors against a known map.
+func (g *Grid) Raycast(from Coord, angle, maxRange float32) float32 {
+	to := from.Add(Coord{maxRange * cos32(angle), maxRange * sin32(angle)})
+	x0, y0 := g.Cell(from)
+	x1, y1 := g.Cell(to)
+
+	dist := maxRange
+	traceLine(x0, y0, x1, y1, func(x, y int) bool {
+		if g.Occupied(x, y) {
+			d := g.Coord(x, y).Sub(from)
+			dist = float32(math.Hypot(float64(d.X), float64(d.Y))) - g.resolution / 2
+			if dist < 0 {
+				dist = 0
+			}
+			return false
+		}
+		return true
+	})
+
+	return dist
+}
+
+// Image renders the grid with free space white, obstacles black and
+// unknown cells grey. +Y is up.
+func (g *Grid) Image() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, g.w, g.h))
+	for y := 0; y < g.h; y++ {
+		row := img.Pix[img.Stride * (g.h - 1 - y):]
+		for x := 0; x < g.w; x++ {
+			row[x] = uint8(255 * (1.0 - g.Probability(x, y)))
+		}
+	}
+	return img
+}
+
+func (g *Grid) WritePNG(w io.Writer) error {
+	return png.Encode(w, g.Image())
+}
+
+func (g *Grid) WritePGM(w io.Writer) error {
+	return EncodePGM(w, g.Image())
+}
+
+// EncodePGM writes img as a binary (P5) PGM
+func EncodePGM(w io.Writer, img *image.Gray) error {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P5\n%d %d\n255\n", width, height)
+	for y := 0; y < height; y++ {
+		bw.Write(img.Pix[img.Stride * y : img.Stride * y + width])
+	}
+	return bw.Flush()
+}
+
+// NewGrid creates a grid 'width' x 'height' mm, with square cells of
+// 'resolution' mm
+func NewGrid(width, height, resolution float32) *Grid {
+	w := int(math.Ceil(float64(width / resolution)))
+	h := int(math.Ceil(float64(height / resolution)))
+
+	return &Grid{
+		resolution: resolution,
+		origin: Coord{ -float32(w) * resolution / 2, -float32(h) * resolution / 2 },
+		w: w,
+		h: h,
+		cells: make([]float32, w * h),
+	}
+}
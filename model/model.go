@@ -2,9 +2,12 @@
 package model
 
 import (
+	"fmt"
 	"math"
 
 	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/base/rangefinder"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
 )
 
 type Coord struct {
@@ -19,13 +22,31 @@ func (c Coord) Add(b Coord) Coord {
 	return Coord{ c.X + b.X, c.Y + b.Y }
 }
 
+func (c Coord) Scale(s float32) Coord {
+	return Coord{ c.X * s, c.Y * s }
+}
+
+// Pose is published on "model/pose" every tick
+type Pose struct {
+	X, Y float32
+	Heading float32
+}
+
+var poseTopic = telemetry.NewTopic("model/pose", Pose{})
+
 type Model struct {
 	platform *base.Platform
 
 	pos Coord
 	ori float32
 
+	// Wheel distances and IMU heading at the last tick
+	started bool
 	prevDist Coord
+	prevRot float32
+
+	grid *Grid
+	arena *Arena
 }
 
 func (m *Model) GetPose() ( Coord, float32 ) {
@@ -44,53 +65,155 @@ func cos32(x float32) float32 {
 	return float32(math.Cos(float64(x)))
 }
 
+func (m *Model) Map() *Grid {
+	return m.grid
+}
+
+func (m *Model) SetMap(g *Grid) {
+	m.grid = g
+}
+
+// AddRange adds a range reading from a sensor mounted on the robot to the
+// map, using the current pose
+func (m *Model) AddRange(mount rangefinder.Mount, dist, maxRange float32) {
+	if m.grid == nil {
+		return
+	}
+
+	from := m.pos.Add(Coord{
+		mount.X * cos32(m.ori) - mount.Y * sin32(m.ori),
+		mount.X * sin32(m.ori) + mount.Y * cos32(m.ori),
+	})
+	m.grid.AddRay(from, m.ori + mount.Angle, dist, maxRange)
+}
+
+// AddObstacle adds an obstacle 'dist' mm from the robot centre, at 'bearing'
+// relative to the robot's heading, to the map. Everything closer is taken to
+// be free.
+func (m *Model) AddObstacle(bearing, dist, maxRange float32) {
+	m.AddRange(rangefinder.Mount{ Angle: bearing }, dist, maxRange)
+}
+
 func (m *Model) ResetOrientation() {
 	m.pos = Coord{ 0.0, 0.0 }
 	m.ori = 0.0
 }
 
-func (m *Model) Tick() {
-	/*
-	wb := m.platform.Wheelbase()
+func (m *Model) Arena() *Arena {
+	return m.arena
+}
+
+// SetArena sets the map of tags used by AddTags
+func (m *Model) SetArena(a *Arena) {
+	m.arena = a
+}
+
+func wrap(a float32) float32 {
+	return float32(math.Atan2(math.Sin(float64(a)), math.Cos(float64(a))))
+}
+
+// How far each tag fix moves the pose towards it, 0 to 1
+const fixGain = 0.5
+
+// AddTags corrects the pose using tags seen by the camera, which are looked
+// up in the arena map
+func (m *Model) AddTags(tags []TagSighting) error {
+	if m.arena == nil {
+		return fmt.Errorf("No arena map")
+	}
+
+	pos, ori, err := m.arena.Locate(tags)
+	if err != nil {
+		return err
+	}
+
+	m.pos = m.pos.Add(pos.Sub(m.pos).Scale(fixGain))
+
+	m.ori = wrap(m.ori + wrap(ori - m.ori) * fixGain)
+
+	return nil
+}
 
+// How much of each heading change is taken from the IMU, when there is one,
+// rather than from the wheels. The wheels slip when turning, the IMU only
+// drifts slowly.
+const imuWeight = 0.9
+
+// Below this, in radians per tick, a move is treated as a straight line
+const minTurn = 1e-4
+
+// odometry moves the pose by how far the wheels have gone since the last
+// tick, turning by the heading change fused from the wheels and the IMU
+func (m *Model) odometry() {
 	a, b := m.platform.GetDistance()
 	newDist := Coord{ a, b }
-	delta := newDist.Sub(m.prevDist)
+	rot, hasIMU := m.platform.GetRot(), m.platform.HasIMU()
 
-	w := (delta.Y - delta.X) / (wb)
-	r := (wb / 2) * (delta.X + delta.Y) / (delta.Y - delta.X)
+	if !m.started {
+		m.prevDist, m.prevRot = newDist, rot
+		m.started = true
+		return
+	}
 
-	if w == 0.0 {
-		m.pos = m.pos.Add(Coord{delta.X * cos32(m.ori), delta.Y * sin32(m.ori) })
+	delta := newDist.Sub(m.prevDist)
+	dist := (delta.X + delta.Y) / 2
+	w := (delta.Y - delta.X) / m.platform.Wheelbase()
+	if hasIMU {
+		w = imuWeight * wrap(rot - m.prevRot) + (1 - imuWeight) * w
+	}
+
+	if w > -minTurn && w < minTurn {
+		heading := m.ori + w / 2
+		m.pos = m.pos.Add(Coord{ dist * cos32(heading), dist * sin32(heading) })
 	} else {
-		rotCentre := Coord{m.pos.X - r * sin32(m.ori), m.pos.Y + r * cos32(m.ori)}
-		if rotCentre.IsNaN() {
-			log.Printf("rotCentre.IsNaN() - w: %v, rotCentre: %v, r: %v\n", w, rotCentre, r)
-			return
-		}
+		// Going round an arc of radius r, about rotCentre
+		r := dist / w
+		rotCentre := Coord{ m.pos.X - r * sin32(m.ori), m.pos.Y + r * cos32(m.ori) }
 		tmp := m.pos.Sub(rotCentre)
-		tmp.X = tmp.X * cos32(w) - tmp.Y * sin32(w)
-		tmp.Y = tmp.X * sin32(w) + tmp.Y * cos32(w)
-		if tmp.IsNaN() {
-			log.Printf("tmp.IsNaN() - w: %v, rotCentre: %v, r: %v\n", w, rotCentre, r)
-			return
+		tmp = Coord{
+			tmp.X * cos32(w) - tmp.Y * sin32(w),
+			tmp.X * sin32(w) + tmp.Y * cos32(w),
 		}
 		m.pos = tmp.Add(rotCentre)
 	}
 
-	m.ori += w
-	if m.ori > math.Pi || m.ori < -math.Pi {
-		m.ori = float32(math.Atan2(math.Sin(float64(m.ori)), math.Cos(float64(m.ori))))
+	m.ori = wrap(m.ori + w)
+	m.prevDist, m.prevRot = newDist, rot
+}
+
+func (m *Model) Tick() {
+	m.odometry()
+
+	for _, r := range m.platform.GetRanges() {
+		m.AddRange(r.Mount, r.Distance, r.MaxRange)
 	}
-	m.prevDist = newDist
-	*/
 
-	m.ori = m.platform.GetRot()
+	poseTopic.Publish(Pose{ m.pos.X, m.pos.Y, m.ori })
 }
 
-func NewModel(p *base.Platform) *Model {
+// Config is the set-up of the model. Zero fields take the defaults.
+type Config struct {
+	// Size of the occupancy map, in mm, centred on the start position.
+	// Defaults to 3000 x 3000.
+	MapWidth, MapHeight float32
+	// Size of each map cell, in mm. Defaults to 10.
+	MapResolution float32
+}
+
+func NewModel(p *base.Platform, cfg Config) *Model {
+	if cfg.MapWidth == 0 {
+		cfg.MapWidth = 3000
+	}
+	if cfg.MapHeight == 0 {
+		cfg.MapHeight = 3000
+	}
+	if cfg.MapResolution == 0 {
+		cfg.MapResolution = 10
+	}
+
 	m := &Model{
 		platform: p,
+		grid: NewGrid(cfg.MapWidth, cfg.MapHeight, cfg.MapResolution),
 	}
 
 	m.ResetOrientation()
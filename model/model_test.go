@@ -0,0 +1,139 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/mini_mouse/bot/base"
+)
+
+// Reports the same number of steps from each motor on every exchange
+type fakeWheels struct {
+	a, b int32
+}
+
+func (f *fakeWheels) Transact(sent []datalink.Packet) ([]datalink.Packet, error) {
+	var pkts []datalink.Packet
+	// Motor 0 is mounted backwards
+	for id, steps := range []int32{ -f.a, f.b } {
+		buf := &bytes.Buffer{}
+		binary.Write(buf, binary.LittleEndian, uint32(id))
+		binary.Write(buf, binary.LittleEndian, steps)
+		pkts = append(pkts, datalink.Packet{ Endpoint: 0x12, Data: buf.Bytes() })
+	}
+	return pkts, nil
+}
+
+// Turns by 'step' every reading
+type fakeIMU struct {
+	rot, step float64
+}
+
+func (i *fakeIMU) Euler() ([]float64, error) {
+	i.rot += i.step
+	return []float64{ i.rot, 0, 0 }, nil
+}
+
+func run(t *testing.T, hw base.Hardware, ori float32, ticks int) *Model {
+	t.Helper()
+
+	p := base.NewPlatformWith(hw, base.Config{})
+	m := NewModel(p, Config{})
+	m.ori = ori
+
+	// The first tick only picks up where the wheels are
+	for i := 0; i < ticks + 1; i++ {
+		if err := p.Update(); err != nil {
+			t.Fatal(err)
+		}
+		m.Tick()
+	}
+	return m
+}
+
+func near(a, b float32) bool {
+	return math.Abs(float64(a - b)) < 0.1
+}
+
+func TestOdometry(t *testing.T) {
+	// 600 steps per revolution of a 30.5 mm wheel, 76 mm apart
+	const (
+		mmPerStep = 30.5 * math.Pi / 600
+		wheelbase = 76
+		ticks = 10
+	)
+
+	// Left slower than right: turning left, round a circle of radius r
+	a, b := 60 * mmPerStep, 120 * mmPerStep
+	w := (b - a) / wheelbase
+	r := (a + b) / 2 / w
+	theta := w * ticks
+
+	tests := []struct{
+		name string
+		hw base.Hardware
+		ori float32
+		pos Coord
+		heading float32
+	}{
+		{
+			"Straight",
+			base.Hardware{ Transactor: &fakeWheels{ 100, 100 } },
+			0,
+			Coord{ 100 * mmPerStep * ticks, 0 },
+			0,
+		},
+		{
+			"Straight, facing left",
+			base.Hardware{ Transactor: &fakeWheels{ 100, 100 } },
+			math.Pi / 2,
+			Coord{ 0, 100 * mmPerStep * ticks },
+			math.Pi / 2,
+		},
+		{
+			"Reversing",
+			base.Hardware{ Transactor: &fakeWheels{ -100, -100 } },
+			math.Pi,
+			Coord{ 100 * mmPerStep * ticks, 0 },
+			math.Pi,
+		},
+		{
+			"Arc",
+			base.Hardware{ Transactor: &fakeWheels{ 60, 120 } },
+			0,
+			Coord{ float32(r * math.Sin(theta)), float32(r * (1 - math.Cos(theta))) },
+			float32(theta),
+		},
+		{
+			"Turning on the spot",
+			base.Hardware{ Transactor: &fakeWheels{ -60, 60 } },
+			0,
+			Coord{ 0, 0 },
+			float32(120 * mmPerStep / wheelbase * ticks),
+		},
+		{
+			// The IMU says most of the turn, the slipping wheels say
+			// none of it
+			"IMU",
+			base.Hardware{ Transactor: &fakeWheels{ 0, 0 }, IMU: &fakeIMU{ step: 0.02 } },
+			0,
+			Coord{ 0, 0 },
+			0.02 * ticks * imuWeight,
+		},
+	}
+
+	for _, test := range tests {
+		m := run(t, test.hw, test.ori, ticks)
+		pos, heading := m.GetPose()
+		if !near(pos.X, test.pos.X) || !near(pos.Y, test.pos.Y) {
+			t.Errorf("%s: at %v, expected %v", test.name, pos, test.pos)
+		}
+		if !near(wrap(heading - test.heading), 0) {
+			t.Errorf("%s: heading %v, expected %v", test.name, heading, test.heading)
+		}
+	}
+}
@@ -4,10 +4,11 @@ package algo
 import (
 	"image"
 	"math"
+
+	"github.com/usedbytes/mini_mouse/bot/tunable"
 )
 
-func findMinMaxRowwise(img *image.Gray) []image.Point {
-	ret := make([]image.Point, img.Bounds().Dy())
+func findMinMaxRowwise(img *image.Gray, ret []image.Point) []image.Point {
 	w, h := img.Bounds().Dx(), img.Bounds().Dy()
 	cpp := 1
 
@@ -28,8 +29,9 @@ func findMinMaxRowwise(img *image.Gray) []image.Point {
 	return ret
 }
 
-// TODO: What fudge-factor do we need here?
-const fudge = 80
+// Rows with less contrast than this are assumed to have no line edge in
+// them. TODO: What fudge-factor do we need here?
+var fudge = tunable.NewInt("algo/fudge", 80, 0, 255)
 
 /* FIXME: Out of sync with expandContrastAndThresh
 func expandContrast(img *image.Gray, minMax []image.Point) {
@@ -54,8 +56,25 @@ func expandContrast(img *image.Gray, minMax []image.Point) {
 func expandContrastAndThresh(img *image.Gray, minMax []image.Point) {
 	w, _ := img.Bounds().Dx(), img.Bounds().Dy()
 	cpp := 1
+	fudge := fudge.Int()
+
+	// Rows with no contrast of their own (e.g. all line, at a junction)
+	// are compared against the whole frame instead
+	frame := image.Pt(0, 255)
+	for _, p := range minMax {
+		if p.X > frame.X {
+			frame.X = p.X
+		}
+		if p.Y < frame.Y {
+			frame.Y = p.Y
+		}
+	}
 
 	for i, p := range minMax {
+		if p.X - p.Y <= fudge {
+			p = frame
+		}
+
 		diff := p.X - p.Y
 		scale := float32(0.0)
 		if p.X - p.Y > fudge {
@@ -74,14 +93,35 @@ func expandContrastAndThresh(img *image.Gray, minMax []image.Point) {
 	}
 }
 
-func findMiddles(img *image.Gray) [][]float32 {
+// A Segment is a run of line pixels in a row, with its edges normalised so
+// that the image spans -0.5 to 0.5
+type Segment struct {
+	Left, Right float32
+}
+
+func (s Segment) Middle() float32 {
+	return (s.Left + s.Right) / 2
+}
+
+func (s Segment) Width() float32 {
+	return s.Right - s.Left
+}
+
+// FindSegments finds the runs of line pixels in each row of a thresholded
+// image
+func FindSegments(img *image.Gray) [][]Segment {
+	var s scratch
+	return s.findSegments(img)
+}
+
+func (s *scratch) findSegments(img *image.Gray) [][]Segment {
 	w, h := img.Bounds().Dx(), img.Bounds().Dy()
-	middles := make([][]float32, h)
+	s.segments = s.segments[:0]
+	s.ends = s.ends[:0]
 
 	e := float32(1.0) / float32(w)
 
 	for y := 0; y < h; y++ {
-		middles[y] = make([]float32, 0, 2)
 		row := img.Pix[img.Stride * y : img.Stride * y + w]
 		in := false
 		start := 0
@@ -90,7 +130,7 @@ func findMiddles(img *image.Gray) [][]float32 {
 			if v == 0 {
 				if in {
 					if (x - start > 1) {
-						middles[y] = append(middles[y], float32(start + x) * e / 2)
+						s.segments = append(s.segments, Segment{ float32(start) * e - 0.5, float32(x) * e - 0.5 })
 					}
 					in = false
 				}
@@ -103,11 +143,21 @@ func findMiddles(img *image.Gray) [][]float32 {
 		}
 		if in {
 			if (w - start >= 2) {
-				middles[y] = append(middles[y], float32(start + w) * e / 2)
+				s.segments = append(s.segments, Segment{ float32(start) * e - 0.5, 0.5 })
 			}
 		}
+		s.ends = append(s.ends, len(s.segments))
+	}
+
+	// Only slice up the rows once all the segments are in, as appending
+	// may have moved them
+	rows := s.segmentRows(h)
+	start := 0
+	for y, end := range s.ends {
+		rows[y] = s.segments[start:end:end]
+		start = end
 	}
-	return middles
+	return rows
 }
 
 func abs(i int) int {
@@ -121,11 +171,57 @@ type Point struct {
 	U, V float32
 }
 
-func findClosest(points []float32, pt float32) int {
+type Branch int
+const (
+	Straight Branch = 1 << iota
+	Left
+	Right
+)
+
+type Junction int
+const (
+	NoJunction Junction = iota
+	// The line splits into separate lines
+	Fork
+	// The line meets a perpendicular line and stops
+	Tee
+	// The line crosses a perpendicular line
+	Crossing
+	// The line turns sharply to one side
+	Corner
+)
+
+// Segments wider than this are taken to be perpendicular lines
+const wideLine = 0.45
+
+// The end of the line is only reported once it's this close (as a fraction
+// of the image height)
+const endDistance = 0.35
+
+type Result struct {
+	// All of the line segments found in each row. Row 0 is nearest.
+	Rows [][]Segment
+	// The followed line, one point per row, NaN where it wasn't seen
+	Points []float32
+	// Angle of the line, in image space. Positive leans right.
+	Angle float32
+
+	Junction Junction
+	// Row where the junction starts, and the branches available there
+	JunctionRow int
+	Branches Branch
+
+	// The line stops a short way ahead, without a junction
+	End bool
+
+	Quality Quality
+}
+
+func findClosest(segments []Segment, pt float32) int {
 	min := 4.0
 	mindx := 0
-	for i, p := range points {
-		dst := math.Abs(float64(pt - p))
+	for i, s := range segments {
+		dst := math.Abs(float64(pt - s.Middle()))
 		if dst < min {
 			min = dst
 			mindx = i
@@ -134,32 +230,343 @@ func findClosest(points []float32, pt float32) int {
 	return mindx
 }
 
-func FindLine(img *image.Gray) []float32 {
-	minMax := findMinMaxRowwise(img)
-	expandContrastAndThresh(img, minMax)
-	middles := findMiddles(img)
+// Pick the point in 'segments' to follow, given the predicted position and
+// the preferred branch
+func choose(segments []Segment, pred float32, prefer Branch) float32 {
+	if len(segments) > 1 {
+		switch prefer {
+		case Left:
+			return segments[0].Middle()
+		case Right:
+			return segments[len(segments) - 1].Middle()
+		}
+	}
+
+	s := segments[findClosest(segments, pred)]
+	if s.Width() > wideLine {
+		switch prefer {
+		case Left:
+			return s.Left + lineWidth / 2
+		case Right:
+			return s.Right - lineWidth / 2
+		}
+		// Go straight over: keep the prediction
+		return float32(math.Max(math.Min(float64(pred), float64(s.Right)), float64(s.Left)))
+	}
+
+	return s.Middle()
+}
+
+// Nominal width of the line, used to tell if a wide segment extends to
+// one side
+const lineWidth = 0.2
+
+func classify(res *Result) {
+	h := len(res.Rows)
+
+	nearest, furthest := h, -1
+	for i, row := range res.Rows {
+		if len(row) == 0 {
+			continue
+		}
+		if i < nearest {
+			nearest = i
+		}
+		furthest = i
+	}
+	if furthest < 0 {
+		return
+	}
+
+	for i := nearest; i <= furthest; i++ {
+		row := res.Rows[i]
+		if len(row) == 0 {
+			continue
+		}
+
+		if len(row) > 1 {
+			res.Junction = Fork
+			res.JunctionRow = i
+			res.Branches = Left | Right
+			if len(row) > 2 {
+				res.Branches |= Straight
+			}
+			return
+		}
+
+		s := row[0]
+		if s.Width() <= wideLine {
+			continue
+		}
+
+		// Compare the wide segment to where the line was before it
+		centre := s.Middle()
+		for j := i - 1; j >= 0; j-- {
+			if !math.IsNaN(float64(res.Points[j])) && res.Rows[j][0].Width() <= wideLine {
+				centre = res.Points[j]
+				break
+			}
+		}
+
+		if s.Left < centre - lineWidth {
+			res.Branches |= Left
+		}
+		if s.Right > centre + lineWidth {
+			res.Branches |= Right
+		}
+
+		// Does the line carry on beyond the wide part?
+		for j := i + 1; j < h; j++ {
+			if len(res.Rows[j]) > 0 && res.Rows[j][0].Width() <= wideLine {
+				res.Branches |= Straight
+				break
+			}
+		}
+
+		res.JunctionRow = i
+		switch {
+		case res.Branches & (Left | Right) == (Left | Right):
+			if res.Branches & Straight != 0 {
+				res.Junction = Crossing
+			} else {
+				res.Junction = Tee
+			}
+		case res.Branches & (Left | Right) != 0:
+			res.Junction = Corner
+		default:
+			// Just a wide bit of line
+			res.Branches = 0
+			continue
+		}
+		return
+	}
+
+	if nearest <= 1 && float32(furthest) < float32(h) * endDistance {
+		res.End = true
+	}
+}
+
+// Least-squares straight line x = a + b * r through the points, where r is
+// the normalised row
+func lineFit(points []float32) (float32, float32) {
+	var n, sr, sr2, sx, srx float64
+	h := float64(len(points))
+	for i, v := range points {
+		if math.IsNaN(float64(v)) {
+			continue
+		}
+		r := float64(i) / h
+		n++
+		sr += r
+		sr2 += r * r
+		sx += float64(v)
+		srx += r * float64(v)
+	}
+
+	if n == 0 {
+		return 0, 0
+	}
+
+	den := n * sr2 - sr * sr
+	if n < 2 || den == 0 {
+		return float32(sx / n), 0
+	}
+	b := (n * srx - sr * sx) / den
+	a := (sx - b * sr) / n
+	return float32(a), float32(b)
+}
+
+type Quality struct {
+	// Overall 0 (no line) to 1 (certain)
+	Confidence float32
+	// Fraction of rows where the line was seen
+	Coverage float32
+	// Mean width of the followed segments, normalised to the image width
+	Width float32
+	// Range of the frame before thresholding, 0 to 1
+	Contrast float32
+	// Total number of segments found
+	Candidates int
+	// RMS distance of the line points from a straight line
+	Residual float32
+}
+
+func clamp01(v float32) float32 {
+	return float32(math.Max(0, math.Min(1, float64(v))))
+}
+
+func measure(res *Result, contrast float32, a, b float32) {
+	q := &res.Quality
+	q.Contrast = contrast
+
+	var seen, single int
+	var width, sq float64
+	h := len(res.Points)
+	for i, p := range res.Points {
+		q.Candidates += len(res.Rows[i])
+		if math.IsNaN(float64(p)) {
+			continue
+		}
+		seen++
+		if len(res.Rows[i]) == 1 {
+			single++
+		}
+
+		for _, s := range res.Rows[i] {
+			if p >= s.Left && p <= s.Right {
+				width += float64(s.Width())
+				break
+			}
+		}
+
+		d := float64(p - (a + b * float32(i) / float32(h)))
+		sq += d * d
+	}
+
+	if seen == 0 || h == 0 {
+		return
+	}
+
+	q.Coverage = float32(seen) / float32(h)
+	q.Width = float32(width / float64(seen))
+	q.Residual = float32(math.Sqrt(sq / float64(seen)))
+
+	// Each factor is 1 for a good line, heading to 0 as things get worse
+	contrastFactor := clamp01((contrast * 255 - 20) / 60)
+	widthFactor := clamp01(1 - float32(math.Abs(float64(q.Width - lineWidth))) / (2 * lineWidth))
+	residualFactor := 1 / (1 + q.Residual / 0.1)
+	ambiguity := float32(single) / float32(seen)
+	if res.Junction != NoJunction {
+		// Junctions are expected to be wide and branchy
+		widthFactor = 1
+		ambiguity = 1
+	}
 
+	q.Confidence = q.Coverage * contrastFactor * widthFactor * residualFactor * ambiguity
+}
+
+// A Detector finds the line in successive frames, smoothing the result
+// from one frame to the next.
+//
+// It keeps its working buffers between frames, so after the first frame it
+// doesn't allocate. The slices in the Results it returns belong to the
+// Detector, and are only valid until its next FindLine: use Result.Clone to
+// keep them for longer.
+type Detector struct {
+	Threshold Threshold
+	// Weight given to the previous frame's points, 0 (no smoothing) to <1
+	Smoothing float32
+
+	prev []float32
+	scratch scratch
+}
+
+func (d *Detector) Reset() {
+	d.prev = nil
+}
+
+func (d *Detector) smooth(points []float32) {
+	if d.Smoothing <= 0 {
+		return
+	}
+
+	if len(d.prev) != len(points) {
+		d.prev = make([]float32, len(points))
+		copy(d.prev, points)
+		return
+	}
+
+	for i, p := range points {
+		prev := d.prev[i]
+		// Only smooth rows seen in both frames. Don't make up points
+		// for rows which have disappeared
+		if !math.IsNaN(float64(p)) && !math.IsNaN(float64(prev)) {
+			points[i] = d.Smoothing * prev + (1 - d.Smoothing) * p
+		}
+		d.prev[i] = points[i]
+	}
+}
+
+// FindLine finds the line in img, which isn't modified. Where the line
+// branches, the 'prefer' branch is followed.
+func (d *Detector) FindLine(img *image.Gray, prefer Branch) Result {
+	min, max := frameRange(img)
+
+	thresh := d.scratch.gray(img)
+	d.Threshold.apply(thresh, &d.scratch)
+
+	return d.FindLineSegments(d.scratch.findSegments(thresh), prefer, float32(int(max) - int(min)) / 255)
+}
+
+// Thresholded returns the image thresholded by the last FindLine. It's only
+// valid until FindLine is next called.
+func (d *Detector) Thresholded() *image.Gray {
+	return &d.scratch.img
+}
+
+// FindLineSegments is FindLine for a frame which has already been
+// thresholded and split into segments. 'contrast' is the range of the frame
+// before thresholding, 0 to 1.
+func (d *Detector) FindLineSegments(rows [][]Segment, prefer Branch, contrast float32) Result {
 	dx := float32(0.0)
-	linePoints := make([]float32, len(middles))
+	linePoints := d.scratch.linePoints(len(rows))
 
 	var current float32
-	for _, row := range middles {
+	for _, row := range rows {
 		if len(row) == 0 {
 			continue
 		}
-		current = row[0]
+		current = row[0].Middle()
 	}
 
-	for i, row := range middles {
+	for i, row := range rows {
 		if len(row) == 0 {
 			linePoints[i] = float32(math.NaN())
 			continue
 		}
 		pred := current + dx
-		idx := findClosest(row, pred)
-		dx = row[idx] - current
-		linePoints[i] = row[idx] - 0.5
+		pt := choose(row, pred, prefer)
+		dx = pt - current
+		linePoints[i] = pt
+	}
+
+	d.smooth(linePoints)
+
+	a, b := lineFit(linePoints)
+	res := Result{
+		Rows: rows,
+		Points: linePoints,
+		Angle: float32(math.Atan(float64(b))),
 	}
+	classify(&res)
+	measure(&res, contrast, a, b)
+
+	return res
+}
+
+// Clone returns a copy of r which doesn't share any memory with it
+func (r Result) Clone() Result {
+	ret := r
+	ret.Points = append([]float32(nil), r.Points...)
+
+	// All the rows share one array
+	n := 0
+	for _, row := range r.Rows {
+		n += len(row)
+	}
+	segments := make([]Segment, 0, n)
+	ret.Rows = make([][]Segment, len(r.Rows))
+	for i, row := range r.Rows {
+		start := len(segments)
+		segments = append(segments, row...)
+		ret.Rows[i] = segments[start:len(segments):len(segments)]
+	}
+	return ret
+}
 
-	return linePoints
+// FindLine finds the line in a single frame, with the default thresholding
+// and no smoothing. img isn't modified.
+func FindLine(img *image.Gray, prefer Branch) Result {
+	d := Detector{}
+	return d.FindLine(img, prefer)
 }
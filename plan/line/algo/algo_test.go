@@ -0,0 +1,77 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package algo
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+var thresholds = []Threshold{ RowContrast, Otsu, AdaptiveRow, Hysteresis }
+
+// lineFrame draws a vertical line 'width' pixels wide, with its left edge
+// at column 'left', onto a flat background
+func lineFrame(w, h, left, width int, bg, fg uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := bg
+			if x >= left && x < left + width {
+				v = fg
+			}
+			img.Pix[img.PixOffset(x, y)] = v
+		}
+	}
+	return img
+}
+
+// A line in the right-hand half of a bigger frame, so FindLine is given a
+// sub-image with Stride != width
+func subFrame() *image.Gray {
+	img := lineFrame(64, 48, 40, 6, 30, 200)
+	return img.SubImage(image.Rect(32, 0, 64, 48)).(*image.Gray)
+}
+
+func TestFindLineLeavesSource(t *testing.T) {
+	for _, th := range thresholds {
+		img := subFrame()
+		before := append([]uint8(nil), img.Pix...)
+
+		d := Detector{ Threshold: th }
+		d.FindLine(img, Straight)
+
+		if !bytes.Equal(before, img.Pix) {
+			t.Errorf("%v: FindLine modified the source image", th)
+		}
+	}
+}
+
+func TestFindLineAllocs(t *testing.T) {
+	for _, th := range thresholds {
+		img := subFrame()
+		d := Detector{ Threshold: th, Smoothing: 0.3 }
+		// The first frame sizes the buffers
+		d.FindLine(img, Straight)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			d.FindLine(img, Straight)
+		})
+		if allocs != 0 {
+			t.Errorf("%v: FindLine allocated %v times per frame, expected 0", th, allocs)
+		}
+	}
+}
+
+func BenchmarkFindLine(b *testing.B) {
+	for _, th := range thresholds {
+		b.Run(th.String(), func(b *testing.B) {
+			img := subFrame()
+			d := Detector{ Threshold: th, Smoothing: 0.3 }
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d.FindLine(img, Straight)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package algo
+
+import (
+	"image"
+	"math"
+)
+
+type Colour int
+const (
+	Red Colour = iota
+	Yellow
+	Green
+	Blue
+	numColours
+)
+
+func (c Colour) String() string {
+	return [...]string{ "Red", "Yellow", "Green", "Blue" }[c]
+}
+
+type Side int
+const (
+	SideLeft Side = iota
+	SideCentre
+	SideRight
+)
+
+func (s Side) String() string {
+	return [...]string{ "Left", "Centre", "Right" }[s]
+}
+
+// Hue of each colour as an angle in the Cb-Cr plane, in degrees
+var hues = [numColours]float64{
+	Red: 109,
+	Yellow: 170,
+	Green: -128,
+	Blue: -9,
+}
+
+const (
+	// Minimum chroma distance from grey to count as coloured
+	minSaturation = 40
+	// Maximum hue difference to match a colour
+	hueTolerance = 30
+	// Fraction of a region which must be coloured to count as a marker
+	minMarkerFraction = 0.05
+	// Normalised column either side of centre which divides the regions
+	sideBoundary = 0.2
+)
+
+type Marker struct {
+	Colour Colour
+	Side Side
+	// Fraction of the region covered by the marker
+	Fraction float32
+}
+
+func classifyColour(cb, cr uint8) (Colour, bool) {
+	u := float64(cb) - 128
+	v := float64(cr) - 128
+	if math.Hypot(u, v) < minSaturation {
+		return 0, false
+	}
+
+	hue := math.Atan2(v, u) * 180 / math.Pi
+	for c, h := range hues {
+		d := math.Mod(math.Abs(hue - h), 360)
+		if d > 180 {
+			d = 360 - d
+		}
+		if d < hueTolerance {
+			return Colour(c), true
+		}
+	}
+
+	return 0, false
+}
+
+// FindMarkers looks for patches of colour to the left, right and in the
+// centre of the frame
+func FindMarkers(img *image.YCbCr) []Marker {
+	var counts [3][numColours]int
+	var totals [3]int
+
+	b := img.Bounds()
+	w := float32(b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			u := float32(x - b.Min.X) / w - 0.5
+			side := SideCentre
+			if u < -sideBoundary {
+				side = SideLeft
+			} else if u > sideBoundary {
+				side = SideRight
+			}
+			totals[side]++
+
+			ci := img.COffset(x, y)
+			if c, ok := classifyColour(img.Cb[ci], img.Cr[ci]); ok {
+				counts[side][c]++
+			}
+		}
+	}
+
+	var markers []Marker
+	for side := SideLeft; side <= SideRight; side++ {
+		if totals[side] == 0 {
+			continue
+		}
+		for c := Red; c < numColours; c++ {
+			frac := float32(counts[side][c]) / float32(totals[side])
+			if frac >= minMarkerFraction {
+				markers = append(markers, Marker{ Colour: c, Side: side, Fraction: frac })
+			}
+		}
+	}
+
+	return markers
+}
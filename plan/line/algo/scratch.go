@@ -0,0 +1,72 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package algo
+
+import (
+	"image"
+)
+
+// scratch holds the buffers used to find the line, so that they can be
+// reused from one frame to the next instead of allocated every time. The
+// zero value is ready to use. Anything built in a scratch is only valid
+// until it's next used.
+type scratch struct {
+	img image.Gray
+	minMax []image.Point
+	levels []int
+	stack []image.Point
+	segments []Segment
+	ends []int
+	rows [][]Segment
+	points []float32
+}
+
+// gray copies src into the scratch image, so it can be thresholded without
+// touching src
+func (s *scratch) gray(src *image.Gray) *image.Gray {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if cap(s.img.Pix) < w * h {
+		s.img.Pix = make([]uint8, w * h)
+	}
+	s.img.Pix = s.img.Pix[:w * h]
+	s.img.Stride = w
+	s.img.Rect = image.Rect(0, 0, w, h)
+
+	for y := 0; y < h; y++ {
+		start := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y + y)
+		copy(s.img.Pix[w * y : w * y + w], src.Pix[start : start + w])
+	}
+
+	return &s.img
+}
+
+func (s *scratch) minMaxRows(n int) []image.Point {
+	if cap(s.minMax) < n {
+		s.minMax = make([]image.Point, n)
+	}
+	s.minMax = s.minMax[:n]
+	return s.minMax
+}
+
+func (s *scratch) levelRows(n int) []int {
+	if cap(s.levels) < n {
+		s.levels = make([]int, n)
+	}
+	s.levels = s.levels[:n]
+	return s.levels
+}
+
+func (s *scratch) linePoints(n int) []float32 {
+	if cap(s.points) < n {
+		s.points = make([]float32, n)
+	}
+	s.points = s.points[:n]
+	return s.points
+}
+
+func (s *scratch) segmentRows(n int) [][]Segment {
+	if cap(s.rows) < n {
+		s.rows = make([][]Segment, n)
+	}
+	s.rows = s.rows[:n]
+	return s.rows
+}
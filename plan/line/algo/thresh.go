@@ -0,0 +1,259 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package algo
+
+import (
+	"image"
+)
+
+type Threshold int
+const (
+	// Stretch each row's contrast and threshold at the middle
+	RowContrast Threshold = iota
+	// One threshold for the whole frame, picked by Otsu's method
+	Otsu
+	// Threshold each row at the middle of its range, borrowing the
+	// threshold from the nearest row with enough contrast when it has none
+	AdaptiveRow
+	// Otsu with a band either side: pixels above the band are line, and
+	// pixels inside it are line if they touch another line pixel
+	Hysteresis
+)
+
+func (t Threshold) String() string {
+	return [...]string{ "RowContrast", "Otsu", "AdaptiveRow", "Hysteresis" }[t]
+}
+
+const (
+	// Frames with less contrast than this have no line
+	minFrameContrast = 40
+	// Rows with less contrast than this use another row's threshold
+	minRowContrast = 40
+	// Half-width of the Hysteresis band, as a fraction of the frame's range
+	hysteresisBand = 0.2
+)
+
+// Apply thresholds img in-place, leaving line pixels 255 and the rest 0
+func (method Threshold) Apply(img *image.Gray) {
+	var s scratch
+	method.apply(img, &s)
+}
+
+func (method Threshold) apply(img *image.Gray, s *scratch) {
+	switch method {
+	case Otsu:
+		threshOtsu(img)
+	case AdaptiveRow:
+		threshAdaptiveRow(img, s)
+	case Hysteresis:
+		threshHysteresis(img, s)
+	default:
+		minMax := findMinMaxRowwise(img, s.minMaxRows(img.Bounds().Dy()))
+		expandContrastAndThresh(img, minMax)
+	}
+}
+
+func frameRange(img *image.Gray) (uint8, uint8) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	var min, max uint8 = 255, 0
+	for y := 0; y < h; y++ {
+		for _, v := range img.Pix[img.Stride * y : img.Stride * y + w] {
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+	}
+	return min, max
+}
+
+func otsuLevel(img *image.Gray) uint8 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	var hist [256]int
+	for y := 0; y < h; y++ {
+		for _, v := range img.Pix[img.Stride * y : img.Stride * y + w] {
+			hist[v]++
+		}
+	}
+
+	total := w * h
+	sum := 0
+	for i, n := range hist {
+		sum += i * n
+	}
+
+	// There's often a run of levels with the same score (e.g. between two
+	// flat peaks), so take the middle of it
+	var sumB, wB int
+	var best float64
+	first, last := 0, 0
+	for i, n := range hist {
+		wB += n
+		if wB == 0 {
+			continue
+		}
+		wF := total - wB
+		if wF == 0 {
+			break
+		}
+		sumB += i * n
+
+		mB := float64(sumB) / float64(wB)
+		mF := float64(sum - sumB) / float64(wF)
+		between := float64(wB) * float64(wF) * (mB - mF) * (mB - mF)
+		if between > best {
+			best = between
+			first, last = i, i
+		} else if between == best {
+			last = i
+		}
+	}
+
+	return uint8((first + last) / 2)
+}
+
+func threshLevel(img *image.Gray, level uint8) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.Stride * y : img.Stride * y + w]
+		for x, v := range row {
+			if v > level {
+				row[x] = 255
+			} else {
+				row[x] = 0
+			}
+		}
+	}
+}
+
+func blank(img *image.Gray) {
+	threshLevel(img, 255)
+}
+
+func threshOtsu(img *image.Gray) {
+	min, max := frameRange(img)
+	if int(max) - int(min) < minFrameContrast {
+		blank(img)
+		return
+	}
+
+	threshLevel(img, otsuLevel(img))
+}
+
+func threshAdaptiveRow(img *image.Gray, s *scratch) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	minMax := findMinMaxRowwise(img, s.minMaxRows(h))
+
+	levels := s.levelRows(h)
+	valid := false
+	for i, p := range minMax {
+		if p.X - p.Y >= minRowContrast {
+			levels[i] = (p.X + p.Y) / 2
+			valid = true
+		} else {
+			levels[i] = -1
+		}
+	}
+
+	if !valid {
+		blank(img)
+		return
+	}
+
+	// Fill in rows without a threshold from the nearest one which has
+	for i := range levels {
+		if levels[i] >= 0 {
+			continue
+		}
+		for d := 1; d < h; d++ {
+			if i - d >= 0 && minMax[i - d].X - minMax[i - d].Y >= minRowContrast {
+				levels[i] = levels[i - d]
+				break
+			}
+			if i + d < h && levels[i + d] >= 0 {
+				levels[i] = levels[i + d]
+				break
+			}
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.Stride * y : img.Stride * y + w]
+		for x, v := range row {
+			if int(v) > levels[y] {
+				row[x] = 255
+			} else {
+				row[x] = 0
+			}
+		}
+	}
+}
+
+var neighbours = [...]image.Point{ {1, 0}, {-1, 0}, {0, 1}, {0, -1} }
+
+func threshHysteresis(img *image.Gray, s *scratch) {
+	min, max := frameRange(img)
+	if int(max) - int(min) < minFrameContrast {
+		blank(img)
+		return
+	}
+
+	level := int(otsuLevel(img))
+	band := int(hysteresisBand * float32(int(max) - int(min)))
+	high := level + band
+	low := level - band
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	const (
+		bg = 0
+		weak = 1
+		strong = 255
+	)
+
+	stack := s.stack[:0]
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.Stride * y : img.Stride * y + w]
+		for x, v := range row {
+			switch {
+			case int(v) > high:
+				row[x] = strong
+				stack = append(stack, image.Pt(x, y))
+			case int(v) > low:
+				row[x] = weak
+			default:
+				row[x] = bg
+			}
+		}
+	}
+
+	// Grow the strong pixels into connected weak ones
+	for len(stack) > 0 {
+		p := stack[len(stack) - 1]
+		stack = stack[:len(stack) - 1]
+
+		for _, d := range neighbours {
+			n := p.Add(d)
+			if n.X < 0 || n.Y < 0 || n.X >= w || n.Y >= h {
+				continue
+			}
+			i := img.Stride * n.Y + n.X
+			if img.Pix[i] == weak {
+				img.Pix[i] = strong
+				stack = append(stack, n)
+			}
+		}
+	}
+
+	s.stack = stack
+
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.Stride * y : img.Stride * y + w]
+		for x, v := range row {
+			if v != strong {
+				row[x] = bg
+			}
+		}
+	}
+}
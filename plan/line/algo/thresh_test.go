@@ -0,0 +1,221 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package algo
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+const (
+	goldenW, goldenH = 32, 24
+	// The line is columns 12 to 17, so its middle is at 15
+	lineLeft, lineRight = 12, 18
+)
+
+func onLine(x int) bool {
+	return x >= lineLeft && x < lineRight
+}
+
+func drawFrame(f func(x, y int) int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, goldenW, goldenH))
+	for y := 0; y < goldenH; y++ {
+		for x := 0; x < goldenW; x++ {
+			img.Pix[img.PixOffset(x, y)] = uint8(f(x, y))
+		}
+	}
+	return img
+}
+
+// Repeatable noise, -8 to 8
+type noise uint32
+
+func (n *noise) next() int {
+	*n = *n * 1103515245 + 12345
+	return int(*n >> 16) % 17 - 8
+}
+
+// Convert a line point back to a pixel column
+func column(p float32) float32 {
+	return (p + 0.5) * goldenW
+}
+
+type want struct {
+	// Column the line is found at
+	col float32
+	// Rows the line is found in, counting from row 0. The rest must be NaN.
+	rows int
+}
+
+func checkPoints(t *testing.T, name string, points []float32, w want) {
+	t.Helper()
+	for i, p := range points {
+		nan := math.IsNaN(float64(p))
+		switch {
+		case i >= w.rows && !nan:
+			t.Errorf("%s: row %d: found line at %v, expected none", name, i, column(p))
+		case i < w.rows && nan:
+			t.Errorf("%s: row %d: no line, expected %v", name, i, w.col)
+		case i < w.rows && math.Abs(float64(column(p) - w.col)) > 0.01:
+			t.Errorf("%s: row %d: found line at %v, expected %v", name, i, column(p), w.col)
+		}
+	}
+}
+
+func TestThresholdGolden(t *testing.T) {
+	var lowNoise noise = 1
+
+	all := want{ 15, goldenH }
+	none := want{ 0, 0 }
+
+	tests := []struct{
+		name string
+		frame *image.Gray
+		want map[Threshold]want
+	}{
+		{
+			name: "Clean",
+			frame: drawFrame(func(x, y int) int {
+				if onLine(x) {
+					return 200
+				}
+				return 40
+			}),
+			want: map[Threshold]want{ RowContrast: all, Otsu: all, AdaptiveRow: all, Hysteresis: all },
+		},
+		{
+			// The far half of the frame is in shadow. Only AdaptiveRow
+			// picks its threshold row by row.
+			name: "Shadow",
+			frame: drawFrame(func(x, y int) int {
+				v := 40
+				if onLine(x) {
+					v = 200
+				}
+				if y >= goldenH / 2 {
+					v = v * 35 / 100
+				}
+				return v
+			}),
+			want: map[Threshold]want{
+				RowContrast: { 15, goldenH / 2 },
+				Otsu: { 15, goldenH / 2 },
+				AdaptiveRow: all,
+				Hysteresis: { 15, goldenH / 2 },
+			},
+		},
+		{
+			// A saturated spot off to the side of the line, in the near
+			// rows
+			name: "Glare spot",
+			frame: drawFrame(func(x, y int) int {
+				if x >= 24 && x < 30 && y < 6 {
+					return 255
+				}
+				if onLine(x) {
+					return 150
+				}
+				return 40
+			}),
+			want: map[Threshold]want{ RowContrast: all, Otsu: all, AdaptiveRow: all, Hysteresis: all },
+		},
+		{
+			// The background gets brighter towards the right. A single
+			// threshold for the whole frame takes in the bright side, and
+			// the line gets merged with it.
+			name: "Glare gradient",
+			frame: drawFrame(func(x, y int) int {
+				if onLine(x) {
+					return 220
+				}
+				return 40 + 140 * x / goldenW
+			}),
+			want: map[Threshold]want{
+				RowContrast: all,
+				Otsu: { 22, goldenH },
+				AdaptiveRow: all,
+				Hysteresis: { 19.5, goldenH },
+			},
+		},
+		{
+			// Enough contrast to see, but less than algo/fudge
+			name: "Low contrast",
+			frame: drawFrame(func(x, y int) int {
+				v := 100
+				if onLine(x) {
+					v = 150
+				}
+				return v + lowNoise.next()
+			}),
+			want: map[Threshold]want{ RowContrast: none, Otsu: all, AdaptiveRow: all, Hysteresis: all },
+		},
+		{
+			// Below minFrameContrast, which is taken to be no line at all
+			name: "No contrast",
+			frame: drawFrame(func(x, y int) int {
+				if onLine(x) {
+					return 125
+				}
+				return 100
+			}),
+			want: map[Threshold]want{ RowContrast: none, Otsu: none, AdaptiveRow: none, Hysteresis: none },
+		},
+	}
+
+	for _, test := range tests {
+		for _, th := range thresholds {
+			d := Detector{ Threshold: th }
+			res := d.FindLine(test.frame, Straight)
+			checkPoints(t, test.name + "/" + th.String(), res.Points, test.want[th])
+		}
+	}
+}
+
+func TestSmoothing(t *testing.T) {
+	line := func(left int) *image.Gray {
+		return lineFrame(goldenW, goldenH, left, lineRight - lineLeft, 40, 200)
+	}
+	// The far half is in shadow, so Otsu only sees the near half
+	shadow := drawFrame(func(x, y int) int {
+		if y >= goldenH / 2 {
+			return 10
+		}
+		if onLine(x) {
+			return 200
+		}
+		return 40
+	})
+
+	for _, th := range thresholds {
+		d := Detector{ Threshold: th, Smoothing: 0.5 }
+		name := th.String()
+
+		res := d.FindLine(line(lineLeft), Straight)
+		checkPoints(t, name + "/first", res.Points, want{ 15, goldenH })
+
+		// Half way between the two frames
+		res = d.FindLine(line(lineLeft + 6), Straight)
+		checkPoints(t, name + "/moved", res.Points, want{ 18, goldenH })
+
+		res = d.FindLine(line(lineLeft + 6), Straight)
+		checkPoints(t, name + "/still", res.Points, want{ 19.5, goldenH })
+
+		d.Reset()
+		res = d.FindLine(line(lineLeft), Straight)
+		checkPoints(t, name + "/reset", res.Points, want{ 15, goldenH })
+
+		// Rows which disappear aren't made up from the last frame
+		if th == Otsu {
+			res = d.FindLine(shadow, Straight)
+			checkPoints(t, name + "/shadow", res.Points, want{ 15, goldenH / 2 })
+
+			// ...and rows which come back aren't smoothed against them
+			res = d.FindLine(line(lineLeft + 6), Straight)
+			for i := goldenH / 2; i < goldenH; i++ {
+				if c := column(res.Points[i]); c != 21 {
+					t.Errorf("%s/reappear: row %d: found line at %v, expected 21", name, i, c)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package line
+
+import (
+	"math"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+)
+
+// Floor describes the line on the floor, relative to the robot. Distances
+// are in mm, with X forwards and Y to the left.
+type Floor struct {
+	Valid bool
+	// Lateral offset of the line at 'Distance' ahead. Positive is left.
+	Offset float32
+	Distance float32
+	// Heading of the line relative to the robot, anti-clockwise positive
+	Angle float32
+	// Signed curvature, 1/mm. Positive curves left.
+	Curvature float32
+}
+
+// floorLine fits y = a + b*x + c*x^2 through the line points projected onto
+// the floor, and evaluates it at the fraction 'lookAhead' of the way through
+// the visible points
+func floorLine(line []float32, cal *camera.Calibration, lookAhead float32) Floor {
+	xs := make([]float64, 0, len(line))
+	ys := make([]float64, 0, len(line))
+
+	h := float32(len(line))
+	for i, v := range line {
+		if math.IsNaN(float64(v)) {
+			continue
+		}
+		x, y, ok := cal.ToFloor(v, (float32(i) + 0.5) / h)
+		if !ok {
+			continue
+		}
+		xs = append(xs, float64(x))
+		ys = append(ys, float64(y))
+	}
+
+	if len(xs) < 2 {
+		return Floor{}
+	}
+
+	// Fit about the mean distance to keep things well conditioned
+	var x0 float64
+	for _, x := range xs {
+		x0 += x
+	}
+	x0 /= float64(len(xs))
+
+	var n, sx, sx2, sx3, sx4, sy, sxy, sx2y float64
+	for i := range xs {
+		x := xs[i] - x0
+		y := ys[i]
+		n++
+		sx += x
+		sx2 += x * x
+		sx3 += x * x * x
+		sx4 += x * x * x * x
+		sy += y
+		sxy += x * y
+		sx2y += x * x * y
+	}
+
+	det3 := func(a, b, c, d, e, f, g, h, i float64) float64 {
+		return a * (e * i - f * h) - b * (d * i - f * g) + c * (d * h - e * g)
+	}
+
+	var a, b, c float64
+	det := det3(n, sx, sx2, sx, sx2, sx3, sx2, sx3, sx4)
+	if len(xs) >= 3 && math.Abs(det) > 1e-9 {
+		a = det3(sy, sx, sx2, sxy, sx2, sx3, sx2y, sx3, sx4) / det
+		b = det3(n, sy, sx2, sx, sxy, sx3, sx2, sx2y, sx4) / det
+		c = det3(n, sx, sy, sx, sx2, sxy, sx2, sx3, sx2y) / det
+	} else if den := n * sx2 - sx * sx; den != 0 {
+		b = (n * sxy - sx * sy) / den
+		a = (sy - b * sx) / n
+	} else {
+		a = sy / n
+	}
+
+	near, far := xs[0], xs[len(xs) - 1]
+	dist := near + float64(lookAhead) * (far - near)
+	d := dist - x0
+
+	slope := b + 2 * c * d
+	return Floor{
+		Valid: true,
+		Offset: float32(a + b * d + c * d * d),
+		Distance: float32(dist),
+		Angle: float32(math.Atan(slope)),
+		Curvature: float32(2 * c / math.Pow(1 + slope * slope, 1.5)),
+	}
+}
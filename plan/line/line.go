@@ -2,29 +2,265 @@
 package line
 
 import (
-	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/usedbytes/mini_mouse/bot/base"
 	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/model"
 	"github.com/usedbytes/mini_mouse/bot/plan/line/algo"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+	"github.com/usedbytes/mini_mouse/bot/tunable"
+	"github.com/usedbytes/mini_mouse/bot/vision"
 )
 
 const TaskName = "line"
 
+// Below lostConfidence the line is lost, and it must be back above
+// foundConfidence before we stop searching
+const (
+	lostConfidence = 0.15
+	foundConfidence = 0.3
+)
+
+// Wait for obstacles closer than obstacleStop mm, which are less than
+// obstacleClearance mm from the robot's sides
+const (
+	obstacleStop = 150
+	obstacleClearance = 20
+)
+
+var logger = logging.New("line")
+
+var (
+	qualityTopic = telemetry.NewTopic("line/quality", algo.Quality{})
+	floorTopic = telemetry.NewTopic("line/floor", Floor{})
+	// The line in the cropped frame: U is the column, V the row
+	pointsTopic = telemetry.NewTopic("line/points", []algo.Point{})
+)
+
+// Gains can be changed while the task is running, with SetGains
+type Gains struct {
+	Kp, Ki, Kd float32
+	// Normalised row (0 nearest, 1 furthest) to steer towards
+	LookAhead float32
+	// How much to slow down for curves
+	CurveSlowdown float32
+	MaxSpeed float32
+}
+
 type Task struct {
 	platform *base.Platform
+	// The line and markers are found by the vision pipeline, off the
+	// control loop
+	vision *vision.Pipeline
+	lineDetect *vision.LineDetect
 
 	lastTime time.Time
 	running bool
 	side float32
-	lost, search int
-	maxSpeed, maxTurn float32
+	lost int
+	recovery *Recovery
+	blocked bool
+
+	lock sync.Mutex
+	gains Gains
+	pid PID
+
+	// Which way to go at the next junction
+	branch algo.Branch
+	atJunction bool
+	stopAtEnd bool
+
+	quality algo.Quality
+	floor Floor
+	markers markerTracker
+	laps, targetLaps int
+	slowUntil time.Time
+	hazardTime time.Duration
+	hazardSpeed float32
+}
+
+// SetLaps sets the number of laps to run before stopping, 0 is unlimited
+func (t *Task) SetLaps(laps int) {
+	t.targetLaps = laps
+}
+
+func (t *Task) Laps() int {
+	return t.laps
+}
+
+// Returns true if the task should stop
+func (t *Task) handleEvent(e Event, now time.Time) bool {
+	switch e {
+	case LapMarker:
+		t.laps++
+		logger.Info("Lap", "laps", t.laps)
+		if t.targetLaps > 0 && t.laps >= t.targetLaps {
+			return true
+		}
+	case Hazard:
+		t.slowUntil = now.Add(t.hazardTime)
+	case Finish:
+		logger.Info("Finish", "laps", t.laps)
+		return true
+	}
+	return false
+}
+
+func (t *Task) SetBranch(b algo.Branch) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.branch = b
+	t.lineDetect.SetBranch(b)
+}
+
+func (t *Task) Branch() algo.Branch {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.branch
+}
+
+// Quality returns the detection quality from the latest frame
+func (t *Task) Quality() algo.Quality {
+	return t.quality
+}
+
+// Floor returns the line's position on the floor from the latest frame
+func (t *Task) Floor() Floor {
+	return t.floor
+}
+
+func (t *Task) SetSmoothing(s float32) {
+	t.lineDetect.SetSmoothing(s)
+}
+
+func (t *Task) SetStopAtEnd(stop bool) {
+	t.stopAtEnd = stop
+}
+
+func (t *Task) Gains() Gains {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.gains
+}
+
+func (t *Task) SetGains(g Gains) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.gains = g
+}
+
+// RegisterTunables adds the task's gains and line search parameters to
+// 'reg', under "line/". Apart from the gains, they must only be Set from the
+// main loop, e.g. through control.Control.
+func (t *Task) RegisterTunables(reg *tunable.Registry) {
+	gain := func(name string, min, max float64, field func(g *Gains) *float32) {
+		reg.Float("line/" + name, min, max,
+			func() float64 {
+				g := t.Gains()
+				return float64(*field(&g))
+			},
+			func(v float64) {
+				g := t.Gains()
+				*field(&g) = float32(v)
+				t.SetGains(g)
+			},
+		)
+	}
+
+	gain("kp", 0, 100, func(g *Gains) *float32 { return &g.Kp })
+	gain("ki", 0, 100, func(g *Gains) *float32 { return &g.Ki })
+	gain("kd", 0, 100, func(g *Gains) *float32 { return &g.Kd })
+	gain("look_ahead", 0, 1, func(g *Gains) *float32 { return &g.LookAhead })
+	gain("curve_slowdown", 0, 10, func(g *Gains) *float32 { return &g.CurveSlowdown })
+	gain("max_speed", 0, float64(t.platform.GetMaxVelocity()), func(g *Gains) *float32 { return &g.MaxSpeed })
+
+	float := func(name string, min, max float64, v *float32) {
+		reg.Float("line/" + name, min, max,
+			func() float64 { return float64(*v) },
+			func(f float64) { *v = float32(f) },
+		)
+	}
+
+	float("hazard_speed", 0, 1, &t.hazardSpeed)
+	reg.Float("line/hazard_time", 0, 10,
+		func() float64 { return t.hazardTime.Seconds() },
+		func(v float64) { t.hazardTime = time.Duration(v * float64(time.Second)) },
+	)
+	reg.Bool("line/stop_at_end",
+		func() bool { return t.stopAtEnd },
+		func(v bool) { t.stopAtEnd = v },
+	)
+
+	float("search/max_reverse", 0, 500, &t.recovery.MaxReverse)
+	float("search/creep", 0, 200, &t.recovery.Creep)
+	reg.Float("line/search/timeout", 1, 60,
+		func() float64 { return t.recovery.Timeout.Seconds() },
+		func(v float64) { t.recovery.Timeout = time.Duration(v * float64(time.Second)) },
+	)
+}
+
+// Obstacle makes the robot wait while there's something in its way
+func (t *Task) Obstacle(e vision.ObstacleEvent) {
+	blocked := false
+	for _, o := range e.Obstacles {
+		if o.Distance < obstacleStop && float32(math.Abs(float64(o.Y))) < t.platform.Wheelbase() / 2 + obstacleClearance {
+			blocked = true
+			break
+		}
+	}
+
+	if t.running && blocked != t.blocked {
+		if blocked {
+			logger.Info("Obstacle ahead, waiting")
+		} else {
+			logger.Info("Obstacle gone")
+		}
+	}
+	t.blocked = blocked
+}
+
+func (t *Task) reset() {
+	t.pid.Reset()
+	t.lineDetect.Reset()
+	t.markers.reset()
+	t.recovery.Reset(t.side)
+	t.lost = 0
+	t.laps = 0
+}
+
+// Start following the line, from the next frame. The task must be current
+// in the planner for it to actually go anywhere.
+func (t *Task) Start() {
+	t.reset()
+	t.running = true
+}
+
+func (t *Task) Stop() {
+	if t.running {
+		t.platform.SetVelocity(0, 0)
+	}
+	t.reset()
+	t.running = false
+}
+
+func (t *Task) Running() bool {
+	return t.running
 }
 
 func (t *Task) Enter() {
 	t.platform.EnableCamera()
+	// Only look at frames taken from now on
+	t.lastTime = t.vision.Latest().Time
+	t.pid.Reset()
+	t.blocked = false
 }
 
 func (t *Task) Exit() {
@@ -32,27 +268,92 @@ func (t *Task) Exit() {
 	t.platform.DisableCamera()
 }
 
+func publishPoints(line []float32) {
+	points := make([]algo.Point, 0, len(line))
+	for i, v := range line {
+		if !math.IsNaN(float64(v)) {
+			points = append(points, algo.Point{ U: v, V: (float32(i) + 0.5) / float32(len(line)) })
+		}
+	}
+	pointsTopic.Publish(points)
+}
+
 func (t *Task) Tick(buttons input.ButtonState) {
-	frame, frameTime := t.platform.GetFrame()
-	if frame == nil || frameTime == t.lastTime {
+	// Buttons first: results don't arrive every tick
+	if buttons.Pressed(input.Cross) {
+		if t.Running() {
+			t.Stop()
+		} else {
+			t.Start()
+		}
+	}
+
+	if buttons.Pressed(input.L1) {
+		t.SetBranch(algo.Left)
+	} else if buttons.Pressed(input.R1) {
+		t.SetBranch(algo.Right)
+	} else if buttons.Pressed(input.R2) {
+		t.SetBranch(algo.Straight)
+	}
+
+	out := t.vision.Latest()
+	frameTime := out.Time
+	if frameTime.IsZero() || frameTime == t.lastTime {
 		return
 	}
+	dt := float32(frameTime.Sub(t.lastTime).Seconds())
+	if dt > 0.5 {
+		// First frame, or we've been stalled
+		dt = 0
+	}
 	t.lastTime = frameTime
 
-	if buttons[input.Cross] == input.Pressed {
-		if t.running {
-			t.platform.SetVelocity(0, 0)
+	if !t.running {
+		return
+	}
+
+	if t.blocked {
+		t.platform.SetVelocity(0, 0)
+		t.pid.Reset()
+		return
+	}
+
+	if markers, ok := out.Results["markers"].([]algo.Marker); ok {
+		for _, e := range t.markers.update(markers) {
+			if t.handleEvent(e, frameTime) {
+				t.platform.SetVelocity(0, 0)
+				t.running = false
+				return
+			}
 		}
-		t.running = !t.running
 	}
 
-	if !t.running {
+	res, ok := out.Results["line"].(algo.Result)
+	if !ok {
+		// The pipeline failed before finding the line
 		return
 	}
+	line := res.Points
+	t.quality = res.Quality
+	qualityTopic.Publish(t.quality)
+	publishPoints(line)
+
+	if res.Junction != algo.NoJunction {
+		t.atJunction = true
+	} else if t.atJunction {
+		// Made it through, go back to straight on
+		t.atJunction = false
+		t.SetBranch(algo.Straight)
+	}
 
-	line := algo.FindLine(&frame.Gray)
+	if res.End && t.stopAtEnd {
+		logger.Info("End of line")
+		t.platform.SetVelocity(0, 0)
+		t.running = false
+		return
+	}
 
-	h := frame.Bounds().Dy()
+	h := len(line)
 	nearest := h + 1
 	furthest := -1
 
@@ -68,43 +369,85 @@ func (t *Task) Tick(buttons input.ButtonState) {
 		}
 	}
 
-	if (nearest > h || furthest < 0) || (t.lost > 0 && nearest > h / 2) {
-		fmt.Printf("Lost line! prev was %v\n", t.side)
+	conf := res.Quality.Confidence
+	lost := nearest > h || furthest < 0 || conf < lostConfidence
+	if t.lost > 0 {
+		lost = lost || nearest > h / 2 || conf < foundConfidence
+	}
+
+	if lost {
+		if t.lost == 0 {
+			logger.Warn("Lost line", "side", t.side)
+		}
 		t.lost++
-		if t.lost > t.search {
-			t.side = -t.side
-			t.search *= 2
+		t.pid.Reset()
+		t.lineDetect.Reset()
+
+		t.recovery.Tick(buttons)
+		if t.recovery.Failed() {
+			logger.Warn("Couldn't find the line, giving up", "lost_ticks", t.lost)
+			t.platform.SetVelocity(0, 0)
+			t.running = false
+			t.lost = 0
+			t.recovery.Seen(t.side)
 		}
-		t.platform.SetArc(0, float32(math.Copysign(5.0, float64(t.side))))
 		return
 	} else {
 		t.lost = 0
-		t.search = 60
 	}
 
-	val := float32(0.0)
-	mid := int(math.Ceil(float64(furthest - nearest) / 2))
-	for i := mid; i < furthest; i++ {
-		if !math.IsNaN(float64(line[i])) {
-			val = line[i]
-			break
-		}
+	f, _ := fitLine(line)
+	g := t.Gains()
+	if t.platform.Calibration != nil {
+		t.floor = floorLine(line, t.platform.Calibration, g.LookAhead)
+		floorTopic.Publish(t.floor)
 	}
+	t.pid.Kp, t.pid.Ki, t.pid.Kd = g.Kp, g.Ki, g.Kd
 
+	// Steer towards where the line will be at the look-ahead distance,
+	// so the line's angle is taken into account as well as its offset
+	val := float32(math.Max(math.Min(float64(f.At(g.LookAhead)), 0.5), -0.5))
 	if val > 0 || val < 0 {
 		t.side = val
 	}
+	t.recovery.Seen(t.side)
 
-	vel := float32(float64(t.maxSpeed) - math.Abs(float64(val)) * float64(2 * t.maxSpeed))
-	omega := t.maxTurn * val
+	vel := g.MaxSpeed - float32(math.Abs(float64(val))) * 2 * g.MaxSpeed
+	vel /= 1 + g.CurveSlowdown * float32(math.Abs(float64(f.Curvature)))
+	// Slow down when we're less sure of the line
+	vel *= 0.3 + 0.7 * (conf - lostConfidence) / (1 - lostConfidence)
+	if frameTime.Before(t.slowUntil) {
+		vel *= t.hazardSpeed
+	}
+	if vel < 0 {
+		vel = 0
+	}
+	omega := t.pid.Update(val, dt)
 	t.platform.SetArc(vel, omega)
 }
 
-func NewTask(pl *base.Platform) *Task {
+// NewTask makes a line following task, which steers by the results from
+// 'lineDetect', a stage of 'vis'
+func NewTask(m *model.Model, pl *base.Platform, vis *vision.Pipeline, lineDetect *vision.LineDetect) *Task {
 	return &Task{
 		platform: pl,
-		search: 60,
-		maxSpeed: 300,
-		maxTurn: 10,
+		vision: vis,
+		lineDetect: lineDetect,
+		recovery: NewRecovery(m, pl),
+		branch: algo.Straight,
+		stopAtEnd: true,
+		hazardTime: 2 * time.Second,
+		hazardSpeed: 0.5,
+		gains: Gains{
+			Kp: 10,
+			Ki: 0,
+			Kd: 0.5,
+			LookAhead: 0.5,
+			CurveSlowdown: 1.0,
+			MaxSpeed: 300,
+		},
+		pid: PID{
+			ILimit: 2,
+		},
 	}
 }
@@ -0,0 +1,83 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package line
+
+import (
+	"github.com/usedbytes/mini_mouse/bot/plan/line/algo"
+)
+
+type Event int
+const (
+	// Green side marker, passed once per lap
+	LapMarker Event = iota
+	// Red side marker, slow down for a while
+	Hazard
+	// Green patch across the track
+	Finish
+	numEvents
+)
+
+func (e Event) String() string {
+	return [...]string{ "LapMarker", "Hazard", "Finish" }[e]
+}
+
+const (
+	// Frames a marker must be seen for before it counts
+	markerFrames = 2
+	// Frames it must then be gone for before it can count again
+	markerClearFrames = 15
+	// Fraction of the centre a finish patch must cover
+	finishFraction = 0.3
+)
+
+// markerTracker debounces marker detections into events
+type markerTracker struct {
+	seen [numEvents]int
+	gone [numEvents]int
+	fired [numEvents]bool
+}
+
+func markerEvent(m algo.Marker) (Event, bool) {
+	switch {
+	case m.Colour == algo.Green && m.Side == algo.SideCentre && m.Fraction >= finishFraction:
+		return Finish, true
+	case m.Colour == algo.Green && m.Side != algo.SideCentre:
+		return LapMarker, true
+	case m.Colour == algo.Red && m.Side != algo.SideCentre:
+		return Hazard, true
+	}
+	return 0, false
+}
+
+func (mt *markerTracker) reset() {
+	*mt = markerTracker{}
+}
+
+func (mt *markerTracker) update(markers []algo.Marker) []Event {
+	var present [numEvents]bool
+	for _, m := range markers {
+		if e, ok := markerEvent(m); ok {
+			present[e] = true
+		}
+	}
+
+	var events []Event
+	for e := Event(0); e < numEvents; e++ {
+		if !present[e] {
+			mt.seen[e] = 0
+			mt.gone[e]++
+			if mt.gone[e] >= markerClearFrames {
+				mt.fired[e] = false
+			}
+			continue
+		}
+
+		mt.gone[e] = 0
+		mt.seen[e]++
+		if mt.seen[e] >= markerFrames && !mt.fired[e] {
+			mt.fired[e] = true
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package line
+
+import (
+	"math"
+)
+
+type PID struct {
+	Kp, Ki, Kd float32
+	// Clamp on the integral term's contribution
+	ILimit float32
+
+	integral float32
+	prevErr float32
+	primed bool
+}
+
+func (p *PID) Reset() {
+	p.integral = 0
+	p.prevErr = 0
+	p.primed = false
+}
+
+func (p *PID) Update(err, dt float32) float32 {
+	deriv := float32(0.0)
+	if p.primed && dt > 0 {
+		deriv = (err - p.prevErr) / dt
+	}
+	p.prevErr = err
+	p.primed = true
+
+	if p.Ki != 0 {
+		p.integral += err * dt
+		if p.ILimit > 0 {
+			lim := float64(p.ILimit / p.Ki)
+			lim = math.Abs(lim)
+			p.integral = float32(math.Max(math.Min(float64(p.integral), lim), -lim))
+		}
+	}
+
+	return p.Kp * err + p.Ki * p.integral + p.Kd * deriv
+}
+
+// fit is a quadratic x = Offset + Slope * r + (Curvature / 2) * r^2 through
+// the line points, where r is the row normalised to 0 (nearest) .. 1
+type fit struct {
+	Offset float32
+	Slope float32
+	Curvature float32
+}
+
+// At returns the fitted line position at normalised row r
+func (f fit) At(r float32) float32 {
+	return f.Offset + f.Slope * r + f.Curvature * r * r / 2
+}
+
+func fitLine(line []float32) (fit, bool) {
+	var n, sr, sr2, sr3, sr4, sx, srx, sr2x float64
+
+	h := float64(len(line))
+	for i, v := range line {
+		if math.IsNaN(float64(v)) {
+			continue
+		}
+		r := float64(i) / h
+		x := float64(v)
+		n++
+		sr += r
+		sr2 += r * r
+		sr3 += r * r * r
+		sr4 += r * r * r * r
+		sx += x
+		srx += r * x
+		sr2x += r * r * x
+	}
+
+	switch {
+	case n == 0:
+		return fit{}, false
+	case n == 1:
+		return fit{ Offset: float32(sx) }, true
+	case n == 2:
+		den := n * sr2 - sr * sr
+		if den == 0 {
+			return fit{ Offset: float32(sx / n) }, true
+		}
+		b := (n * srx - sr * sx) / den
+		a := (sx - b * sr) / n
+		return fit{ Offset: float32(a), Slope: float32(b) }, true
+	}
+
+	// Solve the 3x3 normal equations by Cramer's rule
+	det3 := func(a, b, c, d, e, f, g, h, i float64) float64 {
+		return a * (e * i - f * h) - b * (d * i - f * g) + c * (d * h - e * g)
+	}
+
+	det := det3(n, sr, sr2, sr, sr2, sr3, sr2, sr3, sr4)
+	if math.Abs(det) < 1e-12 {
+		return fit{ Offset: float32(sx / n) }, true
+	}
+
+	a := det3(sx, sr, sr2, srx, sr2, sr3, sr2x, sr3, sr4) / det
+	b := det3(n, sx, sr2, sr, srx, sr3, sr2, sr2x, sr4) / det
+	c := det3(n, sr, sx, sr, sr2, srx, sr2, sr3, sr2x) / det
+
+	return fit{ Offset: float32(a), Slope: float32(b), Curvature: float32(2 * c) }, true
+}
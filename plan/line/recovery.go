@@ -0,0 +1,220 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package line
+
+import (
+	"math"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan/motion"
+)
+
+// A new crumb is dropped when the heading has changed by this much
+const crumbAngle = math.Pi / 36
+
+// Shorter legs than this (mm) aren't worth reversing along
+const minLeg = 5
+
+// A crumb marks where the heading changed on the path driven while the line
+// was visible
+type crumb struct {
+	heading float32
+	// Odometer reading, mm
+	dist float32
+}
+
+// A leg of the path to reverse along
+type leg struct {
+	heading float32
+	length float32
+}
+
+// Recovery searches for the line after it's been lost. It reverses back
+// along the path it drove while it could see the line, by up to MaxReverse,
+// then sweeps from side to side about the last known heading, starting on
+// the side the line was last seen. If that doesn't find it, it creeps
+// forwards and sweeps again, then gives up.
+type Recovery struct {
+	platform *base.Platform
+	model *model.Model
+
+	// Where we were when the line was last seen
+	lastHeading float32
+	lastSide float32
+	// The path which led there, oldest first, covering at least the last
+	// MaxReverse mm
+	trail []crumb
+
+	active bool
+	failed bool
+	start time.Time
+	move motion.Move
+
+	Timeout time.Duration
+	MaxReverse float32
+	Creep float32
+	// Sweep amplitudes either side of the last heading, in radians
+	Sweeps []float32
+}
+
+func (r *Recovery) distance() float32 {
+	a, b := r.platform.GetDistance()
+	return (a + b) / 2
+}
+
+// track adds to the trail, forgetting what's too far back to reverse along
+func (r *Recovery) track(heading, dist float32) {
+	n := len(r.trail)
+	if n == 0 || math.Abs(float64(motion.WrapAngle(heading - r.trail[n - 1].heading))) > crumbAngle {
+		r.trail = append(r.trail, crumb{ heading, dist })
+	}
+
+	drop := 0
+	for drop < len(r.trail) - 1 && dist - r.trail[drop + 1].dist >= r.MaxReverse {
+		drop++
+	}
+	r.trail = append(r.trail[:0], r.trail[drop:]...)
+}
+
+// reverse returns the legs to drive backwards along to retrace the trail
+// from odometer reading 'now', newest first
+func (r *Recovery) reverse(now float32) []leg {
+	var legs []leg
+	remaining := r.MaxReverse
+	end := now
+	for i := len(r.trail) - 1; i >= 0 && remaining > 0; i-- {
+		c := r.trail[i]
+		length := end - c.dist
+		end = c.dist
+		if length <= 0 {
+			continue
+		}
+		if length > remaining {
+			length = remaining
+		}
+		remaining -= length
+		if length >= minLeg {
+			legs = append(legs, leg{ c.heading, length })
+		}
+	}
+	return legs
+}
+
+// Seen records that the line is visible, on 'side'
+func (r *Recovery) Seen(side float32) {
+	if r.active {
+		// The trail doesn't go through the search
+		r.trail = r.trail[:0]
+	}
+
+	_, r.lastHeading = r.model.GetPose()
+	r.lastSide = side
+	r.track(r.lastHeading, r.distance())
+
+	if r.active && r.move != nil {
+		r.move.Exit()
+	}
+	r.active = false
+	r.failed = false
+	r.move = nil
+}
+
+// Reset forgets the trail, e.g. when the robot has been picked up, and
+// records that the line is visible on 'side'
+func (r *Recovery) Reset(side float32) {
+	r.trail = r.trail[:0]
+	r.Seen(side)
+}
+
+func (r *Recovery) Failed() bool {
+	return r.failed
+}
+
+func (r *Recovery) sweep(amplitude float32) []motion.Move {
+	// Positive side is right, which is clockwise
+	toward := -float32(math.Copysign(1, float64(r.lastSide)))
+
+	l := motion.DefaultLimits(r.platform)
+	// Turn slowly enough for the camera to spot the line
+	l.MaxOmega = 1.5
+
+	var moves []motion.Move
+	for _, s := range []float32{ toward, -toward } {
+		t := motion.TurnTo(r.model, r.platform, r.lastHeading + s * amplitude)
+		t.SetLimits(l)
+		moves = append(moves, t)
+	}
+
+	return moves
+}
+
+func (r *Recovery) begin() {
+	r.active = true
+	r.failed = false
+	r.start = r.platform.Now()
+
+	var moves []motion.Move
+
+	// Back to where the line was, the way we came
+	for _, l := range r.reverse(r.distance()) {
+		moves = append(moves, motion.TurnTo(r.model, r.platform, l.heading))
+		moves = append(moves, motion.DriveDistance(r.model, r.platform, -l.length))
+	}
+
+	for _, a := range r.Sweeps {
+		moves = append(moves, r.sweep(a)...)
+	}
+
+	// Widen the search: creep forwards and sweep again
+	if len(r.Sweeps) > 0 && r.Creep > 0 {
+		moves = append(moves, motion.TurnTo(r.model, r.platform, r.lastHeading))
+		moves = append(moves, motion.DriveDistance(r.model, r.platform, r.Creep))
+		moves = append(moves, r.sweep(r.Sweeps[len(r.Sweeps) - 1])...)
+	}
+
+	r.move = motion.NewSequence(moves...)
+	r.move.Enter()
+}
+
+func (r *Recovery) giveUp() {
+	if r.move != nil {
+		r.move.Exit()
+		r.move = nil
+	}
+	r.platform.SetVelocity(0, 0)
+	r.failed = true
+}
+
+// Tick runs the search. Call it while the line is lost.
+func (r *Recovery) Tick(buttons input.ButtonState) {
+	if r.failed {
+		return
+	}
+
+	if !r.active {
+		r.begin()
+	}
+
+	if r.platform.Now().Sub(r.start) > r.Timeout {
+		r.giveUp()
+		return
+	}
+
+	r.move.Tick(buttons)
+	if done, _ := r.move.Done(); done {
+		r.giveUp()
+	}
+}
+
+func NewRecovery(m *model.Model, pl *base.Platform) *Recovery {
+	return &Recovery{
+		platform: pl,
+		model: m,
+		Timeout: 10 * time.Second,
+		MaxReverse: 100,
+		Creep: 40,
+		Sweeps: []float32{ math.Pi / 6, math.Pi / 3, math.Pi / 2 },
+	}
+}
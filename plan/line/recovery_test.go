@@ -0,0 +1,77 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package line
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRecoveryTrail(t *testing.T) {
+	const deg = math.Pi / 180
+
+	type point struct {
+		heading, dist float32
+	}
+
+	tests := []struct{
+		name string
+		path []point
+		// Odometer reading when the line is lost
+		now float32
+		legs []leg
+	}{
+		{
+			"Straight",
+			[]point{ { 0, 0 }, { 0, 50 }, { 0, 150 } },
+			160,
+			[]leg{ { 0, 100 } },
+		},
+		{
+			// Turned right, then lost the line: back along the new
+			// heading, then the old one
+			"Corner",
+			[]point{ { 0, 0 }, { 0, 50 }, { -30 * deg, 60 }, { -30 * deg, 90 } },
+			100,
+			[]leg{ { -30 * deg, 40 }, { 0, 60 } },
+		},
+		{
+			// Small wiggles don't make new legs
+			"Wiggle",
+			[]point{ { 0, 0 }, { 2 * deg, 20 }, { -2 * deg, 40 }, { 0, 60 } },
+			80,
+			[]leg{ { 0, 80 } },
+		},
+		{
+			// Only the last MaxReverse mm are kept
+			"Long",
+			[]point{ { 90 * deg, 0 }, { 0, 200 }, { 20 * deg, 400 }, { 20 * deg, 450 } },
+			460,
+			[]leg{ { 20 * deg, 60 }, { 0, 40 } },
+		},
+		{
+			"Barely moved",
+			[]point{ { 0, 0 } },
+			3,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		r := &Recovery{ MaxReverse: 100 }
+		for _, p := range test.path {
+			r.track(p.heading, p.dist)
+		}
+
+		legs := r.reverse(test.now)
+		if len(legs) != len(test.legs) {
+			t.Errorf("%s: reversing along %v, expected %v", test.name, legs, test.legs)
+			continue
+		}
+		for i, l := range legs {
+			if math.Abs(float64(l.heading - test.legs[i].heading)) > 1e-6 || math.Abs(float64(l.length - test.legs[i].length)) > 1e-3 {
+				t.Errorf("%s: reversing along %v, expected %v", test.name, legs, test.legs)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package maze
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Direction int
+const (
+	North Direction = iota
+	East
+	South
+	West
+)
+
+func (d Direction) Left() Direction {
+	return (d + 3) % 4
+}
+
+func (d Direction) Right() Direction {
+	return (d + 1) % 4
+}
+
+func (d Direction) Reverse() Direction {
+	return (d + 2) % 4
+}
+
+func (d Direction) String() string {
+	return [...]string{ "North", "East", "South", "West" }[d]
+}
+
+// Cell (0, 0) is the bottom-left of the maze, North is +Y
+type Cell struct {
+	X, Y int
+}
+
+func (c Cell) Step(d Direction) Cell {
+	switch d {
+	case North:
+		return Cell{ c.X, c.Y + 1 }
+	case East:
+		return Cell{ c.X + 1, c.Y }
+	case South:
+		return Cell{ c.X, c.Y - 1 }
+	default:
+		return Cell{ c.X - 1, c.Y }
+	}
+}
+
+// Maze is a map of the walls between cells, and which of them have been
+// seen. The outside boundary is always walled.
+type Maze struct {
+	w, h int
+	walls []uint8
+	known []uint8
+}
+
+func (m *Maze) Size() (int, int) {
+	return m.w, m.h
+}
+
+func (m *Maze) Contains(c Cell) bool {
+	return c.X >= 0 && c.Y >= 0 && c.X < m.w && c.Y < m.h
+}
+
+func (m *Maze) idx(c Cell) int {
+	return c.Y * m.w + c.X
+}
+
+func (m *Maze) set(c Cell, d Direction, wall bool) {
+	if !m.Contains(c) {
+		return
+	}
+
+	i := m.idx(c)
+	if wall {
+		m.walls[i] |= 1 << uint(d)
+	} else {
+		m.walls[i] &^= 1 << uint(d)
+	}
+	m.known[i] |= 1 << uint(d)
+}
+
+// SetWall records whether there's a wall on side 'd' of cell 'c'
+func (m *Maze) SetWall(c Cell, d Direction, wall bool) {
+	n := c.Step(d)
+	if !m.Contains(c) || !m.Contains(n) {
+		// Boundary walls can't be changed
+		return
+	}
+
+	m.set(c, d, wall)
+	m.set(n, d.Reverse(), wall)
+}
+
+func (m *Maze) Wall(c Cell, d Direction) bool {
+	if !m.Contains(c) || !m.Contains(c.Step(d)) {
+		return true
+	}
+	return m.walls[m.idx(c)] & (1 << uint(d)) != 0
+}
+
+func (m *Maze) Known(c Cell, d Direction) bool {
+	if !m.Contains(c) {
+		return true
+	}
+	return m.known[m.idx(c)] & (1 << uint(d)) != 0
+}
+
+// Unreachable is the flood-fill distance of cells which can't reach the goal
+const Unreachable = -1
+
+// FloodFill returns the distance in cells from every cell to the nearest goal
+// cell, indexed by Y * width + X. If 'optimistic' is set, walls which haven't
+// been seen are assumed to be open.
+func (m *Maze) FloodFill(goals []Cell, optimistic bool) []int {
+	dist := make([]int, m.w * m.h)
+	for i := range dist {
+		dist[i] = Unreachable
+	}
+
+	queue := make([]Cell, 0, m.w * m.h)
+	for _, g := range goals {
+		if m.Contains(g) {
+			dist[m.idx(g)] = 0
+			queue = append(queue, g)
+		}
+	}
+
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		for d := North; d <= West; d++ {
+			if !m.Open(c, d, optimistic) {
+				continue
+			}
+			n := c.Step(d)
+			if dist[m.idx(n)] != Unreachable {
+				continue
+			}
+			dist[m.idx(n)] = dist[m.idx(c)] + 1
+			queue = append(queue, n)
+		}
+	}
+
+	return dist
+}
+
+// Open reports whether the robot can move from c in direction d. Unknown
+// walls are treated as open if 'optimistic' is set.
+func (m *Maze) Open(c Cell, d Direction, optimistic bool) bool {
+	if !m.Contains(c) || !m.Contains(c.Step(d)) {
+		return false
+	}
+	if !m.Known(c, d) {
+		return optimistic
+	}
+	return !m.Wall(c, d)
+}
+
+// Distance returns the flood-fill distance of c, or Unreachable
+func (m *Maze) Distance(dist []int, c Cell) int {
+	if !m.Contains(c) {
+		return Unreachable
+	}
+	return dist[m.idx(c)]
+}
+
+// Route follows a flood-fill downhill from 'from', returning the directions
+// to take. Straight on is preferred where there's a choice.
+func (m *Maze) Route(dist []int, from Cell, facing Direction, optimistic bool) ([]Direction, error) {
+	var route []Direction
+
+	c := from
+	for m.Distance(dist, c) > 0 {
+		d, ok := m.Downhill(dist, c, facing, optimistic)
+		if !ok {
+			return nil, fmt.Errorf("No route from %v", c)
+		}
+		route = append(route, d)
+		c = c.Step(d)
+		facing = d
+	}
+
+	if m.Distance(dist, c) != 0 {
+		return nil, fmt.Errorf("No route from %v", from)
+	}
+
+	return route, nil
+}
+
+// Downhill picks the open neighbour of c with the lowest distance,
+// preferring 'facing' then turns over reversing
+func (m *Maze) Downhill(dist []int, c Cell, facing Direction, optimistic bool) (Direction, bool) {
+	best := Unreachable
+	var dir Direction
+
+	for _, d := range []Direction{ facing, facing.Left(), facing.Right(), facing.Reverse() } {
+		if !m.Open(c, d, optimistic) {
+			continue
+		}
+		nd := m.Distance(dist, c.Step(d))
+		if nd == Unreachable {
+			continue
+		}
+		if best == Unreachable || nd < best {
+			best = nd
+			dir = d
+		}
+	}
+
+	return dir, best != Unreachable && best < m.Distance(dist, c)
+}
+
+func NewMaze(w, h int) *Maze {
+	return &Maze{
+		w: w,
+		h: h,
+		walls: make([]uint8, w * h),
+		known: make([]uint8, w * h),
+	}
+}
+
+// ParseMaze reads a fully-known maze from the common text format, e.g:
+//
+//	+---+---+
+//	|       |
+//	+   +---+
+//	|   |   |
+//	+---+---+
+//
+// The first line is the North edge.
+func ParseMaze(text string) (*Maze, error) {
+	lines := strings.Split(strings.Trim(text, "\n"), "\n")
+	if len(lines) < 3 || len(lines) % 2 != 1 {
+		return nil, fmt.Errorf("Bad maze height")
+	}
+
+	width := len(strings.TrimRight(lines[0], " "))
+	if width < 5 || (width - 1) % 4 != 0 {
+		return nil, fmt.Errorf("Bad maze width")
+	}
+
+	w := (width - 1) / 4
+	h := (len(lines) - 1) / 2
+	m := NewMaze(w, h)
+
+	at := func(row, col int) byte {
+		if col < len(lines[row]) {
+			return lines[row][col]
+		}
+		return ' '
+	}
+
+	for y := 0; y < h; y++ {
+		row := 2 * (h - 1 - y) + 1
+		for x := 0; x < w; x++ {
+			c := Cell{ x, y }
+			col := 4 * x + 2
+			m.SetWall(c, North, at(row - 1, col) == '-')
+			m.SetWall(c, East, at(row, col + 2) == '|')
+		}
+	}
+
+	// Mark the boundaries known, so everything is
+	for i := range m.known {
+		m.known[i] = 0xf
+	}
+
+	return m, nil
+}
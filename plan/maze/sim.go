@@ -0,0 +1,92 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package maze
+
+import (
+	"fmt"
+
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/plan/motion"
+)
+
+// Sim is a Body which moves through a known maze, for exercising the task
+// without the robot. Each move completes in a single Tick.
+type Sim struct {
+	maze *Maze
+	start Cell
+
+	Pos Cell
+	Dir Direction
+	// Number of moves made, and cells driven
+	Moves, Cells int
+}
+
+type simMove struct {
+	fn func() error
+	done bool
+	err error
+}
+
+func (m *simMove) Enter() {
+	m.done = false
+	m.err = nil
+}
+
+func (m *simMove) Exit() { }
+
+func (m *simMove) Tick(buttons input.ButtonState) {
+	if !m.done {
+		m.err = m.fn()
+		m.done = true
+	}
+}
+
+func (m *simMove) Done() (bool, error) {
+	return m.done, m.err
+}
+
+func (s *Sim) Reset(d Direction) {
+	s.Pos = s.start
+	s.Dir = d
+	s.Moves = 0
+	s.Cells = 0
+}
+
+func (s *Sim) Walls() (bool, bool, bool) {
+	return s.maze.Wall(s.Pos, s.Dir.Left()),
+	       s.maze.Wall(s.Pos, s.Dir),
+	       s.maze.Wall(s.Pos, s.Dir.Right())
+}
+
+func (s *Sim) Face(d Direction) motion.Move {
+	return &simMove{
+		fn: func() error {
+			s.Dir = d
+			s.Moves++
+			return nil
+		},
+	}
+}
+
+func (s *Sim) Forward(cells int, fast bool) motion.Move {
+	return &simMove{
+		fn: func() error {
+			s.Moves++
+			for i := 0; i < cells; i++ {
+				if s.maze.Wall(s.Pos, s.Dir) {
+					return fmt.Errorf("Crashed into wall at %v facing %v", s.Pos, s.Dir)
+				}
+				s.Pos = s.Pos.Step(s.Dir)
+				s.Cells++
+			}
+			return nil
+		},
+	}
+}
+
+func NewSim(m *Maze, start Cell) *Sim {
+	return &Sim{
+		maze: m,
+		start: start,
+		Pos: start,
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package maze
+
+import (
+	"math"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan/motion"
+)
+
+const TaskName = "maze"
+
+var logger = logging.New("maze")
+
+// Body is how the task senses and moves through the maze, so that it can be
+// run against the real robot or a simulation.
+type Body interface {
+	// Reset is called when the robot is in the start cell facing 'd'
+	Reset(d Direction)
+	// Walls reports walls to the left, front and right of the current cell
+	Walls() (left, front, right bool)
+	// Face turns on the spot to face 'd'
+	Face(d Direction) motion.Move
+	// Forward drives 'cells' cells straight ahead
+	Forward(cells int, fast bool) motion.Move
+}
+
+// Strategy is how the maze is explored on the way to the goal. The way
+// back to the start, and the fast run, always use flood-fill.
+type Strategy int
+const (
+	// Head for the goal, treating walls which haven't been seen as open
+	FloodFill Strategy = iota
+	// Keep a wall on the left. It needs no map, but never finds a goal
+	// which isn't connected to the outside wall, e.g. one in the middle of
+	// a loop.
+	WallFollow
+)
+
+func (s Strategy) String() string {
+	return [...]string{ "FloodFill", "WallFollow" }[s]
+}
+
+type phase int
+const (
+	exploring phase = iota
+	returning
+	fastRun
+	finished
+)
+
+type Task struct {
+	body Body
+	maze *Maze
+
+	start Cell
+	startDir Direction
+	goals []Cell
+	strategy Strategy
+	// Cells moved following the wall, to spot going round in circles
+	steps int
+
+	phase phase
+	pos Cell
+	dir Direction
+
+	move motion.Move
+	// Where we'll be once 'move' is done
+	nextPos Cell
+	nextDir Direction
+}
+
+func (t *Task) Maze() *Maze {
+	return t.maze
+}
+
+func (t *Task) Position() (Cell, Direction) {
+	return t.pos, t.dir
+}
+
+func (t *Task) Finished() bool {
+	return t.phase == finished
+}
+
+// SetStrategy sets how the goal is searched for
+func (t *Task) SetStrategy(s Strategy) {
+	t.strategy = s
+}
+
+func (t *Task) Strategy() Strategy {
+	return t.strategy
+}
+
+// Reset forgets the maze and goes back to exploring from the start cell
+func (t *Task) Reset() {
+	w, h := t.maze.Size()
+	t.maze = NewMaze(w, h)
+	t.phase = exploring
+	t.steps = 0
+	t.pos = t.start
+	t.dir = t.startDir
+	t.move = nil
+	t.body.Reset(t.startDir)
+}
+
+func (t *Task) Enter() {
+	// Start again if we've finished or haven't started yet
+	if t.phase == finished || (t.phase == exploring && t.pos == t.start && t.move == nil) {
+		t.Reset()
+	}
+}
+
+func (t *Task) Exit() {
+	if t.move != nil {
+		t.move.Exit()
+		t.move = nil
+	}
+}
+
+func (t *Task) sense() {
+	left, front, right := t.body.Walls()
+	t.maze.SetWall(t.pos, t.dir.Left(), left)
+	t.maze.SetWall(t.pos, t.dir, front)
+	t.maze.SetWall(t.pos, t.dir.Right(), right)
+}
+
+func (t *Task) isGoal(c Cell, goals []Cell) bool {
+	for _, g := range goals {
+		if c == g {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Task) moveTo(d Direction, cells int, fast bool) {
+	fwd := t.body.Forward(cells, fast)
+	if d != t.dir {
+		t.move = motion.NewSequence(t.body.Face(d), fwd)
+	} else {
+		t.move = fwd
+	}
+
+	t.nextPos = t.pos
+	for i := 0; i < cells; i++ {
+		t.nextPos = t.nextPos.Step(d)
+	}
+	t.nextDir = d
+}
+
+// Take one step of exploration towards 'goals'. Returns true if we're
+// already at a goal.
+func (t *Task) explore(goals []Cell, strategy Strategy) bool {
+	t.sense()
+
+	if t.isGoal(t.pos, goals) {
+		return true
+	}
+
+	var d Direction
+	var ok bool
+	if strategy == WallFollow {
+		d, ok = t.followWall()
+	} else {
+		// Treat unknown walls as open
+		dist := t.maze.FloodFill(goals, true)
+		d, ok = t.maze.Downhill(dist, t.pos, t.dir, true)
+	}
+	if !ok {
+		logger.Warn("No way to goal", "goals", goals, "from", t.pos, "strategy", strategy)
+		t.phase = finished
+		return false
+	}
+
+	t.moveTo(d, 1, false)
+	return false
+}
+
+// Pick the next direction keeping a wall on the left. Every wall is passed
+// at most once each side, so taking more steps than that means the goal
+// can't be found this way.
+func (t *Task) followWall() (Direction, bool) {
+	w, h := t.maze.Size()
+	t.steps++
+	if t.steps > 4 * w * h {
+		return t.dir, false
+	}
+
+	for _, d := range []Direction{ t.dir.Left(), t.dir, t.dir.Right(), t.dir.Reverse() } {
+		if t.maze.Open(t.pos, d, false) {
+			return d, true
+		}
+	}
+	return t.dir, false
+}
+
+// Plan the fast run using only the walls we've seen
+func (t *Task) startFastRun() {
+	dist := t.maze.FloodFill(t.goals, false)
+	route, err := t.maze.Route(dist, t.pos, t.dir, false)
+	if err != nil {
+		logger.Warn("Fast run failed", "err", err)
+		t.phase = finished
+		return
+	}
+
+	var moves []motion.Move
+	dir := t.dir
+	for i := 0; i < len(route); {
+		d := route[i]
+		n := 1
+		for i + n < len(route) && route[i + n] == d {
+			n++
+		}
+
+		if d != dir {
+			moves = append(moves, t.body.Face(d))
+		}
+		moves = append(moves, t.body.Forward(n, true))
+
+		dir = d
+		i += n
+	}
+
+	c := t.pos
+	for _, d := range route {
+		c = c.Step(d)
+	}
+
+	t.move = motion.NewSequence(moves...)
+	t.nextPos = c
+	t.nextDir = dir
+	t.phase = fastRun
+}
+
+func (t *Task) Tick(buttons input.ButtonState) {
+	if t.phase == finished {
+		return
+	}
+
+	if t.move != nil {
+		t.move.Tick(buttons)
+
+		done, err := t.move.Done()
+		if !done {
+			return
+		}
+		t.move = nil
+
+		if err != nil {
+			logger.Warn("Move failed", "err", err)
+			t.phase = finished
+			return
+		}
+
+		t.pos = t.nextPos
+		t.dir = t.nextDir
+	}
+
+	switch t.phase {
+	case exploring:
+		if t.explore(t.goals, t.strategy) {
+			logger.Info("Reached goal, returning to start")
+			t.phase = returning
+			t.explore([]Cell{ t.start }, FloodFill)
+		}
+	case returning:
+		if t.explore([]Cell{ t.start }, FloodFill) {
+			logger.Info("Back at start, starting fast run")
+			t.startFastRun()
+		}
+	case fastRun:
+		logger.Info("Finished fast run")
+		t.phase = finished
+	}
+}
+
+func NewTask(body Body, w, h int, start Cell, dir Direction, goals []Cell) *Task {
+	t := &Task{
+		body: body,
+		maze: NewMaze(w, h),
+		start: start,
+		startDir: dir,
+		goals: goals,
+	}
+	t.Reset()
+
+	return t
+}
+
+// Robot is a Body using the rangefinders and motion primitives
+type Robot struct {
+	platform *base.Platform
+	model *model.Model
+
+	cellSize float32
+	// Model heading when facing North
+	north float32
+}
+
+// Sensor indices, as set up by base.NewPlatform
+const (
+	rangeFront = 0
+	rangeLeft = 1
+	rangeRight = 2
+)
+
+func (r *Robot) Walls() (bool, bool, bool) {
+	thresh := r.cellSize * 0.75
+	ranges := r.platform.Ranges
+
+	return ranges.Last(rangeLeft) < thresh,
+	       ranges.Last(rangeFront) < thresh,
+	       ranges.Last(rangeRight) < thresh
+}
+
+func (r *Robot) Face(d Direction) motion.Move {
+	heading := r.north - float32(d) * math.Pi / 2
+	return motion.TurnTo(r.model, r.platform, heading)
+}
+
+func (r *Robot) Forward(cells int, fast bool) motion.Move {
+	d := motion.DriveDistance(r.model, r.platform, float32(cells) * r.cellSize)
+	if fast {
+		l := motion.DefaultLimits(r.platform)
+		l.MaxVelocity = r.platform.GetMaxVelocity()
+		l.Accel *= 2
+		d.SetLimits(l)
+	}
+	return d
+}
+
+func (r *Robot) Reset(d Direction) {
+	_, heading := r.model.GetPose()
+	r.north = heading + float32(d) * math.Pi / 2
+}
+
+func NewRobot(m *model.Model, pl *base.Platform, cellSize float32) *Robot {
+	return &Robot{
+		platform: pl,
+		model: m,
+		cellSize: cellSize,
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package maze
+
+import (
+	"testing"
+)
+
+// A perfect maze: exactly one route between any two cells
+const treeMaze = `
++---+---+---+---+---+
+|                   |
++   +---+---+---+---+
+|                   |
++---+---+   +---+   +
+|       |       |   |
++   +   +---+---+   +
+|   |   |           |
++   +   +   +---+   +
+|   |       |       |
++---+---+---+---+---+
+`
+
+// Has loops, so there's more than one way to the middle
+const loopMaze = `
++---+---+---+---+---+---+
+|       |               |
++   +   +   +   +   +---+
+|       |   |   |       |
++   +   +   +   +   +   +
+|   |   |   |       |   |
++   +---+   +---+---+   +
+|           |       |   |
++   +---+---+   +   +   +
+|   |       |   |       |
++---+   +   +   +---+   +
+|       |       |       |
++---+---+---+---+---+---+
+`
+
+// The goal is on an island in the middle of a loop, with a way in from
+// the North
+const islandMaze = `
++---+---+---+---+
+|               |
++   +   +---+   +
+|   |       |   |
++   +   +   +   +
+|   |       |   |
++   +---+---+   +
+|               |
++---+---+---+---+
+`
+
+type runResult struct {
+	// Where exploration finished, and whether it was a goal
+	explored Cell
+	reached bool
+	// Cells driven in the fast run, and where it ended
+	fastCells int
+	fastEnd Cell
+	finished bool
+}
+
+func runTask(t *testing.T, text string, goals []Cell, strategy Strategy) (*Maze, runResult) {
+	t.Helper()
+
+	m, err := ParseMaze(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim := NewSim(m, Cell{ 0, 0 })
+	w, h := m.Size()
+	task := NewTask(sim, w, h, Cell{ 0, 0 }, North, goals)
+	task.SetStrategy(strategy)
+	task.Enter()
+
+	var res runResult
+	fastStart := -1
+	for i := 0; i < 10000 && !task.Finished(); i++ {
+		before := task.phase
+		task.Tick(nil)
+
+		if before == exploring && task.phase != exploring {
+			res.explored = sim.Pos
+			res.reached = task.isGoal(sim.Pos, goals)
+		}
+		if before != fastRun && task.phase == fastRun {
+			fastStart = sim.Cells
+		}
+	}
+
+	res.finished = task.Finished()
+	if fastStart >= 0 {
+		res.fastCells = sim.Cells - fastStart
+		res.fastEnd = sim.Pos
+	}
+
+	return m, res
+}
+
+func TestTask(t *testing.T) {
+	centre := []Cell{ {2, 2}, {2, 3}, {3, 2}, {3, 3} }
+
+	tests := []struct{
+		name string
+		maze string
+		goals []Cell
+		strategy Strategy
+		// Whether the goal can be found
+		reachable bool
+	}{
+		{ "Tree", treeMaze, []Cell{ {4, 4} }, FloodFill, true },
+		{ "Tree", treeMaze, []Cell{ {4, 4} }, WallFollow, true },
+		{ "Loop", loopMaze, centre, FloodFill, true },
+		{ "Loop", loopMaze, []Cell{ {5, 0} }, WallFollow, true },
+		{ "Island", islandMaze, []Cell{ {1, 1}, {1, 2}, {2, 1}, {2, 2} }, FloodFill, true },
+		{ "Island", islandMaze, []Cell{ {1, 1}, {1, 2}, {2, 1}, {2, 2} }, WallFollow, false },
+	}
+
+	for _, test := range tests {
+		name := test.name + "/" + test.strategy.String()
+		m, res := runTask(t, test.maze, test.goals, test.strategy)
+
+		if !res.finished {
+			t.Errorf("%s: didn't finish", name)
+			continue
+		}
+
+		if !test.reachable {
+			if res.reached {
+				t.Errorf("%s: reached goal at %v, expected not to", name, res.explored)
+			}
+			continue
+		}
+
+		if !res.reached {
+			t.Errorf("%s: exploration stopped at %v, not a goal", name, res.explored)
+			continue
+		}
+
+		// The fast run only knows the walls it's seen, but they must be
+		// enough to take the shortest route through the whole maze
+		shortest := m.Distance(m.FloodFill(test.goals, false), Cell{ 0, 0 })
+		if res.fastCells != shortest {
+			t.Errorf("%s: fast run drove %d cells, shortest route is %d", name, res.fastCells, shortest)
+		}
+
+		found := false
+		for _, g := range test.goals {
+			found = found || res.fastEnd == g
+		}
+		if !found {
+			t.Errorf("%s: fast run ended at %v, not a goal", name, res.fastEnd)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package motion
+
+import (
+	"math"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/model"
+)
+
+// Proportional gain used to hold the expected heading while driving
+const headingGain = 3.0
+
+// Drive moves along a straight line or a circular arc, measuring progress
+// with the wheel odometry and correcting heading with the model.
+type Drive struct {
+	move
+
+	// Signed path length in mm, negative is backwards
+	length float32
+	// Total heading change over the move
+	angle float32
+
+	startDist float32
+	startHeading float32
+	vel float32
+}
+
+func (d *Drive) Enter() {
+	d.restart()
+	d.vel = 0
+	d.startDist = d.distance()
+	_, d.startHeading = d.model.GetPose()
+}
+
+func (d *Drive) Tick(buttons input.ButtonState) {
+	if !d.started {
+		d.Enter()
+	}
+
+	if !d.tick() {
+		return
+	}
+
+	travelled := d.distance() - d.startDist
+	remaining := d.length - travelled
+	if abs32(remaining) <= d.limits.DistTolerance {
+		d.finish(nil)
+		return
+	}
+
+	v := profile(remaining, d.vel, d.limits.MinVelocity, d.limits.MaxVelocity, d.limits.Accel, d.dt)
+	d.vel = copysign32(v, remaining)
+
+	// Follow the arc's curvature, and pull back towards the heading we
+	// should have by now
+	w := float32(0.0)
+	expected := d.startHeading
+	if d.length != 0 {
+		w = d.angle * d.vel / d.length
+		expected += d.angle * travelled / d.length
+	}
+	_, heading := d.model.GetPose()
+	w += headingGain * WrapAngle(expected - heading)
+	w = copysign32(min32(abs32(w), d.limits.MaxOmega), w)
+
+	d.setArc(d.vel, w)
+}
+
+func (d *Drive) SetLimits(l Limits) {
+	d.limits = l
+}
+
+func newDrive(m *model.Model, pl *base.Platform, length, angle float32) *Drive {
+	return &Drive{
+		move: move{
+			platform: pl,
+			model: m,
+			limits: DefaultLimits(pl),
+		},
+		length: length,
+		angle: angle,
+	}
+}
+
+// Drive straight for 'mm' millimetres, holding the starting heading.
+// Negative is backwards.
+func DriveDistance(m *model.Model, pl *base.Platform, mm float32) *Drive {
+	return newDrive(m, pl, mm, 0)
+}
+
+// Drive forwards around an arc of 'radius' mm, changing heading by 'angle'
+// radians. Positive angle is anti-clockwise. A zero radius turns on the spot.
+func DriveArc(m *model.Model, pl *base.Platform, radius, angle float32) Move {
+	if radius == 0 {
+		return TurnBy(m, pl, angle)
+	}
+
+	length := float32(math.Abs(float64(radius * angle)))
+	return newDrive(m, pl, length, angle)
+}
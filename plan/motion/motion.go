@@ -0,0 +1,215 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package motion
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan"
+)
+
+var ErrTimeout = errors.New("Move timed out")
+
+// A Move is a plan.Task which finishes. Tick it until Done() returns true.
+// Enter() (re)starts the move, and Exit() stops the robot.
+type Move interface {
+	plan.EnterExitTask
+	Done() (bool, error)
+}
+
+type Limits struct {
+	// mm/s and mm/s/s
+	MaxVelocity, MinVelocity, Accel float32
+	// rad/s and rad/s/s
+	MaxOmega, MinOmega, AngAccel float32
+
+	// mm and rad
+	DistTolerance, AngleTolerance float32
+
+	Timeout time.Duration
+}
+
+func DefaultLimits(pl *base.Platform) Limits {
+	return Limits{
+		MaxVelocity: pl.GetMaxVelocity() * 0.75,
+		MinVelocity: 20,
+		Accel: 600,
+
+		MaxOmega: 4,
+		MinOmega: 0.4,
+		AngAccel: 20,
+
+		DistTolerance: 3,
+		AngleTolerance: math.Pi / 90,
+
+		Timeout: 5 * time.Second,
+	}
+}
+
+func abs32(x float32) float32 {
+	return float32(math.Abs(float64(x)))
+}
+
+func copysign32(x, s float32) float32 {
+	return float32(math.Copysign(float64(x), float64(s)))
+}
+
+func min32(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Wrap an angle to [-Pi, Pi]
+func WrapAngle(a float32) float32 {
+	return float32(math.Atan2(math.Sin(float64(a)), math.Cos(float64(a))))
+}
+
+// Speed which allows stopping within 'remaining' at 'decel', capped to
+// [min, max], and limited to 'accel' more than 'prev' since the last tick.
+func profile(remaining, prev, min, max, accel float32, dt float32) float32 {
+	v := float32(math.Sqrt(float64(2 * accel * abs32(remaining))))
+	v = min32(v, max)
+	if dt > 0 {
+		v = min32(v, abs32(prev) + accel * dt)
+	}
+	return max32(v, min)
+}
+
+// move holds the state common to all of the primitives
+type move struct {
+	platform *base.Platform
+	model *model.Model
+	limits Limits
+
+	started bool
+	done bool
+	err error
+
+	startTime, lastTick time.Time
+	dt float32
+}
+
+func (m *move) Done() (bool, error) {
+	return m.done, m.err
+}
+
+func (m *move) Exit() {
+	m.platform.SetVelocity(0, 0)
+}
+
+func (m *move) restart() {
+	m.started = true
+	m.done = false
+	m.err = nil
+	m.startTime = m.platform.Now()
+	m.lastTick = m.startTime
+	m.dt = 0
+}
+
+// Returns false if the move shouldn't do anything this tick
+func (m *move) tick() bool {
+	if m.done {
+		return false
+	}
+
+	now := m.platform.Now()
+	m.dt = float32(now.Sub(m.lastTick).Seconds())
+	m.lastTick = now
+
+	if m.limits.Timeout > 0 && now.Sub(m.startTime) > m.limits.Timeout {
+		m.finish(ErrTimeout)
+		return false
+	}
+
+	return true
+}
+
+func (m *move) finish(err error) {
+	m.platform.SetVelocity(0, 0)
+	m.done = true
+	m.err = err
+}
+
+// Positive omega is anti-clockwise, matching model.Model
+func (m *move) setArc(v, w float32) {
+	dv := w * m.platform.Wheelbase() / 2
+	a, b := v - dv, v + dv
+
+	max := m.platform.GetMaxVelocity()
+	if over := max32(abs32(a), abs32(b)); over > max {
+		a = a * max / over
+		b = b * max / over
+	}
+
+	m.platform.SetVelocity(a, b)
+}
+
+func (m *move) distance() float32 {
+	a, b := m.platform.GetDistance()
+	return (a + b) / 2
+}
+
+// Sequence runs a list of Moves one after the other, stopping at the first
+// failure.
+type Sequence struct {
+	moves []Move
+	idx int
+	entered bool
+	err error
+}
+
+func (s *Sequence) Enter() {
+	s.idx = 0
+	s.err = nil
+	s.entered = false
+}
+
+func (s *Sequence) Exit() {
+	if s.idx < len(s.moves) {
+		s.moves[s.idx].Exit()
+	}
+}
+
+func (s *Sequence) Tick(buttons input.ButtonState) {
+	for s.err == nil && s.idx < len(s.moves) {
+		mv := s.moves[s.idx]
+		if !s.entered {
+			mv.Enter()
+			s.entered = true
+		}
+
+		mv.Tick(buttons)
+
+		done, err := mv.Done()
+		if !done {
+			return
+		}
+
+		s.err = err
+		s.idx++
+		s.entered = false
+	}
+}
+
+func (s *Sequence) Done() (bool, error) {
+	return s.err != nil || s.idx >= len(s.moves), s.err
+}
+
+func NewSequence(moves ...Move) *Sequence {
+	return &Sequence{
+		moves: moves,
+	}
+}
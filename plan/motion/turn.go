@@ -0,0 +1,78 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package motion
+
+import (
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/model"
+)
+
+// Turn rotates on the spot, either to an absolute heading or by a relative
+// angle from the heading when the move starts.
+type Turn struct {
+	move
+
+	relative bool
+	angle float32
+	target float32
+	omega float32
+}
+
+func (t *Turn) Enter() {
+	t.restart()
+	t.omega = 0
+
+	_, heading := t.model.GetPose()
+	if t.relative {
+		t.target = WrapAngle(heading + t.angle)
+	} else {
+		t.target = WrapAngle(t.angle)
+	}
+}
+
+func (t *Turn) Tick(buttons input.ButtonState) {
+	if !t.started {
+		t.Enter()
+	}
+
+	if !t.tick() {
+		return
+	}
+
+	_, heading := t.model.GetPose()
+	err := WrapAngle(t.target - heading)
+	if abs32(err) <= t.limits.AngleTolerance {
+		t.finish(nil)
+		return
+	}
+
+	w := profile(err, t.omega, t.limits.MinOmega, t.limits.MaxOmega, t.limits.AngAccel, t.dt)
+	t.omega = copysign32(w, err)
+	t.platform.SetOmega(t.omega)
+}
+
+func (t *Turn) SetLimits(l Limits) {
+	t.limits = l
+}
+
+func newTurn(m *model.Model, pl *base.Platform, angle float32, relative bool) *Turn {
+	return &Turn{
+		move: move{
+			platform: pl,
+			model: m,
+			limits: DefaultLimits(pl),
+		},
+		relative: relative,
+		angle: angle,
+	}
+}
+
+// Turn to face an absolute heading, in radians
+func TurnTo(m *model.Model, pl *base.Platform, heading float32) *Turn {
+	return newTurn(m, pl, heading, false)
+}
+
+// Turn by 'angle' radians. Positive is anti-clockwise
+func TurnBy(m *model.Model, pl *base.Platform, angle float32) *Turn {
+	return newTurn(m, pl, angle, true)
+}
@@ -0,0 +1,245 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package path
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+
+	"github.com/usedbytes/mini_mouse/bot/model"
+)
+
+type cell struct {
+	x, y int
+}
+
+type node struct {
+	cell
+	f float64
+	index int
+}
+
+type openSet []*node
+
+func (o openSet) Len() int { return len(o) }
+func (o openSet) Less(i, j int) bool { return o[i].f < o[j].f }
+func (o openSet) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+	o[i].index = i
+	o[j].index = j
+}
+func (o *openSet) Push(x interface{}) {
+	n := x.(*node)
+	n.index = len(*o)
+	*o = append(*o, n)
+}
+func (o *openSet) Pop() interface{} {
+	old := *o
+	n := old[len(old) - 1]
+	*o = old[:len(old) - 1]
+	return n
+}
+
+// Costmap is an occupancy grid with obstacles grown by the robot radius, so
+// that the robot can be planned for as a point.
+type Costmap struct {
+	grid *model.Grid
+	w, h int
+	blocked []bool
+}
+
+func (c *Costmap) Blocked(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.w || y >= c.h {
+		return true
+	}
+	return c.blocked[y * c.w + x]
+}
+
+// Inflate builds a Costmap from g, blocking every cell within 'radius' mm of
+// an occupied cell
+func Inflate(g *model.Grid, radius float32) *Costmap {
+	w, h := g.Size()
+	c := &Costmap{
+		grid: g,
+		w: w,
+		h: h,
+		blocked: make([]bool, w * h),
+	}
+
+	r := int(math.Ceil(float64(radius / g.Resolution())))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !g.Occupied(x, y) {
+				continue
+			}
+
+			for dy := -r; dy <= r; dy++ {
+				for dx := -r; dx <= r; dx++ {
+					if dx * dx + dy * dy > r * r {
+						continue
+					}
+					nx, ny := x + dx, y + dy
+					if nx >= 0 && ny >= 0 && nx < w && ny < h {
+						c.blocked[ny * w + nx] = true
+					}
+				}
+			}
+		}
+	}
+
+	return c
+}
+
+// Octile distance, admissible for 8-connected moves
+func heuristic(a, b cell) float64 {
+	dx := math.Abs(float64(a.x - b.x))
+	dy := math.Abs(float64(a.y - b.y))
+	return (dx + dy) + (math.Sqrt2 - 2) * math.Min(dx, dy)
+}
+
+var neighbours = []struct{
+	dx, dy int
+	cost float64
+}{
+	{ 1, 0, 1 }, { -1, 0, 1 }, { 0, 1, 1 }, { 0, -1, 1 },
+	{ 1, 1, math.Sqrt2 }, { 1, -1, math.Sqrt2 }, { -1, 1, math.Sqrt2 }, { -1, -1, math.Sqrt2 },
+}
+
+// If the robot has ended up inside an inflated obstacle, let it move
+// through other inflated (but not actually occupied) cells to escape.
+func (c *Costmap) passable(from, to cell) bool {
+	if !c.Blocked(to.x, to.y) {
+		return true
+	}
+
+	if !c.grid.InBounds(to.x, to.y) {
+		return false
+	}
+
+	return c.Blocked(from.x, from.y) && !c.grid.Occupied(to.x, to.y)
+}
+
+func (c *Costmap) astar(start, goal cell) ([]cell, error) {
+	if c.Blocked(goal.x, goal.y) {
+		return nil, fmt.Errorf("Goal is blocked")
+	}
+
+	g := map[cell]float64{ start: 0 }
+	from := make(map[cell]cell)
+	closed := make(map[cell]bool)
+
+	open := &openSet{}
+	heap.Push(open, &node{ cell: start, f: heuristic(start, goal) })
+
+	for open.Len() > 0 {
+		n := heap.Pop(open).(*node)
+		if n.cell == goal {
+			path := []cell{ goal }
+			for cur := goal; cur != start; {
+				cur = from[cur]
+				path = append(path, cur)
+			}
+			for i, j := 0, len(path) - 1; i < j; i, j = i + 1, j - 1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path, nil
+		}
+
+		if closed[n.cell] {
+			continue
+		}
+		closed[n.cell] = true
+
+		for _, nb := range neighbours {
+			next := cell{ n.x + nb.dx, n.y + nb.dy }
+			if closed[next] || !c.passable(n.cell, next) {
+				continue
+			}
+			// Don't cut corners
+			if nb.dx != 0 && nb.dy != 0 &&
+			   (!c.passable(n.cell, cell{ n.x + nb.dx, n.y }) ||
+			    !c.passable(n.cell, cell{ n.x, n.y + nb.dy })) {
+				continue
+			}
+
+			cost := g[n.cell] + nb.cost
+			if old, ok := g[next]; ok && cost >= old {
+				continue
+			}
+			g[next] = cost
+			from[next] = n.cell
+			heap.Push(open, &node{ cell: next, f: cost + heuristic(next, goal) })
+		}
+	}
+
+	return nil, fmt.Errorf("No path found")
+}
+
+// Clear reports whether the straight line between a and b is unblocked
+func (c *Costmap) Clear(a, b model.Coord) bool {
+	x0, y0 := c.grid.Cell(a)
+	x1, y1 := c.grid.Cell(b)
+
+	steps := int(math.Max(math.Abs(float64(x1 - x0)), math.Abs(float64(y1 - y0))))
+	if steps == 0 {
+		return !c.Blocked(x0, y0)
+	}
+
+	// Sample at half-cell spacing so that diagonal lines can't slip
+	// between blocked cells
+	steps *= 2
+	for i := 0; i <= steps; i++ {
+		t := float32(i) / float32(steps)
+		p := a.Add(b.Sub(a).Scale(t))
+		x, y := c.grid.Cell(p)
+		if c.Blocked(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// Shortcut any waypoints which can be skipped without hitting anything
+func (c *Costmap) smooth(path []model.Coord) []model.Coord {
+	if len(path) <= 2 {
+		return path
+	}
+
+	ret := []model.Coord{ path[0] }
+	i := 0
+	for i < len(path) - 1 {
+		j := len(path) - 1
+		for j > i + 1 && !c.Clear(path[i], path[j]) {
+			j--
+		}
+		ret = append(ret, path[j])
+		i = j
+	}
+
+	return ret
+}
+
+// Plan finds a collision-free route from start to goal. The returned route
+// doesn't include the start point.
+func (c *Costmap) Plan(start, goal model.Coord) ([]model.Coord, error) {
+	sx, sy := c.grid.Cell(start)
+	gx, gy := c.grid.Cell(goal)
+
+	cells, err := c.astar(cell{ sx, sy }, cell{ gx, gy })
+	if err != nil {
+		return nil, err
+	} else if len(cells) < 2 {
+		return []model.Coord{ goal }, nil
+	}
+
+	path := make([]model.Coord, 0, len(cells))
+	path = append(path, start)
+	for _, cl := range cells[1:len(cells) - 1] {
+		path = append(path, c.grid.Coord(cl.x, cl.y))
+	}
+	path = append(path, goal)
+
+	path = c.smooth(path)
+
+	return path[1:], nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package path
+
+import (
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan/waypoint"
+	"github.com/usedbytes/mini_mouse/bot/vision"
+)
+
+const TaskName = "path"
+
+var logger = logging.New("path")
+
+// Extra clearance around the robot footprint, in mm
+const margin = 10
+
+// Obstacles seen by the camera further away than this (mm) aren't trusted
+const obstacleRange = 400
+
+// Inflating the map is expensive, so only check for map changes this often
+const checkTicks = 30
+
+// Task plans a route to a goal through the model's occupancy map, and
+// follows it with a waypoint.Task. If the map changes such that the rest of
+// the route is blocked, it replans.
+type Task struct {
+	platform *base.Platform
+	model *model.Model
+	follower *waypoint.Task
+
+	goal model.Coord
+	planned bool
+	failed bool
+	mapVersion int
+	ticks int
+}
+
+func (t *Task) radius() float32 {
+	return t.platform.Wheelbase() / 2 + margin
+}
+
+func (t *Task) SetGoal(c model.Coord) {
+	t.goal = c
+	t.planned = false
+	t.failed = false
+}
+
+func (t *Task) Enter() {
+	t.planned = false
+	t.failed = false
+}
+
+func (t *Task) Exit() {
+	t.platform.SetVelocity(0, 0)
+}
+
+func (t *Task) Arrived() bool {
+	return t.planned && t.follower.Arrived()
+}
+
+// Obstacle adds obstacles seen by the camera to the map, so that the route
+// is replanned around them
+func (t *Task) Obstacle(e vision.ObstacleEvent) {
+	for _, o := range e.Obstacles {
+		t.model.AddObstacle(o.Bearing, o.Distance, obstacleRange)
+	}
+}
+
+func (t *Task) replan(cm *Costmap) {
+	pos, _ := t.model.GetPose()
+
+	route, err := cm.Plan(pos, t.goal)
+	if err != nil {
+		if !t.failed {
+			logger.Warn("Planning failed", "err", err)
+		}
+		t.failed = true
+		t.planned = false
+		return
+	}
+
+	t.follower.SetRoute(route)
+	t.planned = true
+	t.failed = false
+}
+
+// Check the part of the route we haven't driven yet against the new map
+func (t *Task) routeClear(cm *Costmap) bool {
+	prev, _ := t.model.GetPose()
+	for _, c := range t.follower.Route() {
+		if !cm.Clear(prev, c) {
+			return false
+		}
+		prev = c
+	}
+	return true
+}
+
+func (t *Task) Tick(buttons input.ButtonState) {
+	grid := t.model.Map()
+	if grid == nil {
+		return
+	}
+
+	t.ticks++
+	changed := grid.Version() != t.mapVersion
+	if (!t.planned && !t.failed) || (t.ticks >= checkTicks && (changed || t.failed)) {
+		t.ticks = 0
+		cm := Inflate(grid, t.radius())
+		if !t.planned || !t.routeClear(cm) {
+			t.replan(cm)
+		}
+		t.mapVersion = grid.Version()
+	}
+
+	if !t.planned {
+		t.platform.SetVelocity(0, 0)
+		return
+	}
+
+	t.follower.Tick(buttons)
+}
+
+func NewTask(m *model.Model, pl *base.Platform, wp *waypoint.Task) *Task {
+	return &Task{
+		platform: pl,
+		model: m,
+		follower: wp,
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package path
+
+import (
+	"math"
+	"testing"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan/waypoint"
+)
+
+// Robot radius used for planning, mm
+const testRadius = 48
+
+// Marks the cells along a straight wall from a to b as occupied
+func wall(g *model.Grid, a, b model.Coord) {
+	d := b.Sub(a)
+	steps := int(math.Hypot(float64(d.X), float64(d.Y)) / float64(g.Resolution())) * 2
+	for i := 0; i <= steps; i++ {
+		g.SetOccupied(a.Add(d.Scale(float32(i) / float32(steps))), true)
+	}
+}
+
+// Distance from c to the nearest occupied cell
+func clearance(g *model.Grid, c model.Coord) float32 {
+	w, h := g.Size()
+	nearest := float32(math.Inf(1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !g.Occupied(x, y) {
+				continue
+			}
+			d := g.Coord(x, y).Sub(c)
+			nearest = float32(math.Min(float64(nearest), math.Hypot(float64(d.X), float64(d.Y))))
+		}
+	}
+	return nearest
+}
+
+func TestPlan(t *testing.T) {
+	tests := []struct{
+		name string
+		walls [][2]model.Coord
+		start, goal model.Coord
+		// Whether there's a way there
+		reachable bool
+		// The fewest waypoints the route can have
+		legs int
+	}{
+		{
+			"Open",
+			nil,
+			model.Coord{ -300, 0 }, model.Coord{ 300, 100 },
+			true, 1,
+		},
+		{
+			"Wall in the way",
+			[][2]model.Coord{ { { 0, -200 }, { 0, 200 } } },
+			model.Coord{ -300, 0 }, model.Coord{ 300, 0 },
+			true, 2,
+		},
+		{
+			// The gap is wider than the wall cells, but narrower than
+			// the robot
+			"Gap too narrow",
+			[][2]model.Coord{ { { 0, -500 }, { 0, -40 } }, { { 0, 40 }, { 0, 500 } } },
+			model.Coord{ -300, 0 }, model.Coord{ 300, 0 },
+			true, 2,
+		},
+		{
+			"Boxed in",
+			[][2]model.Coord{
+				{ { 200, -100 }, { 400, -100 } }, { { 400, -100 }, { 400, 100 } },
+				{ { 400, 100 }, { 200, 100 } }, { { 200, 100 }, { 200, -100 } },
+			},
+			model.Coord{ -300, 0 }, model.Coord{ 300, 0 },
+			false, 0,
+		},
+		{
+			"Goal against a wall",
+			[][2]model.Coord{ { { 300, -200 }, { 300, 200 } } },
+			model.Coord{ -300, 0 }, model.Coord{ 300 - testRadius / 2, 0 },
+			false, 0,
+		},
+	}
+
+	for _, test := range tests {
+		g := model.NewGrid(1200, 1200, 10)
+		for _, w := range test.walls {
+			wall(g, w[0], w[1])
+		}
+		cm := Inflate(g, testRadius)
+
+		route, err := cm.Plan(test.start, test.goal)
+		if !test.reachable {
+			if err == nil {
+				t.Errorf("%s: planned %v, expected no route", test.name, route)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if len(route) < test.legs {
+			t.Errorf("%s: route %v has fewer than %d legs", test.name, route, test.legs)
+		}
+		if route[len(route) - 1] != test.goal {
+			t.Errorf("%s: route ends at %v, expected %v", test.name, route[len(route) - 1], test.goal)
+		}
+
+		prev := test.start
+		for _, c := range route {
+			if !cm.Clear(prev, c) {
+				t.Errorf("%s: leg %v to %v is blocked", test.name, prev, c)
+			}
+			// Cell centres can be half a cell closer than the
+			// inflation radius
+			if d := clearance(g, c); d < testRadius - g.Resolution() {
+				t.Errorf("%s: waypoint %v is only %v mm from an obstacle", test.name, c, d)
+			}
+			prev = c
+		}
+
+		// Smoothing should leave nothing to shortcut
+		for i := 2; i < len(route); i++ {
+			if cm.Clear(route[i - 2], route[i]) {
+				t.Errorf("%s: waypoint %v could be skipped", test.name, route[i - 1])
+			}
+		}
+	}
+}
+
+func TestReplan(t *testing.T) {
+	platform := base.NewPlatformWith(base.Hardware{}, base.Config{})
+	m := model.NewModel(platform, model.Config{ MapWidth: 1200, MapHeight: 1200 })
+	follower := waypoint.NewTask(m, platform)
+	task := NewTask(m, platform, follower)
+
+	goal := model.Coord{ 400, 0 }
+	task.SetGoal(goal)
+	task.Enter()
+	task.Tick(nil)
+
+	if route := follower.Route(); len(route) != 1 || route[0] != goal {
+		t.Fatalf("Planned %v across an empty map, expected straight to %v", route, goal)
+	}
+
+	// Something turns up in the way
+	wall(m.Map(), model.Coord{ 200, -150 }, model.Coord{ 200, 150 })
+	for i := 0; i < checkTicks; i++ {
+		task.Tick(nil)
+	}
+
+	route := follower.Route()
+	if len(route) < 2 || route[len(route) - 1] != goal {
+		t.Fatalf("Replanned %v, expected a way round to %v", route, goal)
+	}
+	cm := Inflate(m.Map(), task.radius())
+	if !task.routeClear(cm) {
+		t.Errorf("Replanned route %v is blocked", route)
+	}
+
+	// Walled in completely, so there's no route and the robot stops
+	wall(m.Map(), model.Coord{ 300, -100 }, model.Coord{ 300, 100 })
+	wall(m.Map(), model.Coord{ 300, 100 }, model.Coord{ 500, 100 })
+	wall(m.Map(), model.Coord{ 500, 100 }, model.Coord{ 500, -100 })
+	wall(m.Map(), model.Coord{ 500, -100 }, model.Coord{ 300, -100 })
+	for i := 0; i < checkTicks; i++ {
+		task.Tick(nil)
+	}
+	if task.planned || !task.failed {
+		t.Errorf("Still following %v to an unreachable goal", follower.Route())
+	}
+}
@@ -3,8 +3,11 @@ package plan
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+	"github.com/usedbytes/mini_mouse/bot/vision"
 )
 
 type Task interface {
@@ -17,13 +20,41 @@ type EnterExitTask interface {
 	Exit()
 }
 
+// Tasks which want to stop for, or steer around, obstacles seen by the
+// camera implement this. Obstacle is called before Tick.
+type ObstacleTask interface {
+	Task
+	Obstacle(e vision.ObstacleEvent)
+}
+
+// The name of the current task
+var taskTopic = telemetry.NewTopic("planner/task", "")
+
 type Planner struct {
 	current Task
+	currentName string
 	tasks map[string]Task
+	obstacles <-chan vision.ObstacleEvent
+}
+
+// Pass on any obstacle events to the current task. They're thrown away if
+// it isn't interested.
+func (p *Planner) handleObstacles() {
+	for {
+		select {
+		case e := <-p.obstacles:
+			if ot, ok := p.current.(ObstacleTask); ok {
+				ot.Obstacle(e)
+			}
+		default:
+			return
+		}
+	}
 }
 
 func (p *Planner) Tick(buttons input.ButtonState) {
 	// TODO: Do things which are irrespective of task
+	p.handleObstacles()
 
 	if p.current == nil {
 		return
@@ -32,6 +63,12 @@ func (p *Planner) Tick(buttons input.ButtonState) {
 	p.current.Tick(buttons)
 }
 
+// SetObstacles sets the stream of obstacle events, e.g. from
+// vision.Obstacles
+func (p *Planner) SetObstacles(events <-chan vision.ObstacleEvent) {
+	p.obstacles = events
+}
+
 func (p *Planner) SetTask(name string) error {
 	if _, ok := p.tasks[name]; !ok {
 		return fmt.Errorf("Unknown task '%s'", name)
@@ -44,6 +81,8 @@ func (p *Planner) SetTask(name string) error {
 	// TODO: Stop current task
 
 	p.current = p.tasks[name]
+	p.currentName = name
+	taskTopic.Publish(name)
 
 	enter, ok := p.current.(EnterExitTask)
 	if ok {
@@ -61,6 +100,21 @@ func (p *Planner) AddTask(name string, task Task) error {
 	return nil
 }
 
+// Current returns the name of the current task, or "" if there isn't one
+func (p *Planner) Current() string {
+	return p.currentName
+}
+
+// Tasks returns the names of all the tasks, sorted
+func (p *Planner) Tasks() []string {
+	names := make([]string, 0, len(p.tasks))
+	for name := range p.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func NewPlanner() *Planner {
 	return &Planner{
 		tasks: make(map[string]Task),
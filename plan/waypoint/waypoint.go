@@ -2,39 +2,80 @@
 package waypoint
 
 import (
-	"log"
 	"math"
+	"time"
 
 	"github.com/usedbytes/mini_mouse/bot/base"
 	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/logging"
 	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan/motion"
+	"github.com/usedbytes/mini_mouse/bot/tunable"
 )
 
 const TaskName = "waypoint"
 
+var (
+	logger = logging.New("waypoint")
+	// Steering is logged every tick
+	steerLogger = logger.Every(250 * time.Millisecond)
+
+	// How close to a waypoint counts as being there, in mm
+	arrivalRadius = tunable.NewFloat("waypoint/arrival_radius", 30, 5, 200)
+	// Turn on the spot until pointing within this many radians of the
+	// waypoint
+	headingTolerance = tunable.NewFloat("waypoint/heading_tolerance", math.Pi / 25, 0.01, math.Pi / 2)
+)
+
 type Task struct {
 	platform *base.Platform
 	model *model.Model
 
-	waypoint model.Coord
+	route []model.Coord
+	idx int
 }
 
 func (t *Task) SetWaypoint(c model.Coord) {
-	t.waypoint = c
+	t.SetRoute([]model.Coord{ c })
+}
+
+// SetRoute sets a list of waypoints to visit in order
+func (t *Task) SetRoute(route []model.Coord) {
+	t.route = route
+	t.idx = 0
+}
+
+// Route returns the waypoints which haven't been reached yet
+func (t *Task) Route() []model.Coord {
+	return t.route[t.idx:]
+}
+
+func (t *Task) Arrived() bool {
+	return t.idx >= len(t.route)
 }
 
 func (t *Task) Tick(buttons input.ButtonState) {
+	if t.Arrived() {
+		t.platform.SetVelocity(0, 0)
+		return
+	}
+
 	pos, theta := t.model.GetPose()
+	waypoint := t.route[t.idx]
 
-	dPos := t.waypoint.Sub(pos)
+	dPos := waypoint.Sub(pos)
 	heading := float32(math.Atan2(float64(dPos.Y), float64(dPos.X)))
-	dTheta := heading - theta
+	// The short way round
+	dTheta := motion.WrapAngle(heading - theta)
 	hypot := math.Hypot(float64(dPos.X), float64(dPos.Y))
-	if hypot <= 30 {
-		log.Printf("Arrived\n")
-		t.platform.SetVelocity(0, 0)
+	if hypot <= arrivalRadius.Float() {
+		t.idx++
+		if t.Arrived() {
+			logger.Info("Arrived", "waypoints", len(t.route))
+			t.platform.SetVelocity(0, 0)
+		}
 		return
-	} else if math.Abs(float64(dTheta)) > (math.Pi / 25)  {
+	} else if math.Abs(float64(dTheta)) > headingTolerance.Float() {
 		// Rotate
 		//w := math.Max(math.Pi / 16, math.Min(math.Abs(float64(dTheta)), math.Pi / 2))
 		w := 1.0
@@ -49,7 +90,8 @@ func (t *Task) Tick(buttons input.ButtonState) {
 		t.platform.SetVelocity(float32(v), float32(v))
 	}
 
-	log.Printf("dPos: %v, heading: %v dtheta: %v\n", dPos, heading * 180 / math.Pi, dTheta * 180 / math.Pi)
+	steerLogger.Debug("Steering", "dx", dPos.X, "dy", dPos.Y,
+		"heading_deg", heading * 180 / math.Pi, "error_deg", dTheta * 180 / math.Pi)
 }
 
 func NewTask(m *model.Model, pl *base.Platform) *Task {
@@ -0,0 +1,342 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+)
+
+// A log file starts with this, then has records until the end:
+//
+//	u8 kind
+//	varint time, ns since the previous record in the file (the first is
+//	       since the Unix epoch)
+//	uvarint payload length, payload
+//
+// Payloads are little-endian, laid out as described by the Kind constants.
+// Each file stands alone, so the oldest can be deleted.
+const magic = "MMREC\x00\x01\n"
+
+type Kind uint8
+const (
+	// u32 tick number. Starts each main loop tick, so everything until the
+	// next Tick happened during it. The record time is what base.Platform
+	// gave as the time for the tick.
+	KindTick Kind = iota
+	// Datalink packets sent and received by dev.Dev. u16 count, then for
+	// each: u8 endpoint, u16 length, data.
+	KindSent
+	KindReceived
+	// The IMU's euler vector, f64 each
+	KindIMU
+	// u16 width, u16 height, pixels. The record time is the frame's time.
+	KindFrame
+	// u16 width, u16 height, u8 image.YCbCrSubsampleRatio, then the Y, Cb
+	// and Cr planes
+	KindColourFrame
+	// Gamepad state read in the tick: f32 left stick, f32 right stick,
+	// u8 count, then u8 button, u8 input.State flags for each
+	KindInput
+	// The planner's current task name, when it changes
+	KindTask
+	// The model's pose at the end of the tick: f32 x, f32 y, f32 heading
+	KindPose
+	// u32 count of records which were lost just before this one, because
+	// they couldn't be written fast enough. They may include Ticks, so
+	// the tick this lands in can have more than one tick's records in it.
+	KindDropped
+)
+
+func (k Kind) String() string {
+	names := [...]string{ "tick", "sent", "received", "imu", "frame", "colour", "input", "task", "pose", "dropped" }
+	if int(k) < len(names) {
+		return names[k]
+	}
+	return fmt.Sprintf("kind(%d)", uint8(k))
+}
+
+type Record struct {
+	Kind Kind
+	Time time.Time
+	Data []byte
+}
+
+func encodeRecord(w *bytes.Buffer, kind Kind, delta int64, payload []byte) {
+	var tmp [binary.MaxVarintLen64]byte
+	w.WriteByte(byte(kind))
+	w.Write(tmp[:binary.PutVarint(tmp[:], delta)])
+	w.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(payload)))])
+	w.Write(payload)
+}
+
+func encodePackets(pkts []datalink.Packet) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint16(len(pkts)))
+	for _, p := range pkts {
+		buf.WriteByte(p.Endpoint)
+		binary.Write(buf, binary.LittleEndian, uint16(len(p.Data)))
+		buf.Write(p.Data)
+	}
+	return buf.Bytes()
+}
+
+func encodeGray(img *image.Gray) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	buf := bytes.NewBuffer(make([]byte, 0, 4 + w * h))
+	binary.Write(buf, binary.LittleEndian, []uint16{ uint16(w), uint16(h) })
+	for y := 0; y < h; y++ {
+		off := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y + y)
+		buf.Write(img.Pix[off : off + w])
+	}
+	return buf.Bytes()
+}
+
+func encodeYCbCr(img *image.YCbCr) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, []uint16{ uint16(w), uint16(h) })
+	buf.WriteByte(byte(img.SubsampleRatio))
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		off := img.YOffset(b.Min.X, y)
+		buf.Write(img.Y[off : off + w])
+	}
+
+	// Chroma planes, at whatever size the ratio makes them
+	cw, ch := chromaSize(w, h, img.SubsampleRatio)
+	for _, plane := range [][]byte{ img.Cb, img.Cr } {
+		for y := 0; y < ch; y++ {
+			off := img.COffset(b.Min.X, b.Min.Y) + y * img.CStride
+			buf.Write(plane[off : off + cw])
+		}
+	}
+	return buf.Bytes()
+}
+
+// Size of the chroma planes of a w x h image, as image.NewYCbCr makes them
+func chromaSize(w, h int, ratio image.YCbCrSubsampleRatio) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return (w + 1) / 2, h
+	case image.YCbCrSubsampleRatio420:
+		return (w + 1) / 2, (h + 1) / 2
+	case image.YCbCrSubsampleRatio440:
+		return w, (h + 1) / 2
+	case image.YCbCrSubsampleRatio411:
+		return (w + 3) / 4, h
+	case image.YCbCrSubsampleRatio410:
+		return (w + 3) / 4, (h + 1) / 2
+	}
+	return w, h
+}
+
+func encodeInput(left, right float32, buttons input.ButtonState) []byte {
+	keys := make([]int, 0, len(buttons))
+	for b, s := range buttons {
+		if s != input.None {
+			keys = append(keys, int(b))
+		}
+	}
+	sort.Ints(keys)
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, []float32{ left, right })
+	buf.WriteByte(byte(len(keys)))
+	for _, k := range keys {
+		buf.WriteByte(byte(k))
+		buf.WriteByte(byte(buttons[input.Button(k)]))
+	}
+	return buf.Bytes()
+}
+
+func encodeFloats(vec []float64) []byte {
+	buf := make([]byte, 8 * len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint64(buf[i * 8:], math.Float64bits(v))
+	}
+	return buf
+}
+
+var errShort = fmt.Errorf("Record too short")
+
+// Tick returns the tick number of a KindTick record
+func (r Record) Tick() (uint32, error) {
+	if len(r.Data) < 4 {
+		return 0, errShort
+	}
+	return binary.LittleEndian.Uint32(r.Data), nil
+}
+
+// Packets decodes a KindSent or KindReceived record
+func (r Record) Packets() ([]datalink.Packet, error) {
+	d := r.Data
+	if len(d) < 2 {
+		return nil, errShort
+	}
+	n := int(binary.LittleEndian.Uint16(d))
+	d = d[2:]
+
+	pkts := make([]datalink.Packet, 0, n)
+	for i := 0; i < n; i++ {
+		if len(d) < 3 {
+			return nil, errShort
+		}
+		ep, l := d[0], int(binary.LittleEndian.Uint16(d[1:]))
+		d = d[3:]
+		if len(d) < l {
+			return nil, errShort
+		}
+		pkts = append(pkts, datalink.Packet{ Endpoint: ep, Data: d[:l:l] })
+		d = d[l:]
+	}
+	return pkts, nil
+}
+
+// IMU decodes a KindIMU record
+func (r Record) IMU() ([]float64, error) {
+	if len(r.Data) % 8 != 0 {
+		return nil, errShort
+	}
+	vec := make([]float64, len(r.Data) / 8)
+	for i := range vec {
+		vec[i] = math.Float64frombits(binary.LittleEndian.Uint64(r.Data[i * 8:]))
+	}
+	return vec, nil
+}
+
+// Frame decodes a KindFrame record
+func (r Record) Frame() (*image.Gray, error) {
+	if len(r.Data) < 4 {
+		return nil, errShort
+	}
+	w, h := int(binary.LittleEndian.Uint16(r.Data)), int(binary.LittleEndian.Uint16(r.Data[2:]))
+	if len(r.Data) < 4 + w * h {
+		return nil, errShort
+	}
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	copy(img.Pix, r.Data[4:])
+	return img, nil
+}
+
+// ColourFrame decodes a KindColourFrame record
+func (r Record) ColourFrame() (*image.YCbCr, error) {
+	if len(r.Data) < 5 {
+		return nil, errShort
+	}
+	w, h := int(binary.LittleEndian.Uint16(r.Data)), int(binary.LittleEndian.Uint16(r.Data[2:]))
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio(r.Data[4]))
+
+	d := r.Data[5:]
+	for _, plane := range [][]byte{ img.Y, img.Cb, img.Cr } {
+		if len(d) < len(plane) {
+			return nil, errShort
+		}
+		copy(plane, d)
+		d = d[len(plane):]
+	}
+	return img, nil
+}
+
+// Input decodes a KindInput record
+func (r Record) Input() (float32, float32, input.ButtonState, error) {
+	d := r.Data
+	if len(d) < 9 {
+		return 0, 0, nil, errShort
+	}
+	left := math.Float32frombits(binary.LittleEndian.Uint32(d))
+	right := math.Float32frombits(binary.LittleEndian.Uint32(d[4:]))
+	n := int(d[8])
+	d = d[9:]
+	if len(d) < 2 * n {
+		return 0, 0, nil, errShort
+	}
+
+	buttons := make(input.ButtonState)
+	for i := 0; i < n; i++ {
+		buttons[input.Button(d[2 * i])] = input.State(d[2 * i + 1])
+	}
+	return left, right, buttons, nil
+}
+
+// Task decodes a KindTask record
+func (r Record) Task() string {
+	return string(r.Data)
+}
+
+// Pose decodes a KindPose record
+func (r Record) Pose() (float32, float32, float32, error) {
+	if len(r.Data) < 12 {
+		return 0, 0, 0, errShort
+	}
+	var v [3]float32
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(r.Data[i * 4:]))
+	}
+	return v[0], v[1], v[2], nil
+}
+
+// Dropped decodes a KindDropped record
+func (r Record) Dropped() (uint32, error) {
+	if len(r.Data) < 4 {
+		return 0, errShort
+	}
+	return binary.LittleEndian.Uint32(r.Data), nil
+}
+
+// Reader reads the records from one log file
+type Reader struct {
+	r *bufio.Reader
+	last int64
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, fmt.Errorf("Reading header: %v", err)
+	}
+	if string(head) != magic {
+		return nil, fmt.Errorf("Not a recording")
+	}
+
+	return &Reader{ r: br }, nil
+}
+
+// Next returns the next record, or io.EOF at the end. A record cut short,
+// e.g. by a crash, is io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Record, error) {
+	kind, err := r.r.ReadByte()
+	if err != nil {
+		return Record{}, err
+	}
+
+	delta, err := binary.ReadVarint(r.r)
+	if err != nil {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+	l, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+
+	r.last += delta
+	return Record{ Kind(kind), time.Unix(0, r.last), data }, nil
+}
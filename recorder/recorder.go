@@ -0,0 +1,469 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+)
+
+const (
+	// Records waiting to be written. If the disk can't keep up, more than
+	// this are dropped rather than holding up the main loop.
+	queueLen = 512
+	// How often buffered records are written out
+	flushPeriod = 500 * time.Millisecond
+	fileExt = ".mmrec"
+	// Files are named <run ID>-<sequence number><fileExt>, where the ID is
+	// the time the Recorder was made in this format
+	runFormat = "20060102-150405.000"
+)
+
+var logger = logging.New("recorder")
+
+type entry struct {
+	kind Kind
+	time time.Time
+	data []byte
+}
+
+// Recorder writes everything the robot sees and does to log files in a
+// directory, for working out what went wrong afterwards.
+//
+// Files are rotated when they reach a size limit, and the oldest are
+// deleted to keep the whole directory under another. Recording is done on its own
+// goroutine, so the methods don't block on the disk. Records are written
+// out every flushPeriod, so that's about how much is lost if the program is
+// killed.
+//
+// A nil *Recorder records nothing, so callers needn't check for one.
+type Recorder struct {
+	dir string
+	maxFile, maxTotal int64
+	runID string
+
+	entries chan entry
+	done sync.WaitGroup
+	dropped uint64
+	// Dropped since the last KindDropped record was queued
+	pending uint64
+	// Held for reading while adding an entry, so Close can't close
+	// 'entries' under it
+	lock sync.RWMutex
+	closed bool
+
+	// Only touched by the main loop
+	tick uint32
+	task string
+
+	// Only touched by the writer
+	file *os.File
+	w *bufio.Writer
+	size int64
+	last int64
+	seq int
+}
+
+func (r *Recorder) add(kind Kind, t time.Time, data []byte) {
+	if r == nil {
+		return
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.closed {
+		return
+	}
+
+	// Mark the gap left by anything dropped, so replays know to skip it
+	if n := atomic.SwapUint64(&r.pending, 0); n > 0 {
+		marker := make([]byte, 4)
+		binary.LittleEndian.PutUint32(marker, uint32(n))
+		select {
+		case r.entries <- entry{ KindDropped, t, marker }:
+		default:
+			// Still no room, so this one's lost too
+			atomic.AddUint64(&r.pending, n + 1)
+			atomic.AddUint64(&r.dropped, 1)
+			return
+		}
+	}
+
+	select {
+	case r.entries <- entry{ kind, t, data }:
+	default:
+		atomic.AddUint64(&r.pending, 1)
+		atomic.AddUint64(&r.dropped, 1)
+	}
+}
+
+// Dropped returns how many records were thrown away because they couldn't
+// be written fast enough
+func (r *Recorder) Dropped() uint64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Tick marks the start of a main loop tick, at time 't'
+func (r *Recorder) Tick(t time.Time) {
+	if r == nil {
+		return
+	}
+	r.tick++
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, r.tick)
+	r.add(KindTick, t, data)
+}
+
+func (r *Recorder) IMU(vec []float64) {
+	if r == nil || vec == nil {
+		return
+	}
+	r.add(KindIMU, time.Now(), encodeFloats(vec))
+}
+
+// Frame records a camera frame, taken at 't'
+func (r *Recorder) Frame(img *image.Gray, t time.Time) {
+	if r == nil {
+		return
+	}
+	r.add(KindFrame, t, encodeGray(img))
+}
+
+// ColourFrame records a camera frame in colour, taken at 't'
+func (r *Recorder) ColourFrame(img *image.YCbCr, t time.Time) {
+	if r == nil {
+		return
+	}
+	r.add(KindColourFrame, t, encodeYCbCr(img))
+}
+
+// Input records the gamepad state the planner was given
+func (r *Recorder) Input(left, right float32, buttons input.ButtonState) {
+	if r == nil {
+		return
+	}
+	r.add(KindInput, time.Now(), encodeInput(left, right, buttons))
+}
+
+// Task records the planner's current task, if it's changed
+func (r *Recorder) Task(name string) {
+	if r == nil || name == r.task {
+		return
+	}
+	r.task = name
+	r.add(KindTask, time.Now(), []byte(name))
+}
+
+// Pose records where the model thinks the robot is
+func (r *Recorder) Pose(x, y, heading float32) {
+	if r == nil {
+		return
+	}
+	data := make([]byte, 12)
+	for i, v := range []float32{ x, y, heading } {
+		binary.LittleEndian.PutUint32(data[i * 4:], math.Float32bits(v))
+	}
+	r.add(KindPose, time.Now(), data)
+}
+
+type transactor struct {
+	rec *Recorder
+	t datalink.Transactor
+}
+
+func (t *transactor) Transact(sent []datalink.Packet) ([]datalink.Packet, error) {
+	if len(sent) > 0 {
+		t.rec.add(KindSent, time.Now(), encodePackets(sent))
+	}
+	received, err := t.t.Transact(sent)
+	if len(received) > 0 {
+		t.rec.add(KindReceived, time.Now(), encodePackets(received))
+	}
+	return received, err
+}
+
+// Transactor wraps 't' so that the packets going through it are recorded
+func (r *Recorder) Transactor(t datalink.Transactor) datalink.Transactor {
+	if r == nil {
+		return t
+	}
+	return &transactor{ r, t }
+}
+
+func (r *Recorder) files() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(r.dir, "*" + fileExt))
+	if err != nil {
+		return nil, err
+	}
+	// Names start with the run's start time, then the sequence number, so
+	// this is oldest first
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// Delete the oldest files until there's room for a new one
+func (r *Recorder) prune() {
+	files, err := r.files()
+	if err != nil {
+		logger.Error("Listing old recordings", "err", err)
+		return
+	}
+
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+
+	for i := 0; i < len(files) && total + r.maxFile > r.maxTotal; i++ {
+		if err := os.Remove(files[i]); err != nil {
+			logger.Error("Deleting old recording", "err", err)
+			continue
+		}
+		total -= sizes[i]
+	}
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.w.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	return err
+}
+
+func (r *Recorder) rotate() error {
+	if err := r.closeFile(); err != nil {
+		logger.Error("Writing recording", "err", err)
+	}
+	r.prune()
+
+	r.seq++
+	name := fmt.Sprintf("%s-%04d%s", r.runID, r.seq, fileExt)
+	f, err := os.Create(filepath.Join(r.dir, name))
+	if err != nil {
+		return err
+	}
+
+	r.file = f
+	r.w = bufio.NewWriterSize(f, 64 * 1024)
+	r.last = 0
+	n, err := r.w.WriteString(magic)
+	r.size = int64(n)
+	return err
+}
+
+func (r *Recorder) write(e entry, buf *bytes.Buffer) error {
+	if r.file == nil || r.size >= r.maxFile {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	t := e.time.UnixNano()
+	buf.Reset()
+	encodeRecord(buf, e.kind, t - r.last, e.data)
+	r.last = t
+
+	n, err := r.w.Write(buf.Bytes())
+	r.size += int64(n)
+	return err
+}
+
+func (r *Recorder) run() {
+	defer r.done.Done()
+
+	flush := time.NewTicker(flushPeriod)
+	defer flush.Stop()
+
+	buf := &bytes.Buffer{}
+	var failed bool
+	for {
+		select {
+		case e, ok := <-r.entries:
+			if !ok {
+				if err := r.closeFile(); err != nil {
+					logger.Error("Writing recording", "err", err)
+				}
+				return
+			}
+
+			err := r.write(e, buf)
+			if err != nil && !failed {
+				logger.Error("Writing recording", "err", err)
+			}
+			// Only complain once until it works again
+			failed = err != nil
+		case <-flush.C:
+			if r.file != nil {
+				if err := r.w.Flush(); err != nil {
+					logger.Error("Writing recording", "err", err)
+				}
+			}
+		}
+	}
+}
+
+// Close writes out anything outstanding, and stops recording. Anything
+// recorded after it's called is ignored. It may be called more than once,
+// from any goroutine.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.entries)
+	r.lock.Unlock()
+
+	r.done.Wait()
+
+	if d := r.Dropped(); d > 0 {
+		logger.Warn("Dropped records", "count", d)
+	}
+	return nil
+}
+
+// Run is the recording files from one run of the robot
+type Run struct {
+	ID string
+	// Oldest first
+	Files []string
+	// False if the oldest files have been deleted, e.g. to make room
+	Complete bool
+}
+
+// parseName splits a recording file's name into its run ID and sequence
+// number
+func parseName(path string) (string, int, bool) {
+	name := strings.TrimSuffix(filepath.Base(path), fileExt)
+	i := strings.LastIndexByte(name, '-')
+	if i < 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(name[i + 1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:i], seq, true
+}
+
+// Runs lists the runs recorded in 'dir', oldest first
+func Runs(dir string) ([]Run, error) {
+	r := &Recorder{ dir: dir }
+	files, err := r.files()
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []Run
+	for _, f := range files {
+		id, seq, ok := parseName(f)
+		if !ok {
+			logger.Warn("Ignoring badly named recording", "file", f)
+			continue
+		}
+
+		if len(runs) == 0 || runs[len(runs) - 1].ID != id {
+			runs = append(runs, Run{ ID: id, Complete: seq == 1 })
+		}
+		runs[len(runs) - 1].Files = append(runs[len(runs) - 1].Files, f)
+	}
+	return runs, nil
+}
+
+// Recordings returns the files recorded in 'dir' by run 'id', oldest first,
+// or by the latest run if 'id' is "". It's an error if the start of the run
+// has been deleted, as the rest can't be replayed without it.
+func Recordings(dir, id string) ([]string, error) {
+	runs, err := Runs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("No recordings in %s", dir)
+	}
+
+	run := runs[len(runs) - 1]
+	if id != "" {
+		found := false
+		for _, r := range runs {
+			if r.ID == id {
+				run, found = r, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No run '%s' in %s", id, dir)
+		}
+	}
+
+	if !run.Complete {
+		return nil, fmt.Errorf("The start of run '%s' has been deleted", run.ID)
+	}
+	return run.Files, nil
+}
+
+// IsRunStart returns whether 'path' is the first file of its run
+func IsRunStart(path string) bool {
+	_, seq, ok := parseName(path)
+	return ok && seq == 1
+}
+
+// NewRecorder starts recording a run into 'dir', which is created if need
+// be. All the run's files share an ID, its start time, see Runs.
+// Each file is limited to about 'maxFile' bytes, and the whole directory to
+// 'maxTotal'.
+func NewRecorder(dir string, maxFile, maxTotal int64) (*Recorder, error) {
+	if maxFile <= 0 || maxTotal < maxFile {
+		return nil, fmt.Errorf("Recording limits must be positive, with the total at least the file size")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		dir: dir,
+		maxFile: maxFile,
+		maxTotal: maxTotal,
+		runID: time.Now().Format(runFormat),
+		entries: make(chan entry, queueLen),
+	}
+
+	r.done.Add(1)
+	go r.run()
+
+	return r, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package recorder
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Records 'ticks' ticks, in files of about 'maxFile' bytes
+func recordRun(t *testing.T, dir string, ticks int, maxFile int64) {
+	t.Helper()
+
+	r, err := NewRecorder(dir, maxFile, 1 << 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < ticks; i++ {
+		r.Tick(time.Now())
+		r.Task("task")
+		r.Pose(1, 2, 3)
+		// Don't fill the queue
+		time.Sleep(100 * time.Microsecond)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRuns(t *testing.T) {
+	dir := t.TempDir()
+	recordRun(t, dir, 100, 256)
+	// Make sure the IDs differ
+	time.Sleep(10 * time.Millisecond)
+	recordRun(t, dir, 100, 256)
+
+	runs, err := Runs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("Found %d runs, expected 2", len(runs))
+	}
+	for _, r := range runs {
+		if len(r.Files) < 2 || !r.Complete {
+			t.Errorf("Run %s: %d files, complete %v. Expected a complete run split over several files", r.ID, len(r.Files), r.Complete)
+		}
+	}
+
+	files, err := Recordings(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(runs[1].Files) || files[0] != runs[1].Files[0] {
+		t.Errorf("Latest run is %v, expected %v", files, runs[1].Files)
+	}
+	if !IsRunStart(files[0]) || IsRunStart(files[1]) {
+		t.Errorf("%s should start the run and %s shouldn't", files[0], files[1])
+	}
+
+	// Lose the start of the first run
+	if err := os.Remove(runs[0].Files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Recordings(dir, runs[0].ID); err == nil {
+		t.Errorf("Run %s can be replayed without its first file", runs[0].ID)
+	}
+	if _, err := Recordings(dir, runs[1].ID); err != nil {
+		t.Errorf("Run %s: %v", runs[1].ID, err)
+	}
+	if _, err := Recordings(dir, "nonsense"); err == nil {
+		t.Errorf("Found a run which doesn't exist")
+	}
+}
+
+func TestDroppedMarker(t *testing.T) {
+	// Nothing writing, so the queue fills up
+	r := &Recorder{ entries: make(chan entry, 2) }
+	for i := 0; i < 5; i++ {
+		r.Tick(time.Now())
+	}
+	if d := r.Dropped(); d != 3 {
+		t.Fatalf("Dropped %d records, expected 3", d)
+	}
+
+	drain := func() []entry {
+		var entries []entry
+		for len(r.entries) > 0 {
+			entries = append(entries, <-r.entries)
+		}
+		return entries
+	}
+	drain()
+
+	// The next record to make it says how many were lost before it
+	r.Task("task")
+	entries := drain()
+	if len(entries) != 2 || entries[0].kind != KindDropped || entries[1].kind != KindTask {
+		t.Fatalf("Queued %v, expected a dropped marker then the task", entries)
+	}
+	if n, err := (Record{ Kind: KindDropped, Data: entries[0].data }).Dropped(); err != nil || n != 3 {
+		t.Errorf("Marker says %d dropped (%v), expected 3", n, err)
+	}
+
+	r.Tick(time.Now())
+	if entries := drain(); len(entries) != 1 || entries[0].kind != KindTick {
+		t.Errorf("Queued %v, expected only a tick", entries)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/recorder"
+	"github.com/usedbytes/mini_mouse/bot/replay"
+)
+
+// runReplay re-runs a recorded run through the same code as the robot, and
+// reports where it sent different commands. It returns the exit status.
+//
+// For the results to match, the recording must start at the beginning of a
+// run, and use the same tunables, calibration, map and arena. Vision runs
+// synchronously, and commands from the control API aren't recorded, so runs
+// which depended on those can differ.
+//
+// 'path' is the first file of a run, or a directory to replay run 'run' from
+// (the latest if it's "").
+func runReplay(path, run string, arena *model.Arena, cfg base.Config, mcfg model.Config, tunablesFile string, maxDiffs int) int {
+	paths := []string{ path }
+	if fi, err := os.Stat(path); err != nil {
+		logger.Error("Finding recordings", "err", err)
+		return 2
+	} else if fi.IsDir() {
+		paths, err = recorder.Recordings(path, run)
+		if err != nil {
+			logger.Error("Finding recordings", "err", err)
+			return 2
+		}
+	} else if !recorder.IsRunStart(path) {
+		logger.Error("Recording isn't the start of a run", "file", path)
+		return 2
+	}
+
+	rp := replay.NewReplay(paths)
+	defer rp.Close()
+
+	ip := input.NewDetachedCollector()
+	platform := base.NewPlatformWith(rp.Hardware(), cfg)
+	bot := newRobot(platform, ip, &Telem{}, arena, mcfg, true)
+	loadTunables(tunablesFile, false)
+
+	ticks := 0
+	for {
+		t, err := rp.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logger.Error("Reading recording", "err", err)
+			return 2
+		}
+
+		if t.HasInput {
+			ip.Feed(t.Left, t.Right, t.Buttons)
+		}
+		bot.tick()
+		rp.CheckTask(bot.planner.Current())
+		ticks++
+	}
+
+	diffs := rp.Diffs()
+	for i, d := range diffs {
+		if i >= maxDiffs {
+			fmt.Printf("... and %d more\n", len(diffs) - maxDiffs)
+			break
+		}
+		fmt.Println(d)
+	}
+	fmt.Printf("Replayed %d ticks, %d differences\n", ticks, len(diffs))
+
+	if len(diffs) > 0 {
+		return 1
+	}
+	return 0
+}
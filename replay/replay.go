@@ -0,0 +1,337 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/recorder"
+)
+
+var logger = logging.New("replay")
+
+// Tick is everything recorded during one main loop tick
+type Tick struct {
+	N uint32
+	Time time.Time
+
+	Sent, Received []datalink.Packet
+	IMU []float64
+
+	Frame *image.Gray
+	Colour *image.YCbCr
+	FrameTime time.Time
+
+	HasInput bool
+	Left, Right float32
+	Buttons input.ButtonState
+
+	// The planner's task at the end of the tick, if it changed
+	Task string
+
+	HasPose bool
+	X, Y, Heading float32
+
+	// How many records were lost from the recording. Some of this tick,
+	// or even the whole of the next one, may be missing.
+	Dropped int
+}
+
+func (t *Tick) add(r recorder.Record) error {
+	var err error
+	switch r.Kind {
+	case recorder.KindSent:
+		var pkts []datalink.Packet
+		pkts, err = r.Packets()
+		t.Sent = append(t.Sent, pkts...)
+	case recorder.KindReceived:
+		var pkts []datalink.Packet
+		pkts, err = r.Packets()
+		t.Received = append(t.Received, pkts...)
+	case recorder.KindIMU:
+		t.IMU, err = r.IMU()
+	case recorder.KindFrame:
+		t.Frame, err = r.Frame()
+		t.FrameTime = r.Time
+	case recorder.KindColourFrame:
+		t.Colour, err = r.ColourFrame()
+	case recorder.KindInput:
+		t.Left, t.Right, t.Buttons, err = r.Input()
+		t.HasInput = err == nil
+	case recorder.KindTask:
+		t.Task = r.Task()
+	case recorder.KindPose:
+		t.X, t.Y, t.Heading, err = r.Pose()
+		t.HasPose = err == nil
+	case recorder.KindDropped:
+		var n uint32
+		n, err = r.Dropped()
+		t.Dropped += int(n)
+	}
+	return err
+}
+
+// Reader reads ticks from a list of recording files, in order
+type Reader struct {
+	paths []string
+	file *os.File
+	r *recorder.Reader
+	// The first record of the next tick, if it's been read
+	next *recorder.Record
+}
+
+func (r *Reader) record() (recorder.Record, error) {
+	for {
+		if r.r == nil {
+			if len(r.paths) == 0 {
+				return recorder.Record{}, io.EOF
+			}
+
+			f, err := os.Open(r.paths[0])
+			if err != nil {
+				return recorder.Record{}, err
+			}
+			rr, err := recorder.NewReader(f)
+			if err != nil {
+				f.Close()
+				return recorder.Record{}, fmt.Errorf("%s: %v", r.paths[0], err)
+			}
+			r.file, r.r = f, rr
+		}
+
+		rec, err := r.r.Next()
+		if err == nil {
+			return rec, nil
+		}
+
+		// A file cut short (e.g. by a crash) is expected, the rest of
+		// it is just lost
+		if err == io.ErrUnexpectedEOF {
+			logger.Warn("Truncated recording", "file", r.paths[0])
+		} else if err != io.EOF {
+			return recorder.Record{}, err
+		}
+
+		r.file.Close()
+		r.file, r.r = nil, nil
+		r.paths = r.paths[1:]
+	}
+}
+
+// Next returns the next tick, or io.EOF after the last
+func (r *Reader) Next() (*Tick, error) {
+	// Skip anything before the first tick
+	for r.next == nil {
+		rec, err := r.record()
+		if err != nil {
+			return nil, err
+		}
+		if rec.Kind == recorder.KindTick {
+			r.next = &rec
+		}
+	}
+
+	n, err := r.next.Tick()
+	if err != nil {
+		return nil, err
+	}
+	t := &Tick{ N: n, Time: r.next.Time }
+	r.next = nil
+
+	for {
+		rec, err := r.record()
+		if err == io.EOF {
+			return t, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if rec.Kind == recorder.KindTick {
+			r.next = &rec
+			return t, nil
+		}
+
+		if err := t.add(rec); err != nil {
+			return nil, fmt.Errorf("Tick %d: %v: %v", t.N, rec.Kind, err)
+		}
+	}
+}
+
+func (r *Reader) Close() error {
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
+
+// NewReader reads 'paths', which must be from the same run, oldest first
+// (see recorder.Recordings)
+func NewReader(paths []string) *Reader {
+	return &Reader{ paths: paths }
+}
+
+// Diff is a tick where something different was done on replay
+type Diff struct {
+	Tick uint32
+	Time time.Time
+	What string
+	Recorded, Replayed string
+}
+
+func (d Diff) String() string {
+	return fmt.Sprintf("tick %d (%s): %s\n\trecorded: %s\n\treplayed: %s",
+		d.Tick, d.Time.Format("15:04:05.000"), d.What, d.Recorded, d.Replayed)
+}
+
+func formatPackets(pkts []datalink.Packet) string {
+	if len(pkts) == 0 {
+		return "nothing"
+	}
+
+	s := make([]string, len(pkts))
+	for i, p := range pkts {
+		s[i] = fmt.Sprintf("ep %d: % x", p.Endpoint, p.Data)
+	}
+	return strings.Join(s, ", ")
+}
+
+func samePackets(a, b []datalink.Packet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Endpoint != b[i].Endpoint || !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
+
+// Replay stands in for the robot's hardware, giving a base.Platform the data
+// from a recording one tick at a time. What the Platform sends is compared
+// with what was recorded.
+type Replay struct {
+	reader *Reader
+	tick *Tick
+	transacted bool
+	cameraEnabled bool
+	frameTaken bool
+
+	diffs []Diff
+}
+
+// Next moves on to the next tick, or returns io.EOF at the end
+func (r *Replay) Next() (*Tick, error) {
+	t, err := r.reader.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	r.tick = t
+	r.transacted = false
+	r.frameTaken = false
+	if t.Dropped > 0 {
+		logger.Warn("Records missing from the recording, not comparing", "tick", t.N, "dropped", t.Dropped)
+	}
+	return t, nil
+}
+
+func (r *Replay) diff(what, recorded, replayed string) {
+	// What was recorded isn't all of what happened
+	if r.tick.Dropped > 0 {
+		return
+	}
+	r.diffs = append(r.diffs, Diff{ r.tick.N, r.tick.Time, what, recorded, replayed })
+}
+
+// CheckTask compares the task which was running at the end of the tick
+// with 'current'
+func (r *Replay) CheckTask(current string) {
+	if r.tick.Task != "" && r.tick.Task != current {
+		r.diff("task", r.tick.Task, current)
+	}
+}
+
+// Diffs returns all the differences found so far
+func (r *Replay) Diffs() []Diff {
+	return r.diffs
+}
+
+func (r *Replay) Transact(sent []datalink.Packet) ([]datalink.Packet, error) {
+	if r.transacted {
+		// Only one exchange is recorded per tick
+		r.diff("sent", "nothing", formatPackets(sent))
+		return nil, nil
+	}
+	r.transacted = true
+
+	if !samePackets(sent, r.tick.Sent) {
+		r.diff("sent", formatPackets(r.tick.Sent), formatPackets(sent))
+	}
+	return r.tick.Received, nil
+}
+
+type camera Replay
+
+func (c *camera) Enable() {
+	c.cameraEnabled = true
+}
+
+func (c *camera) Disable() {
+	c.cameraEnabled = false
+}
+
+func (c *camera) Enabled() bool {
+	return c.cameraEnabled
+}
+
+func (c *camera) Frame() (*image.Gray, *image.YCbCr, time.Time) {
+	if !c.cameraEnabled || c.frameTaken || c.tick.Frame == nil {
+		return nil, nil, time.Time{}
+	}
+	c.frameTaken = true
+	return c.tick.Frame, c.tick.Colour, c.tick.FrameTime
+}
+
+type imu Replay
+
+func (i *imu) Euler() ([]float64, error) {
+	return i.tick.IMU, nil
+}
+
+// Hardware returns the hardware for a base.Platform to replay the recording
+// with. Its clock is the time each tick started.
+func (r *Replay) Hardware() base.Hardware {
+	return base.Hardware{
+		Transactor: r,
+		Camera: (*camera)(r),
+		IMU: (*imu)(r),
+		Clock: func() time.Time {
+			if r.tick == nil {
+				return time.Time{}
+			}
+			return r.tick.Time
+		},
+	}
+}
+
+func (r *Replay) Close() error {
+	return r.reader.Close()
+}
+
+// NewReplay replays the recording in 'paths', oldest first. Call Next before
+// using the Hardware.
+func NewReplay(paths []string) *Replay {
+	return &Replay{
+		reader: NewReader(paths),
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/recorder"
+)
+
+// Reports a few steps from alternate motors on every exchange
+type fakeTransactor struct {
+	n int
+}
+
+func (f *fakeTransactor) Transact(sent []datalink.Packet) ([]datalink.Packet, error) {
+	f.n++
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(f.n % 2))
+	binary.Write(buf, binary.LittleEndian, int32(5 + f.n % 7))
+	return []datalink.Packet{ { Endpoint: 0x12, Data: buf.Bytes() } }, nil
+}
+
+// A frame every other tick, getting brighter
+type fakeCamera struct {
+	enabled bool
+	n int
+}
+
+func (c *fakeCamera) Enable() {
+	c.enabled = true
+}
+
+func (c *fakeCamera) Disable() {
+	c.enabled = false
+}
+
+func (c *fakeCamera) Enabled() bool {
+	return c.enabled
+}
+
+func (c *fakeCamera) Frame() (*image.Gray, *image.YCbCr, time.Time) {
+	c.n++
+	if !c.enabled || c.n % 2 != 0 {
+		return nil, nil, time.Time{}
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 16, 32))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(c.n + i)
+	}
+	return img, nil, time.Now()
+}
+
+// Turning slowly
+type fakeIMU struct {
+	n int
+}
+
+func (i *fakeIMU) Euler() ([]float64, error) {
+	i.n++
+	return []float64{ float64(i.n) * 0.01, 0, 0 }, nil
+}
+
+// A stand-in for the robot's main loop: steer on the heading and the
+// brightness of the frame
+type controller struct {
+	platform *base.Platform
+	gain float32
+	brightness float32
+}
+
+func (c *controller) tick() {
+	c.platform.Update()
+
+	if frame, _ := c.platform.GetFullFrame(); frame != nil {
+		c.brightness = float32(frame.Pix[0]) / 255
+	}
+	c.platform.SetArc(100 * c.brightness, -c.gain * c.platform.GetRot())
+}
+
+func record(t *testing.T, dir string, ticks int, gain float32) {
+	rec, err := recorder.NewRecorder(dir, 1 << 16, 1 << 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	platform := base.NewPlatformWith(base.Hardware{
+		Transactor: &fakeTransactor{},
+		Camera: &fakeCamera{},
+		IMU: &fakeIMU{},
+	}, base.Config{})
+	platform.SetRecorder(rec)
+	platform.EnableCamera()
+
+	c := &controller{ platform: platform, gain: gain }
+	for i := 0; i < ticks; i++ {
+		c.tick()
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func play(t *testing.T, dir string, gain float32) (int, []Diff) {
+	paths, err := recorder.Recordings(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp := NewReplay(paths)
+	defer rp.Close()
+
+	platform := base.NewPlatformWith(rp.Hardware(), base.Config{})
+	platform.EnableCamera()
+
+	c := &controller{ platform: platform, gain: gain }
+	ticks := 0
+	for {
+		_, err := rp.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		c.tick()
+		ticks++
+	}
+
+	return ticks, rp.Diffs()
+}
+
+func TestReplay(t *testing.T) {
+	const ticks = 200
+	dir := t.TempDir()
+	record(t, dir, ticks, 2)
+
+	n, diffs := play(t, dir, 2)
+	if n != ticks {
+		t.Errorf("Replayed %d ticks, recorded %d", n, ticks)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("Replay differed from the recording %d times, first: %v", len(diffs), diffs[0])
+	}
+
+	// Anything which changes what's sent must show up
+	_, diffs = play(t, dir, 3)
+	if len(diffs) == 0 {
+		t.Errorf("Changing the gain didn't change the replay")
+	}
+}
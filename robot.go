@@ -0,0 +1,211 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package main
+
+import (
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/control"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan"
+	"github.com/usedbytes/mini_mouse/bot/plan/line"
+	"github.com/usedbytes/mini_mouse/bot/plan/maze"
+	"github.com/usedbytes/mini_mouse/bot/plan/path"
+	"github.com/usedbytes/mini_mouse/bot/plan/rc"
+	"github.com/usedbytes/mini_mouse/bot/plan/waypoint"
+	"github.com/usedbytes/mini_mouse/bot/recorder"
+	"github.com/usedbytes/mini_mouse/bot/sched"
+	"github.com/usedbytes/mini_mouse/bot/tunable"
+	"github.com/usedbytes/mini_mouse/bot/vision"
+)
+
+// robot is everything the main loop runs, whether it's driving the real
+// robot or replaying a recording
+type robot struct {
+	platform *base.Platform
+	input *input.Collector
+	telem *Telem
+	rec *recorder.Recorder
+
+	mod *model.Model
+	planner *plan.Planner
+	lineTask *line.Task
+	wpTask *waypoint.Task
+	ctl *control.Control
+
+	vis *vision.Pipeline
+	fiducials *vision.Fiducials
+	// Run vision in the main loop instead of on its own goroutine, so the
+	// results don't depend on timing
+	syncVision bool
+
+	lastFrame time.Time
+	ticks int
+	// The main loop tick, split up so the scheduler can time each part
+	stages []sched.Stage
+}
+
+func newRobot(platform *base.Platform, ip *input.Collector, telem *Telem, arena *model.Arena, mcfg model.Config, syncVision bool) *robot {
+	r := &robot{
+		platform: platform,
+		input: ip,
+		telem: telem,
+		syncVision: syncVision,
+	}
+
+	r.mod = model.NewModel(platform, mcfg)
+	if arena != nil {
+		r.mod.SetArena(arena)
+	}
+
+	r.wpTask = waypoint.NewTask(r.mod, platform)
+	r.wpTask.SetWaypoint(model.Coord{ 0, 0 })
+
+	obstacles := vision.NewObstacles(platform.Calibration, 400)
+	r.fiducials = vision.NewFiducials(platform.Calibration)
+	lineDetect := vision.NewLineDetect(0.3)
+	r.vis = vision.NewPipeline(
+		obstacles,
+		r.fiducials,
+		vision.Crop(platform.Calibration.Crop),
+		lineDetect,
+		vision.Markers(),
+	)
+	if !syncVision {
+		r.vis.Start()
+	}
+
+	r.lineTask = line.NewTask(r.mod, platform, r.vis, lineDetect)
+	r.lineTask.RegisterTunables(tunable.Default)
+	telem.SetLineTask(r.lineTask)
+	telem.SetVision(r.vis)
+
+	r.planner = plan.NewPlanner()
+	r.planner.AddTask(line.TaskName, r.lineTask)
+	r.planner.AddTask(waypoint.TaskName, r.wpTask)
+	r.planner.AddTask(rc.TaskName, rc.NewTask(ip, platform))
+	r.planner.AddTask(path.TaskName, path.NewTask(r.mod, platform, r.wpTask))
+
+	// Standard 16x16 maze with 180 mm cells, starting in the corner
+	mazeGoals := []maze.Cell{ {7, 7}, {7, 8}, {8, 7}, {8, 8} }
+	mazeTask := maze.NewTask(maze.NewRobot(r.mod, platform, 180), 16, 16, maze.Cell{0, 0}, maze.North, mazeGoals)
+	r.planner.AddTask(maze.TaskName, mazeTask)
+	r.planner.SetTask(rc.TaskName)
+	r.planner.SetObstacles(obstacles.Events())
+
+	r.ctl = control.NewControl(control.Robot{
+		Planner: r.planner,
+		Model: r.mod,
+		Platform: platform,
+		Line: r.lineTask,
+		Waypoint: r.wpTask,
+		Tunables: tunable.Default,
+	})
+
+	r.stages = []sched.Stage{
+		{ "platform", r.updatePlatform },
+		{ "model", r.updateModel },
+		{ "vision", r.updateVision },
+		{ "control", r.ctl.Run },
+		{ "planner", r.updatePlanner },
+	}
+
+	return r
+}
+
+// SetRecorder records everything the robot sees and does from now on
+func (r *robot) SetRecorder(rec *recorder.Recorder) {
+	r.rec = rec
+	r.platform.SetRecorder(rec)
+}
+
+// tick runs all the stages once
+func (r *robot) tick() {
+	for _, s := range r.stages {
+		s.Run()
+	}
+}
+
+func (r *robot) updatePlatform() {
+	err := r.platform.Update()
+	if err != nil {
+		logger.Warn("Platform update failed", "err", err)
+	}
+}
+
+func (r *robot) updateModel() {
+	r.mod.Tick()
+
+	select {
+	case tags := <-r.fiducials.Sightings():
+		if r.mod.Arena() != nil {
+			err := r.mod.AddTags(tags)
+			if err != nil {
+				logger.Warn("Localisation failed", "err", err)
+			}
+		}
+	default:
+	}
+
+	pos, angle := r.mod.GetPose()
+	r.telem.SetPose(float64(pos.X), float64(pos.Y), float64(angle))
+	r.rec.Pose(pos.X, pos.Y, angle)
+	logging.SetContext("tick", r.ticks, "task", r.planner.Current(), "x", pos.X, "y", pos.Y, "heading", angle)
+
+	// Rendering the map is slow, so don't do it every tick
+	if r.ticks % 30 == 0 {
+		r.telem.SetMap(r.mod.Map())
+	}
+	r.ticks++
+}
+
+func (r *robot) updateVision() {
+	frame, frameTime := r.platform.GetFullFrame()
+	if frame != nil && frameTime != r.lastFrame {
+		r.telem.SetFrame(frame)
+		if r.syncVision {
+			r.vis.Process(frame, r.platform.GetFullColourFrame(), frameTime)
+		} else {
+			r.vis.Submit(frame, r.platform.GetFullColourFrame(), frameTime)
+		}
+		r.lastFrame = frameTime
+	}
+}
+
+func (r *robot) updatePlanner() {
+	buttons := r.input.Buttons()
+	left, right := r.input.GetSticks()
+	r.rec.Input(left, right, buttons)
+	r.planner.Tick(buttons)
+
+	r.telem.SetLineQuality(r.lineTask.Quality())
+	r.telem.SetLineFloor(r.lineTask.Floor())
+
+	if buttons.Pressed(input.Triangle) {
+		r.mod.ResetOrientation()
+	}
+
+	if buttons.Pressed(input.Share) {
+		if r.platform.CameraEnabled() {
+			r.platform.DisableCamera()
+		} else {
+			r.platform.EnableCamera()
+		}
+	}
+
+	if buttons.Pressed(input.Square) {
+		r.planner.SetTask("waypoint")
+	}
+
+	if buttons.Pressed(input.Cross) {
+		r.planner.SetTask(line.TaskName)
+	}
+
+	if buttons.Pressed(input.Circle) {
+		r.planner.SetTask("rc")
+	}
+
+	r.rec.Task(r.planner.Current())
+}
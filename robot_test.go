@@ -0,0 +1,67 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package main
+
+import (
+	"image"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/base"
+	"github.com/usedbytes/mini_mouse/bot/interface/input"
+	"github.com/usedbytes/mini_mouse/bot/model"
+)
+
+var (
+	// Robots register their tunables, so there can only be one
+	testRobotOnce sync.Once
+	testRobot *robot
+)
+
+func getTestRobot() *robot {
+	testRobotOnce.Do(func() {
+		platform := base.NewPlatformWith(base.Hardware{}, base.Config{})
+		testRobot = newRobot(platform, input.NewDetachedCollector(), &Telem{}, nil, model.Config{}, true)
+	})
+	return testRobot
+}
+
+// A bright line up the middle of a grey floor, w x h
+func testFrame(w, h int) (*image.Gray, *image.YCbCr) {
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+	colour := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	for i := range colour.Cb {
+		colour.Cb[i], colour.Cr[i] = 128, 128
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(60)
+			if x > w * 2 / 5 && x < w * 3 / 5 {
+				v = 200
+			}
+			gray.Pix[gray.Stride * y + x] = v
+			colour.Y[colour.YStride * y + x] = v
+		}
+	}
+	return gray, colour
+}
+
+// The whole of the robot's vision pipeline, for each frame
+func BenchmarkVision(b *testing.B) {
+	r := getTestRobot()
+
+	for _, size := range []image.Point{ { 16, 32 }, { 160, 120 } } {
+		gray, colour := testFrame(size.X, size.Y)
+		b.Run(size.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			t := time.Now()
+			for i := 0; i < b.N; i++ {
+				t = t.Add(time.Millisecond)
+				if out := r.vis.Process(gray, colour, t); out.Err != nil {
+					b.Fatal(out.Err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package sched
+
+import (
+	"sync"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/logging"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+)
+
+const (
+	// How often Stats are published, and the window Max is taken over
+	statsPeriod = time.Second
+	// Weight of each new sample in Mean
+	alpha = 0.05
+)
+
+var (
+	statsTopic = telemetry.NewTopic("loop/stats", Stats{})
+
+	logger = logging.New("sched")
+	// Overruns tend to come in runs, one message a second is plenty
+	overrunLogger = logger.Every(time.Second)
+)
+
+// Stage is one step of a loop tick
+type Stage struct {
+	Name string
+	Run func()
+}
+
+type Timing struct {
+	Last time.Duration
+	// Exponentially weighted
+	Mean time.Duration
+	// Over the last statsPeriod
+	Max time.Duration
+}
+
+func (t *Timing) add(d time.Duration) {
+	t.Last = d
+	if t.Mean == 0 {
+		t.Mean = d
+	} else {
+		t.Mean += time.Duration(alpha * float64(d - t.Mean))
+	}
+	if d > t.Max {
+		t.Max = d
+	}
+}
+
+type StageTiming struct {
+	Name string
+	Timing
+}
+
+// Stats is published on "loop/stats" once a second
+type Stats struct {
+	Period time.Duration
+	Ticks uint64
+	// Ticks which took longer than Period
+	Overruns uint64
+	// Ticks skipped because the loop fell more than a whole Period behind
+	Missed uint64
+
+	// How long each tick took, all stages together
+	Duration Timing
+	// How late each tick started
+	Jitter Timing
+
+	Stages []StageTiming
+	// Things running on their own goroutines, timed each time they run
+	Background []StageTiming
+}
+
+func (s *Stats) clone() Stats {
+	ret := *s
+	ret.Stages = append([]StageTiming(nil), s.Stages...)
+	ret.Background = append([]StageTiming(nil), s.Background...)
+	return ret
+}
+
+func (s *Stats) resetMax() {
+	s.Duration.Max = 0
+	s.Jitter.Max = 0
+	for i := range s.Stages {
+		s.Stages[i].Max = 0
+	}
+	for i := range s.Background {
+		s.Background[i].Max = 0
+	}
+}
+
+// Loop runs a list of Stages in order, at a fixed rate. Ticks are
+// scheduled from when the loop started rather than when the last one
+// finished, so they don't drift. A tick which runs over its period delays
+// the next one; if the loop falls more than a whole period behind, the
+// ticks it missed are skipped rather than run back to back.
+type Loop struct {
+	period time.Duration
+	stages []Stage
+	stop chan bool
+
+	lock sync.Mutex
+	stats Stats
+}
+
+// Stats returns the timings so far
+func (l *Loop) Stats() Stats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.stats.clone()
+}
+
+// Background runs 'fn' every 'period' on its own goroutine, for things
+// which are too slow to wait for in the loop. They should hand their
+// results over by keeping the latest value for the loop to pick up.
+func (l *Loop) Background(name string, period time.Duration, fn func()) {
+	l.lock.Lock()
+	idx := len(l.stats.Background)
+	l.stats.Background = append(l.stats.Background, StageTiming{ Name: name })
+	l.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-l.stop:
+				return
+			}
+
+			start := time.Now()
+			fn()
+			d := time.Since(start)
+
+			l.lock.Lock()
+			l.stats.Background[idx].add(d)
+			l.lock.Unlock()
+		}
+	}()
+}
+
+func (l *Loop) tick(late time.Duration, times []time.Duration) {
+	start := time.Now()
+	for i, s := range l.stages {
+		t := time.Now()
+		s.Run()
+		times[i] = time.Since(t)
+	}
+	total := time.Since(start)
+
+	l.lock.Lock()
+	l.stats.Ticks++
+	l.stats.Duration.add(total)
+	l.stats.Jitter.add(late)
+	for i, d := range times {
+		l.stats.Stages[i].add(d)
+	}
+	overrun := total > l.period
+	if overrun {
+		l.stats.Overruns++
+	}
+	l.lock.Unlock()
+
+	if overrun {
+		slowest := 0
+		for i, d := range times {
+			if d > times[slowest] {
+				slowest = i
+			}
+		}
+		overrunLogger.Warn("Tick overran", "took", total, "period", l.period,
+			"slowest", l.stages[slowest].Name, "slowest_took", times[slowest])
+	}
+}
+
+func (l *Loop) publish() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	statsTopic.Publish(l.stats.clone())
+	l.stats.resetMax()
+}
+
+// Run runs the loop until Stop is called
+func (l *Loop) Run() {
+	times := make([]time.Duration, len(l.stages))
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	next := time.Now()
+	lastPublish := next
+	for {
+		select {
+		case <-timer.C:
+		case <-l.stop:
+			return
+		}
+
+		now := time.Now()
+		l.tick(now.Sub(next), times)
+
+		next = next.Add(l.period)
+		now = time.Now()
+		if behind := now.Sub(next); behind > l.period {
+			missed := behind / l.period
+			next = next.Add(missed * l.period)
+
+			l.lock.Lock()
+			l.stats.Missed += uint64(missed)
+			l.lock.Unlock()
+			overrunLogger.Warn("Skipped ticks", "count", int(missed))
+		}
+
+		if now.Sub(lastPublish) >= statsPeriod {
+			l.publish()
+			lastPublish = now
+		}
+
+		timer.Reset(next.Sub(now))
+	}
+}
+
+// Stop stops Run, and everything started with Background
+func (l *Loop) Stop() {
+	close(l.stop)
+}
+
+// NewLoop makes a loop which runs 'stages' 'rate' times a second
+func NewLoop(rate float64, stages ...Stage) *Loop {
+	l := &Loop{
+		period: time.Duration(float64(time.Second) / rate),
+		stages: stages,
+		stop: make(chan bool),
+	}
+
+	l.stats.Period = l.period
+	for _, s := range stages {
+		l.stats.Stages = append(l.stats.Stages, StageTiming{ Name: s.Name })
+	}
+
+	return l
+}
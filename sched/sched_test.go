@@ -0,0 +1,108 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package sched
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Run 'l' until it has done 'ticks' ticks
+func runFor(t *testing.T, l *Loop, ticks uint64) {
+	t.Helper()
+
+	done := make(chan bool)
+	go func() {
+		l.Run()
+		close(done)
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for l.Stats().Ticks < ticks {
+		select {
+		case <-deadline:
+			t.Fatalf("Only %d ticks", l.Stats().Ticks)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	l.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return after Stop")
+	}
+}
+
+func TestOverruns(t *testing.T) {
+	// 100 ms period. The sleeps are a long way from the edges, so that
+	// sleeping a bit longer than asked doesn't change the counts.
+	const rate = 10
+
+	tests := []struct{
+		name string
+		// How long to take on each tick
+		sleeps map[int]time.Duration
+		overruns, missed uint64
+	}{
+		{ "On time", nil, 0, 0 },
+		{
+			// Falls 60 ms behind, less than a period, so nothing is
+			// skipped
+			"Two slow ticks",
+			map[int]time.Duration{ 1: 130 * time.Millisecond, 2: 130 * time.Millisecond },
+			2, 0,
+		},
+		{
+			// Finishes 150 ms behind, so the tick due at 200 ms is
+			// skipped
+			"One very slow tick",
+			map[int]time.Duration{ 1: 250 * time.Millisecond },
+			1, 1,
+		},
+	}
+
+	for _, test := range tests {
+		tick := 0
+		l := NewLoop(rate, Stage{ "slow", func() {
+			time.Sleep(test.sleeps[tick])
+			tick++
+		} })
+		runFor(t, l, 6)
+
+		stats := l.Stats()
+		if stats.Overruns != test.overruns || stats.Missed != test.missed {
+			t.Errorf("%s: %d overruns and %d missed, expected %d and %d", test.name,
+				stats.Overruns, stats.Missed, test.overruns, test.missed)
+		}
+		if len(stats.Stages) != 1 || stats.Stages[0].Name != "slow" || stats.Stages[0].Last <= 0 {
+			t.Errorf("%s: stage timings %+v", test.name, stats.Stages)
+		}
+	}
+}
+
+func TestStopBackground(t *testing.T) {
+	l := NewLoop(100, Stage{ "nothing", func() {} })
+
+	var runs int64
+	l.Background("count", time.Millisecond, func() {
+		atomic.AddInt64(&runs, 1)
+	})
+
+	runFor(t, l, 10)
+	if atomic.LoadInt64(&runs) == 0 {
+		t.Fatal("Background never ran")
+	}
+
+	// Let one which had already started finish
+	time.Sleep(10 * time.Millisecond)
+	stopped := atomic.LoadInt64(&runs)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&runs); n != stopped {
+		t.Errorf("Background ran %d times after Stop", n - stopped)
+	}
+
+	if bg := l.Stats().Background; len(bg) != 1 || bg[0].Name != "count" || bg[0].Last <= 0 {
+		t.Errorf("Background timings %+v", bg)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package telemetry
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/logging"
+)
+
+var (
+	logger = logging.New("telemetry")
+	// Topics are published every tick
+	publishLogger = logger.Every(time.Second)
+)
+
+// Message is one value published on a topic
+type Message struct {
+	Topic string
+	// Increases with every message published on the bus
+	Seq uint64
+	Time time.Time
+	Value interface{}
+}
+
+// A Topic carries values of a single type. Only the latest value is kept:
+// subscribers sample it at their own rate.
+type Topic struct {
+	name string
+	typ reflect.Type
+	bus *Bus
+}
+
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Publish sets the topic's latest value, which must be the same type as
+// the topic was created with. v is kept, so mustn't be modified afterwards.
+func (t *Topic) Publish(v interface{}) {
+	if reflect.TypeOf(v) != t.typ {
+		publishLogger.Error("Wrong type published", "topic", t.name, "type", fmt.Sprintf("%T", v), "expected", t.typ)
+		return
+	}
+	t.bus.publish(t.name, v)
+}
+
+type TopicInfo struct {
+	Name string
+	Type string
+}
+
+// Bus holds the latest value of every topic
+type Bus struct {
+	lock sync.Mutex
+	topics map[string]*Topic
+	latest map[string]Message
+	seq uint64
+}
+
+// Topic returns the topic 'name', creating it if need be. 'example' is a
+// value of the type the topic carries.
+func (b *Bus) Topic(name string, example interface{}) *Topic {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	typ := reflect.TypeOf(example)
+	if t, ok := b.topics[name]; ok {
+		if t.typ != typ {
+			panic(fmt.Sprintf("Telemetry topic %s is %v, not %v", name, t.typ, typ))
+		}
+		return t
+	}
+
+	t := &Topic{ name: name, typ: typ, bus: b }
+	b.topics[name] = t
+	return t
+}
+
+func (b *Bus) publish(name string, v interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.seq++
+	b.latest[name] = Message{
+		Topic: name,
+		Seq: b.seq,
+		Time: time.Now(),
+		Value: v,
+	}
+}
+
+// Topics lists all the topics, sorted by name
+func (b *Bus) Topics() []TopicInfo {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ret := make([]TopicInfo, 0, len(b.topics))
+	for _, t := range b.topics {
+		ret = append(ret, TopicInfo{ t.name, t.typ.String() })
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func (b *Bus) Latest(name string) (Message, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	m, ok := b.latest[name]
+	return m, ok
+}
+
+// Does 'name' match one of 'patterns'? A pattern ending in '*' matches
+// names starting with the rest of it. No patterns matches everything.
+func match(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Since returns the latest message on each topic matching 'patterns' which
+// is newer than 'seq'
+func (b *Bus) Since(patterns []string, seq uint64) []Message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var ret []Message
+	for name, m := range b.latest {
+		if m.Seq > seq && match(patterns, name) {
+			ret = append(ret, m)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Seq < ret[j].Seq })
+	return ret
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		topics: make(map[string]*Topic),
+		latest: make(map[string]Message),
+	}
+}
+
+// Default is the bus used by the rest of the robot
+var Default = NewBus()
+
+// NewTopic returns the topic 'name' on the Default bus
+func NewTopic(name string, example interface{}) *Topic {
+	return Default.Topic(name, example)
+}
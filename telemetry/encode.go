@@ -0,0 +1,120 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package telemetry
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+)
+
+type Format int
+const (
+	JSON Format = iota
+	// Binary messages are little-endian:
+	//
+	//	u8 topic length, topic
+	//	u64 seq
+	//	i64 time, ns since the Unix epoch
+	//	u8 payload kind, payload
+	//
+	// See the Payload constants for the payload kinds.
+	Binary
+)
+
+func (f Format) String() string {
+	return [...]string{ "json", "binary" }[f]
+}
+
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "", "json":
+		return JSON, nil
+	case "binary":
+		return Binary, nil
+	}
+	return JSON, fmt.Errorf("Unknown format '%s'", s)
+}
+
+const (
+	// Fixed-size values (numbers, and structs and slices of them), as
+	// encoding/binary would write them
+	PayloadRaw byte = iota
+	// Anything else, as JSON
+	PayloadJSON
+	// u16 width, u16 height, then the pixels
+	PayloadGray
+	// UTF-8 text
+	PayloadString
+	// The value's own MarshalBinary
+	PayloadMarshaler
+)
+
+type jsonMessage struct {
+	Topic string
+	Seq uint64
+	// ns since the Unix epoch
+	Time int64
+	Value interface{}
+}
+
+func encodePayload(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case string:
+		buf.WriteByte(PayloadString)
+		buf.WriteString(t)
+		return nil
+	case *image.Gray:
+		w, h := t.Bounds().Dx(), t.Bounds().Dy()
+		buf.WriteByte(PayloadGray)
+		binary.Write(buf, binary.LittleEndian, []uint16{ uint16(w), uint16(h) })
+		for y := 0; y < h; y++ {
+			buf.Write(t.Pix[t.Stride * y : t.Stride * y + w])
+		}
+		return nil
+	case encoding.BinaryMarshaler:
+		data, err := t.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(PayloadMarshaler)
+		buf.Write(data)
+		return nil
+	}
+
+	if binary.Size(v) >= 0 {
+		buf.WriteByte(PayloadRaw)
+		return binary.Write(buf, binary.LittleEndian, v)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(PayloadJSON)
+	buf.Write(data)
+	return nil
+}
+
+// Encode turns a message into bytes to send to a client
+func (f Format) Encode(m Message) ([]byte, error) {
+	if f == JSON {
+		return json.Marshal(jsonMessage{ m.Topic, m.Seq, m.Time.UnixNano(), m.Value })
+	}
+
+	buf := &bytes.Buffer{}
+	if len(m.Topic) > 255 {
+		return nil, fmt.Errorf("Topic name too long")
+	}
+	buf.WriteByte(byte(len(m.Topic)))
+	buf.WriteString(m.Topic)
+	binary.Write(buf, binary.LittleEndian, m.Seq)
+	binary.Write(buf, binary.LittleEndian, m.Time.UnixNano())
+
+	if err := encodePayload(buf, m.Value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package telemetry
+
+import (
+	"sync"
+
+	"github.com/usedbytes/mini_mouse/bot/logging"
+)
+
+type logSink struct {
+	lock sync.Mutex
+	topic *Topic
+	entries []logging.Entry
+	keep int
+}
+
+func (s *logSink) Write(e *logging.Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry := *e
+	entry.Fields = append([]logging.Field(nil), e.Fields...)
+
+	// Topics only hold their latest value, so each one is a fresh copy
+	// of the most recent entries
+	n := len(s.entries) + 1
+	if n > s.keep {
+		n = s.keep
+	}
+	entries := make([]logging.Entry, 0, n)
+	entries = append(entries, s.entries[len(s.entries) - (n - 1):]...)
+	s.entries = append(entries, entry)
+
+	s.topic.Publish(s.entries)
+}
+
+// NewLogSink is a logging.Sink which publishes the last 'keep' entries as
+// []logging.Entry on the topic 'name'. Clients can use Seq to spot the new
+// ones.
+func NewLogSink(name string, keep int) logging.Sink {
+	if keep < 1 {
+		keep = 1
+	}
+	return &logSink{
+		topic: NewTopic(name, []logging.Entry{}),
+		keep: keep,
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRate = 10
+	maxRate = 60
+)
+
+// Server streams topics from a Bus over HTTP. Under its prefix it serves:
+//
+//	topics         JSON list of the topics
+//	latest?topic=  the latest message on one topic, as JSON
+//	stream         a stream of messages
+//
+// Streams are WebSocket connections, or newline-separated JSON for plain
+// HTTP clients. They're configured by query parameters:
+//
+//	topics=a,b*    topics to send, '*' matches any ending. Default is all.
+//	rate=10        messages per second, per topic
+//	format=json    "json" or "binary" (WebSocket only)
+//
+// WebSocket clients can change topics and rate at any time by sending a
+// JSON text message like {"Topics": ["model/*"], "Rate": 30}.
+type Server struct {
+	bus *Bus
+	prefix string
+}
+
+type subscription struct {
+	lock sync.Mutex
+	Topics []string
+	Rate float32
+	format Format
+	// Set when the topics change, so their latest values are sent again
+	changed bool
+}
+
+func (s *subscription) get() ([]string, time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	changed := s.changed
+	s.changed = false
+	return s.Topics, time.Duration(float32(time.Second) / s.Rate), changed
+}
+
+func (s *subscription) update(data []byte) error {
+	var req struct {
+		Topics []string
+		Rate float32
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if req.Topics != nil {
+		s.Topics = req.Topics
+		s.changed = true
+	}
+	if req.Rate > 0 {
+		s.Rate = clampRate(req.Rate)
+	}
+	return nil
+}
+
+func clampRate(rate float32) float32 {
+	if rate > maxRate {
+		return maxRate
+	}
+	return rate
+}
+
+func parseSubscription(r *http.Request) (*subscription, error) {
+	q := r.URL.Query()
+	sub := &subscription{ Rate: defaultRate }
+
+	if t := q.Get("topics"); t != "" {
+		sub.Topics = strings.Split(t, ",")
+	}
+
+	if rs := q.Get("rate"); rs != "" {
+		rate, err := strconv.ParseFloat(rs, 32)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("Bad rate '%s'", rs)
+		}
+		sub.Rate = clampRate(float32(rate))
+	}
+
+	format, err := ParseFormat(q.Get("format"))
+	if err != nil {
+		return nil, err
+	}
+	sub.format = format
+
+	return sub, nil
+}
+
+// Send anything new on the subscribed topics at the subscription's rate,
+// until 'send' fails or 'done' is closed
+func (s *Server) pump(sub *subscription, send func(m Message) error, done <-chan bool) error {
+	var seq uint64
+	for {
+		topics, period, changed := sub.get()
+		if changed {
+			seq = 0
+		}
+		for _, m := range s.bus.Since(topics, seq) {
+			if err := send(m); err != nil {
+				return err
+			}
+			seq = m.Seq
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-time.After(period):
+		}
+	}
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, sub *subscription) {
+	conn, err := upgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			op, data, err := conn.readFrame()
+			if err != nil {
+				if err != io.EOF {
+					logger.Warn("Reading WebSocket", "err", err)
+				}
+				return
+			}
+			if op == opText {
+				if err := sub.update(data); err != nil {
+					logger.Warn("Bad subscription update", "err", err)
+				}
+			}
+		}
+	}()
+
+	op := byte(opText)
+	if sub.format == Binary {
+		op = opBinary
+	}
+
+	s.pump(sub, func(m Message) error {
+		data, err := sub.format.Encode(m)
+		if err != nil {
+			logger.Warn("Encoding message", "topic", m.Topic, "err", err)
+			return nil
+		}
+		return conn.writeFrame(op, data)
+	}, done)
+}
+
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseSubscription(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isUpgrade(r) {
+		s.serveWebSocket(w, r, sub)
+		return
+	}
+
+	if sub.format != JSON {
+		http.Error(w, "Plain HTTP streams are JSON only", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	done := make(chan bool)
+	go func() {
+		<-r.Context().Done()
+		close(done)
+	}()
+
+	s.pump(sub, func(m Message) error {
+		data, err := JSON.Encode(m)
+		if err != nil {
+			logger.Warn("Encoding message", "topic", m.Topic, "err", err)
+			return nil
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}, done)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("Encoding response", "err", err)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, s.prefix) {
+	case "topics":
+		writeJSON(w, s.bus.Topics())
+	case "latest":
+		m, ok := s.bus.Latest(r.URL.Query().Get("topic"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, jsonMessage{ m.Topic, m.Seq, m.Time.UnixNano(), m.Value })
+	case "stream":
+		s.serveStream(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// NewServer serves 'bus' under 'prefix', which should end in '/'
+func NewServer(bus *Bus, prefix string) *Server {
+	return &Server{
+		bus: bus,
+		prefix: prefix,
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package telemetry
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPoint struct {
+	X, Y float32
+}
+
+func testServer(t *testing.T) (*Bus, *httptest.Server) {
+	bus := NewBus()
+	srv := httptest.NewServer(NewServer(bus, "/"))
+	t.Cleanup(srv.Close)
+	return bus, srv
+}
+
+// A bare WebSocket client, so that it can send frames the server should
+// refuse
+type testClient struct {
+	conn net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, srv *httptest.Server, query, key string) (*testClient, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET /stream?%s HTTP/1.1\r\n", query)
+	fmt.Fprintf(conn, "Host: %s\r\n", srv.Listener.Addr())
+	fmt.Fprintf(conn, "Upgrade: websocket\r\n")
+	fmt.Fprintf(conn, "Connection: Upgrade\r\n")
+	fmt.Fprintf(conn, "Sec-WebSocket-Key: %s\r\n", key)
+	fmt.Fprintf(conn, "Sec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{ conn: conn, r: r }, resp
+}
+
+func (c *testClient) write(fin bool, op byte, masked bool, payload []byte) error {
+	hdr := []byte{ op, byte(len(payload)) }
+	if fin {
+		hdr[0] |= 0x80
+	}
+	if masked {
+		hdr[1] |= 0x80
+		mask := []byte{ 1, 2, 3, 4 }
+		hdr = append(hdr, mask...)
+		payload = append([]byte{}, payload...)
+		for i := range payload {
+			payload[i] ^= mask[i % 4]
+		}
+	}
+	_, err := c.conn.Write(append(hdr, payload...))
+	return err
+}
+
+// Server frames are small in these tests
+func (c *testClient) read() (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[1] & 0x80 != 0 {
+		return 0, nil, fmt.Errorf("Server frame masked")
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0] & 0xf, payload, nil
+}
+
+func TestHandshake(t *testing.T) {
+	_, srv := testServer(t)
+
+	// The example from RFC 6455
+	_, resp := dial(t, srv, "", "dGhlIHNhbXBsZSBub25jZQ==")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Status %d, expected 101", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept %s", accept)
+	}
+}
+
+func TestWebSocketJSON(t *testing.T) {
+	bus, srv := testServer(t)
+	bus.Topic("model/pose", testPoint{}).Publish(testPoint{ 1, 2 })
+	bus.Topic("vision/line", "").Publish("ignored")
+
+	c, _ := dial(t, srv, "topics=model/*&rate=60", "dGhlIHNhbXBsZSBub25jZQ==")
+	op, data, err := c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != opText {
+		t.Fatalf("Opcode %d, expected text", op)
+	}
+
+	var m struct {
+		Topic string
+		Seq uint64
+		Time int64
+		Value testPoint
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Topic != "model/pose" || m.Seq != 1 || m.Value != (testPoint{ 1, 2 }) {
+		t.Errorf("Got %+v", m)
+	}
+	if d := time.Since(time.Unix(0, m.Time)); d < 0 || d > time.Minute {
+		t.Errorf("Time %d is %v ago", m.Time, d)
+	}
+}
+
+func TestWebSocketBinary(t *testing.T) {
+	bus, srv := testServer(t)
+	bus.Topic("model/pose", testPoint{}).Publish(testPoint{ 1, 2 })
+
+	c, _ := dial(t, srv, "format=binary&rate=60", "dGhlIHNhbXBsZSBub25jZQ==")
+	op, data, err := c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != opBinary {
+		t.Fatalf("Opcode %d, expected binary", op)
+	}
+
+	r := bytes.NewReader(data)
+	n, _ := r.ReadByte()
+	topic := make([]byte, n)
+	r.Read(topic)
+
+	var hdr struct {
+		Seq uint64
+		Time int64
+		Kind byte
+	}
+	var v testPoint
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(topic) != "model/pose" || hdr.Seq != 1 || hdr.Kind != PayloadRaw || v != (testPoint{ 1, 2 }) {
+		t.Errorf("Got %s %+v %+v", topic, hdr, v)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes left over", r.Len())
+	}
+}
+
+func TestSubscriptionUpdate(t *testing.T) {
+	bus, srv := testServer(t)
+	bus.Topic("a", "").Publish("a")
+
+	c, _ := dial(t, srv, "topics=a&rate=60", "dGhlIHNhbXBsZSBub25jZQ==")
+	if _, data, err := c.read(); err != nil || !strings.Contains(string(data), `"Topic":"a"`) {
+		t.Fatalf("Got %s, %v", data, err)
+	}
+
+	bus.Topic("b", "").Publish("b")
+	if err := c.write(true, opText, true, []byte(`{"Topics": ["b"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := c.read(); err != nil || !strings.Contains(string(data), `"Topic":"b"`) {
+		t.Fatalf("Got %s, %v", data, err)
+	}
+}
+
+func TestRejectedFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		fin bool
+		op byte
+		masked bool
+		code uint16
+	}{
+		{ "Unmasked", true, opText, false, closeProtocolError },
+		{ "Fragmented", false, opText, true, closeUnsupported },
+		{ "Continuation", true, opContinuation, true, closeUnsupported },
+		{ "Fragmented ping", false, opPing, true, closeProtocolError },
+	}
+
+	for _, test := range tests {
+		bus, srv := testServer(t)
+		bus.Topic("a", "").Publish("a")
+
+		c, _ := dial(t, srv, "rate=60", "dGhlIHNhbXBsZSBub25jZQ==")
+		if err := c.write(test.fin, test.op, test.masked, []byte(`{"Topics": ["b"]}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Data may arrive before the close
+		var code uint16
+		for {
+			op, data, err := c.read()
+			if err != nil {
+				t.Errorf("%s: %v before a close frame", test.name, err)
+				break
+			}
+			if op == opClose {
+				if len(data) >= 2 {
+					code = binary.BigEndian.Uint16(data)
+				}
+				break
+			}
+		}
+		if code != test.code {
+			t.Errorf("%s: close code %d, expected %d", test.name, code, test.code)
+		}
+
+		// ...and then the server hangs up
+		for {
+			if _, _, err := c.read(); err != nil {
+				if err != io.EOF {
+					t.Errorf("%s: %v, expected EOF", test.name, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	bus, srv := testServer(t)
+	pose := bus.Topic("model/pose", testPoint{})
+	pose.Publish(testPoint{ 1, 2 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL + "/stream?rate=60", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type %s", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	for i, want := range []testPoint{ { 1, 2 }, { 3, 4 } } {
+		if !lines.Scan() {
+			t.Fatal(lines.Err())
+		}
+
+		var m struct {
+			Topic string
+			Seq uint64
+			Value testPoint
+		}
+		if err := json.Unmarshal(lines.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Topic != "model/pose" || m.Seq != uint64(i + 1) || m.Value != want {
+			t.Errorf("Line %d: got %+v", i, m)
+		}
+
+		pose.Publish(testPoint{ 3, 4 })
+	}
+
+	// Binary only works over WebSocket
+	resp, err = http.Get(srv.URL + "/stream?format=binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Binary stream status %d, expected 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package telemetry
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Just enough of RFC 6455 to stream messages to a browser
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText = 0x1
+	opBinary = 0x2
+	opClose = 0x8
+	opPing = 0x9
+	opPong = 0xa
+)
+
+// Messages from clients are only for control, so don't need to be big
+const maxClientPayload = 4096
+
+// Close status codes
+const (
+	closeProtocolError = 1002
+	// Used for fragmented messages, which aren't supported
+	closeUnsupported = 1003
+	closeTooBig = 1009
+)
+
+type wsConn struct {
+	conn net.Conn
+	rw *bufio.ReadWriter
+
+	lock sync.Mutex
+}
+
+func isUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !isUpgrade(r) {
+		return nil, fmt.Errorf("Not a WebSocket request")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("Missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("Connection can't be hijacked")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprintf(rw, "Upgrade: websocket\r\n")
+	fmt.Fprintf(rw, "Connection: Upgrade\r\n")
+	fmt.Fprintf(rw, "Sec-WebSocket-Accept: %s\r\n\r\n", accept)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{ conn: conn, rw: rw }, nil
+}
+
+// Server frames are never masked or fragmented
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var hdr [10]byte
+	hdr[0] = 0x80 | op
+	n := 2
+	switch l := len(payload); {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n = 10
+	}
+
+	if _, err := c.rw.Write(hdr[:n]); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// closeWith sends a close frame saying why the connection is being closed,
+// and returns the reason as an error
+func (c *wsConn) closeWith(code uint16, reason string) error {
+	payload := make([]byte, 2, 2 + len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	c.writeFrame(opClose, append(payload, reason...))
+	return fmt.Errorf("%s", reason)
+}
+
+// readFrame returns the next data frame from the client, answering pings
+// along the way. Returns io.EOF when the client closes the connection.
+//
+// Clients must mask their frames. Fragmented messages aren't supported, as
+// clients only send small control messages.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+			return 0, nil, err
+		}
+
+		fin := hdr[0] & 0x80 != 0
+		rsv := hdr[0] & 0x70
+		op := hdr[0] & 0xf
+		masked := hdr[1] & 0x80 != 0
+		length := uint64(hdr[1] & 0x7f)
+
+		if rsv != 0 {
+			return 0, nil, c.closeWith(closeProtocolError, "Reserved bits set")
+		}
+		if !masked {
+			return 0, nil, c.closeWith(closeProtocolError, "Client frame not masked")
+		}
+		if op & 0x8 != 0 {
+			// Control frames
+			if !fin || length > 125 {
+				return 0, nil, c.closeWith(closeProtocolError, "Bad control frame")
+			}
+		} else if !fin || op == opContinuation {
+			return 0, nil, c.closeWith(closeUnsupported, "Fragmented messages aren't supported")
+		}
+
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+
+		if length > maxClientPayload {
+			return 0, nil, c.closeWith(closeTooBig, fmt.Sprintf("Client frame too big (%d bytes)", length))
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+			return 0, nil, err
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i % 4]
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+		case opPong:
+		case opClose:
+			c.writeFrame(opClose, nil)
+			return 0, nil, io.EOF
+		case opText, opBinary:
+			return op, payload, nil
+		default:
+			return 0, nil, c.closeWith(closeProtocolError, fmt.Sprintf("Unknown opcode %d", op))
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
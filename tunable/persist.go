@@ -0,0 +1,110 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package tunable
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/usedbytes/mini_mouse/bot/logging"
+)
+
+var logger = logging.New("tunable")
+
+// Values are saved as a JSON object of name: value
+
+func (r *Registry) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// Nothing's been tuned yet
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	// Anything which doesn't fit (e.g. renamed, or limits changed) is
+	// left at its default, so one bad value doesn't lose the rest
+	for name, value := range values {
+		t, err := r.find(name)
+		if err != nil {
+			logger.Warn("Skipping saved value", "file", path, "err", err)
+			continue
+		}
+		v, err := t.parse(value)
+		if err != nil {
+			logger.Warn("Skipping saved value", "file", path, "err", err)
+			continue
+		}
+		t.set(v)
+	}
+
+	return nil
+}
+
+func (r *Registry) save(path string) error {
+	values := make(map[string]interface{}, len(r.tunables))
+	for _, info := range r.list() {
+		values[info.Name] = info.Value
+	}
+
+	data, err := json.MarshalIndent(values, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write a new file and move it into place, so a crash can't leave a
+	// half-written one
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load sets tunables from the values saved in 'path', if it exists.
+// Tunables must be registered first.
+func (r *Registry) Load(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.load(path)
+	r.publish()
+	return err
+}
+
+// Save writes all the current values to 'path'
+func (r *Registry) Save(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.save(path)
+}
+
+// Persist loads any values saved in 'path', and saves them all there again
+// whenever one is Set
+func (r *Registry) Persist(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err := r.load(path); err != nil {
+		return err
+	}
+	r.path = path
+
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package tunable
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+)
+
+type Kind int
+const (
+	Float Kind = iota
+	Int
+	Bool
+)
+
+func (k Kind) String() string {
+	return [...]string{ "float", "int", "bool" }[k]
+}
+
+// Info describes a tunable, and its value when it was asked for
+type Info struct {
+	Name string
+	Kind string
+	// Inclusive limits, unused for Bool
+	Min, Max float64
+	Value interface{}
+}
+
+// A Tunable is a named parameter which can be read and changed at runtime.
+// The get and set functions aren't called concurrently by the Registry, but
+// anything else using the parameter needs to take care.
+type Tunable struct {
+	name string
+	kind Kind
+	min, max float64
+	get func() float64
+	set func(float64)
+}
+
+func (t *Tunable) info() Info {
+	info := Info{
+		Name: t.name,
+		Kind: t.kind.String(),
+		Min: t.min,
+		Max: t.max,
+	}
+
+	v := t.get()
+	switch t.kind {
+	case Int:
+		info.Value = int64(v)
+	case Bool:
+		info.Value = v != 0
+	default:
+		info.Value = v
+	}
+	return info
+}
+
+// Turn a value from JSON, gob or a query string into a float64, checking it
+// suits the tunable
+func (t *Tunable) parse(value interface{}) (float64, error) {
+	var v float64
+	switch x := value.(type) {
+	case bool:
+		if t.kind != Bool {
+			return 0, fmt.Errorf("%s is a %v, not a bool", t.name, t.kind)
+		}
+		if x {
+			v = 1
+		}
+		return v, nil
+	case string:
+		if t.kind == Bool {
+			b, err := strconv.ParseBool(x)
+			if err != nil {
+				return 0, fmt.Errorf("Bad bool '%s' for %s", x, t.name)
+			}
+			return t.parse(b)
+		}
+		f, err := strconv.ParseFloat(x, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Bad number '%s' for %s", x, t.name)
+		}
+		v = f
+	case float64:
+		v = x
+	case float32:
+		v = float64(x)
+	case int:
+		v = float64(x)
+	case int64:
+		v = float64(x)
+	default:
+		return 0, fmt.Errorf("Can't set %s to a %T", t.name, value)
+	}
+
+	if t.kind == Bool {
+		return 0, fmt.Errorf("%s is a bool", t.name)
+	}
+	if math.IsNaN(v) || v < t.min || v > t.max {
+		return 0, fmt.Errorf("%s must be between %v and %v", t.name, t.min, t.max)
+	}
+	if t.kind == Int && v != math.Trunc(v) {
+		return 0, fmt.Errorf("%s must be a whole number", t.name)
+	}
+	return v, nil
+}
+
+// Registry holds a set of tunables. Packages register theirs with Default,
+// using NewFloat, NewInt and NewBool for package-level parameters, or the
+// Registry's Float, Int and Bool for ones which belong to an object.
+type Registry struct {
+	lock sync.Mutex
+	tunables map[string]*Tunable
+
+	// Where to save values when they change, see Persist
+	path string
+	// The list of tunables is published here whenever one changes
+	topic *telemetry.Topic
+}
+
+func (r *Registry) add(t *Tunable) *Tunable {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.tunables[t.name]; ok {
+		panic(fmt.Sprintf("Duplicate tunable '%s'", t.name))
+	}
+	r.tunables[t.name] = t
+	return t
+}
+
+// Float registers a float parameter between min and max
+func (r *Registry) Float(name string, min, max float64, get func() float64, set func(float64)) *Tunable {
+	return r.add(&Tunable{ name, Float, min, max, get, set })
+}
+
+// Int registers an integer parameter between min and max
+func (r *Registry) Int(name string, min, max int, get func() int, set func(int)) *Tunable {
+	return r.add(&Tunable{
+		name, Int, float64(min), float64(max),
+		func() float64 { return float64(get()) },
+		func(v float64) { set(int(v)) },
+	})
+}
+
+func (r *Registry) Bool(name string, get func() bool, set func(bool)) *Tunable {
+	return r.add(&Tunable{
+		name, Bool, 0, 1,
+		func() float64 {
+			if get() {
+				return 1
+			}
+			return 0
+		},
+		func(v float64) { set(v != 0) },
+	})
+}
+
+func (r *Registry) find(name string) (*Tunable, error) {
+	t, ok := r.tunables[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown tunable '%s'", name)
+	}
+	return t, nil
+}
+
+func (r *Registry) list() []Info {
+	list := make([]Info, 0, len(r.tunables))
+	for _, t := range r.tunables {
+		list = append(list, t.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// List returns all the tunables, sorted by name
+func (r *Registry) List() []Info {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.list()
+}
+
+func (r *Registry) publish() {
+	if r.topic != nil {
+		r.topic.Publish(r.list())
+	}
+}
+
+// Publish sends the current values to telemetry. They're sent again
+// whenever one is Set.
+func (r *Registry) Publish() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.publish()
+}
+
+func (r *Registry) Get(name string) (Info, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	t, err := r.find(name)
+	if err != nil {
+		return Info{}, err
+	}
+	return t.info(), nil
+}
+
+// Set changes a tunable, if 'value' is the right type and in range. Strings
+// are parsed, so values can come straight from a query string.
+func (r *Registry) Set(name string, value interface{}) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	t, err := r.find(name)
+	if err != nil {
+		return err
+	}
+
+	v, err := t.parse(value)
+	if err != nil {
+		return err
+	}
+	t.set(v)
+	r.publish()
+
+	if r.path != "" {
+		return r.save(r.path)
+	}
+	return nil
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		tunables: make(map[string]*Tunable),
+	}
+}
+
+// Default is where packages register their tunables, published on the
+// "tunables" telemetry topic
+var Default = &Registry{
+	tunables: make(map[string]*Tunable),
+	topic: telemetry.NewTopic("tunables", []Info{}),
+}
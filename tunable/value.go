@@ -0,0 +1,82 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package tunable
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Value is a tunable which holds its own value, so it's safe to read from
+// any goroutine
+type Value struct {
+	bits uint64
+}
+
+func (v *Value) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+func (v *Value) store(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *Value) Float() float64 {
+	return v.load()
+}
+
+func (v *Value) Float32() float32 {
+	return float32(v.load())
+}
+
+func (v *Value) Int() int {
+	return int(v.load())
+}
+
+func (v *Value) Bool() bool {
+	return v.load() != 0
+}
+
+func newValue(def float64) *Value {
+	v := &Value{}
+	v.store(def)
+	return v
+}
+
+// NewFloat registers a float tunable with its own value, starting at 'def'
+func (r *Registry) NewFloat(name string, def, min, max float64) *Value {
+	v := newValue(def)
+	r.Float(name, min, max, v.load, v.store)
+	return v
+}
+
+// NewInt registers an integer tunable with its own value, starting at 'def'
+func (r *Registry) NewInt(name string, def, min, max int) *Value {
+	v := newValue(float64(def))
+	r.add(&Tunable{ name, Int, float64(min), float64(max), v.load, v.store })
+	return v
+}
+
+// NewBool registers a bool tunable with its own value, starting at 'def'
+func (r *Registry) NewBool(name string, def bool) *Value {
+	v := newValue(0)
+	if def {
+		v.store(1)
+	}
+	r.add(&Tunable{ name, Bool, 0, 1, v.load, v.store })
+	return v
+}
+
+// NewFloat registers a float tunable with Default
+func NewFloat(name string, def, min, max float64) *Value {
+	return Default.NewFloat(name, def, min, max)
+}
+
+// NewInt registers an integer tunable with Default
+func NewInt(name string, def, min, max int) *Value {
+	return Default.NewInt(name, def, min, max)
+}
+
+// NewBool registers a bool tunable with Default
+func NewBool(name string, def bool) *Value {
+	return Default.NewBool(name, def)
+}
@@ -0,0 +1,350 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package vision
+
+import (
+	"image"
+	"math"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/model"
+	"github.com/usedbytes/mini_mouse/bot/plan/line/algo"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+)
+
+var tagTopic = telemetry.NewTopic("vision/tags", []model.TagSighting{})
+
+// Tags are from the original ArUco dictionary: a black square 7 cells
+// across, with 5x5 data cells inside a 1 cell border. Each row of data is
+// one of these words, encoding 2 bits of the ID, most significant row first.
+// A white cell is a 1, and the leftmost cell is the most significant bit.
+var arucoWords = [4]uint8{ 0x10, 0x17, 0x09, 0x0e }
+
+const (
+	tagCells = 7
+	// Smallest dark blob, in pixels, which could be a tag
+	minTagPixels = tagCells * tagCells
+	// How far a tag's sides can be from square, as a fraction of its size
+	tagSquareness = 0.25
+	// Samples in a tag must span at least this many levels
+	minTagContrast = 40
+)
+
+type point struct {
+	x, y float32
+}
+
+func (p point) sub(b point) point {
+	return point{ p.x - b.x, p.y - b.y }
+}
+
+func (p point) lerp(b point, t float32) point {
+	return point{ p.x + (b.x - p.x) * t, p.y + (b.y - p.y) * t }
+}
+
+func (p point) dist(b point) float32 {
+	return float32(math.Hypot(float64(p.x - b.x), float64(p.y - b.y)))
+}
+
+func cross(a, b point) float32 {
+	return a.x * b.y - a.y * b.x
+}
+
+// Fiducials looks for ArUco tags lying flat on the floor, in a full
+// (uncropped) frame, and publishes the []model.TagSighting it finds under
+// "fiducials". It must come before any stage which crops the frame.
+//
+// Tags need a white margin around them to be separated from the floor, and
+// must be around 3 pixels per cell (21 pixels across, after foreshortening)
+// to be decoded, so they need more camera resolution than line following
+// does. With camera.Default at 160x120, a 60 mm tag can be read out to
+// about 250 mm in front of the robot, and a 20 mm one to about 150 mm.
+type Fiducials struct {
+	cal *camera.Calibration
+
+	// Kept from one frame to the next
+	bin image.Gray
+	labels []int32
+	stack []image.Point
+	blob []image.Point
+	sightings chan []model.TagSighting
+}
+
+func (fd *Fiducials) Name() string {
+	return "fiducials"
+}
+
+// Sightings returns the tags seen in each frame which had any. If they
+// aren't read, only the latest is kept.
+func (fd *Fiducials) Sightings() <-chan []model.TagSighting {
+	return fd.sightings
+}
+
+// Fill the dark blob containing 'start' with 'label', collecting its pixels
+// into fd.blob. Returns false if it touches the edge of the frame.
+func (fd *Fiducials) fill(bin *image.Gray, start image.Point, label int32) bool {
+	w, h := bin.Bounds().Dx(), bin.Bounds().Dy()
+	inside := true
+
+	fd.blob = fd.blob[:0]
+	fd.stack = append(fd.stack[:0], start)
+	fd.labels[start.Y * w + start.X] = label
+	for len(fd.stack) > 0 {
+		p := fd.stack[len(fd.stack) - 1]
+		fd.stack = fd.stack[:len(fd.stack) - 1]
+		fd.blob = append(fd.blob, p)
+
+		for _, d := range [...]image.Point{ {1, 0}, {-1, 0}, {0, 1}, {0, -1} } {
+			n := p.Add(d)
+			if n.X < 0 || n.Y < 0 || n.X >= w || n.Y >= h {
+				inside = false
+				continue
+			}
+			i := n.Y * w + n.X
+			if fd.labels[i] == 0 && bin.Pix[bin.Stride * n.Y + n.X] == 0 {
+				fd.labels[i] = label
+				fd.stack = append(fd.stack, n)
+			}
+		}
+	}
+
+	return inside
+}
+
+// The four outermost points of the blob: the furthest from its centre,
+// the furthest from that, and the furthest either side of the line between
+// them
+func quadCorners(blob []image.Point) ([4]point, bool) {
+	var c point
+	for _, p := range blob {
+		c.x += float32(p.X)
+		c.y += float32(p.Y)
+	}
+	c.x /= float32(len(blob))
+	c.y /= float32(len(blob))
+
+	furthest := func(score func(p point) float32) point {
+		var best point
+		bestScore := float32(math.Inf(-1))
+		for _, b := range blob {
+			p := point{ float32(b.X), float32(b.Y) }
+			if s := score(p); s > bestScore {
+				bestScore = s
+				best = p
+			}
+		}
+		return best
+	}
+
+	p0 := furthest(func(p point) float32 { return p.dist(c) })
+	p2 := furthest(func(p point) float32 { return p.dist(p0) })
+	axis := p2.sub(p0)
+	p1 := furthest(func(p point) float32 { return cross(axis, p.sub(p0)) })
+	p3 := furthest(func(p point) float32 { return -cross(axis, p.sub(p0)) })
+
+	ok := cross(axis, p1.sub(p0)) > 0 && cross(axis, p3.sub(p0)) < 0
+	return [4]point{ p0, p1, p2, p3 }, ok
+}
+
+// Project image pixel corners onto the floor, anti-clockwise seen from
+// above
+func (fd *Fiducials) toFloor(corners [4]point, w, h int) ([4]point, bool) {
+	var floor [4]point
+	for i, c := range corners {
+		u := (c.x + 0.5) / float32(w) - 0.5
+		r := (c.y + 0.5) / float32(h)
+		x, y, ok := fd.cal.ToFloor(u, r)
+		if !ok {
+			return floor, false
+		}
+		floor[i] = point{ x, y }
+	}
+
+	var area float32
+	for i := range floor {
+		area += cross(floor[i], floor[(i + 1) % 4])
+	}
+	if area < 0 {
+		floor[1], floor[3] = floor[3], floor[1]
+	}
+
+	return floor, true
+}
+
+func square(q [4]point) bool {
+	var sides [4]float32
+	var size float32
+	for i := range q {
+		sides[i] = q[i].dist(q[(i + 1) % 4])
+		size += sides[i] / 4
+	}
+
+	for _, s := range sides {
+		if math.Abs(float64(s - size)) > float64(tagSquareness * size) {
+			return false
+		}
+	}
+
+	d0, d1 := q[0].dist(q[2]), q[1].dist(q[3])
+	return math.Abs(float64(d0 - d1)) <= float64(tagSquareness * size)
+}
+
+// Read the tag's cells, with 'tl', 'tr', 'br', 'bl' its corners on the
+// floor. Returns the ID if the cells make a valid tag this way up.
+func (fd *Fiducials) decode(img *image.Gray, tl, tr, br, bl point) (int, bool) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	var cells [tagCells][tagCells]uint8
+	var min, max uint8 = 255, 0
+	for row := 0; row < tagCells; row++ {
+		b := (float32(row) + 0.5) / tagCells
+		for col := 0; col < tagCells; col++ {
+			a := (float32(col) + 0.5) / tagCells
+			p := tl.lerp(tr, a).lerp(bl.lerp(br, a), b)
+
+			u, r, ok := fd.cal.ToImage(p.x, p.y)
+			x, y := int((u + 0.5) * float32(w)), int(r * float32(h))
+			if !ok || x < 0 || y < 0 || x >= w || y >= h {
+				return 0, false
+			}
+
+			v := img.Pix[img.Stride * y + x]
+			cells[row][col] = v
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+	}
+
+	if int(max) - int(min) < minTagContrast {
+		return 0, false
+	}
+	level := (int(min) + int(max)) / 2
+
+	id := 0
+	for row := 0; row < tagCells; row++ {
+		word := uint8(0)
+		for col := 0; col < tagCells; col++ {
+			white := int(cells[row][col]) > level
+			border := row == 0 || col == 0 || row == tagCells - 1 || col == tagCells - 1
+			if border {
+				if white {
+					return 0, false
+				}
+				continue
+			}
+			if white {
+				word |= 1 << uint(tagCells - 2 - col)
+			}
+		}
+
+		if row == 0 || row == tagCells - 1 {
+			continue
+		}
+
+		found := false
+		for i, w := range arucoWords {
+			if w == word {
+				id = id << 2 | i
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+
+	return id, true
+}
+
+func (fd *Fiducials) find(img *image.Gray) []model.TagSighting {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	copyGray(&fd.bin, img)
+	bin := &fd.bin
+	algo.Otsu.Apply(bin)
+
+	if len(fd.labels) != w * h {
+		fd.labels = make([]int32, w * h)
+	} else {
+		for i := range fd.labels {
+			fd.labels[i] = 0
+		}
+	}
+
+	var tags []model.TagSighting
+	label := int32(0)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if fd.labels[y * w + x] != 0 || bin.Pix[bin.Stride * y + x] != 0 {
+				continue
+			}
+
+			label++
+			if !fd.fill(bin, image.Pt(x, y), label) || len(fd.blob) < minTagPixels {
+				continue
+			}
+
+			corners, ok := quadCorners(fd.blob)
+			if !ok {
+				continue
+			}
+
+			q, ok := fd.toFloor(corners, w, h)
+			if !ok || !square(q) {
+				continue
+			}
+
+			// Try each corner as the top-left. Anti-clockwise from it
+			// are bottom-left, bottom-right and top-right.
+			for i := 0; i < 4; i++ {
+				tl, bl, br, tr := q[i], q[(i + 1) % 4], q[(i + 2) % 4], q[(i + 3) % 4]
+				if id, ok := fd.decode(img, tl, tr, br, bl); ok {
+					tags = append(tags, model.TagSighting{
+						ID: id,
+						Corners: [4]model.Coord{
+							{ tl.x, tl.y }, { tr.x, tr.y }, { br.x, br.y }, { bl.x, bl.y },
+						},
+					})
+					break
+				}
+			}
+		}
+	}
+
+	return tags
+}
+
+func (fd *Fiducials) Process(f *Frame) error {
+	tags := fd.find(f.Gray)
+	f.Results["fiducials"] = tags
+	tagTopic.Publish(tags)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	for {
+		select {
+		case fd.sightings <- tags:
+			return nil
+		default:
+		}
+
+		select {
+		case <-fd.sightings:
+		default:
+		}
+	}
+}
+
+// NewFiducials makes a Fiducials stage for frames covering the whole
+// camera view
+func NewFiducials(cal *camera.Calibration) *Fiducials {
+	return &Fiducials{
+		cal: cal.WithCrop(camera.FullFrame),
+		sightings: make(chan []model.TagSighting, 1),
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package vision
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/model"
+)
+
+const (
+	floorLevel = 120
+	blackLevel = 20
+	whiteLevel = 230
+)
+
+// Whether cell (row, col) of tag 'id' is white, including the border
+func tagCell(id, row, col int) bool {
+	if row <= 0 || col <= 0 || row >= tagCells - 1 || col >= tagCells - 1 {
+		return false
+	}
+	word := arucoWords[(id >> uint(2 * (tagCells - 2 - row))) & 3]
+	return word & (1 << uint(tagCells - 2 - col)) != 0
+}
+
+// renderTag draws 'tag', with a one cell white margin, into a w x h full
+// frame taken by a robot at 'pos' facing 'heading'. Points on the tag are
+// projected into the image with Calibration.ToImage, and each pixel is the
+// average of the points which land in it.
+func renderTag(cal *camera.Calibration, w, h int, tag model.ArenaTag, pos model.Coord, heading float32) *image.Gray {
+	sum := make([]int, w * h)
+	n := make([]int, w * h)
+
+	up := model.Coord{ float32(math.Cos(float64(tag.Heading))), float32(math.Sin(float64(tag.Heading))) }
+	right := model.Coord{ up.Y, -up.X }
+	sin, cos := float32(math.Sin(float64(-heading))), float32(math.Cos(float64(-heading)))
+
+	// Fine enough that every pixel the tag covers gets some points
+	const steps = 500
+	cell := tag.Size / tagCells
+	for i := 0; i < steps; i++ {
+		// -1 to tagCells + 1 cells, from the left edge of the margin
+		a := (float32(i) + 0.5) / steps * (tagCells + 2) - 1
+		for j := 0; j < steps; j++ {
+			b := (float32(j) + 0.5) / steps * (tagCells + 2) - 1
+
+			// In the arena, then relative to the robot
+			p := tag.Centre.Add(right.Scale((a - tagCells / 2.0) * cell)).Add(up.Scale((tagCells / 2.0 - b) * cell))
+			d := p.Sub(pos)
+			fx, fy := d.X * cos - d.Y * sin, d.X * sin + d.Y * cos
+
+			u, r, ok := cal.ToImage(fx, fy)
+			x, y := int((u + 0.5) * float32(w)), int(r * float32(h))
+			if !ok || x < 0 || y < 0 || x >= w || y >= h {
+				continue
+			}
+
+			v := whiteLevel
+			col, row := int(math.Floor(float64(a))), int(math.Floor(float64(b)))
+			if col >= 0 && row >= 0 && col < tagCells && row < tagCells && !tagCell(tag.ID, row, col) {
+				v = blackLevel
+			}
+			sum[y * w + x] += v
+			n[y * w + x]++
+		}
+	}
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = floorLevel
+		if n[i] > 0 {
+			img.Pix[i] = uint8(sum[i] / n[i])
+		}
+	}
+	return img
+}
+
+func TestFiducialRoundTrip(t *testing.T) {
+	cal := camera.Default()
+	full := cal.WithCrop(camera.FullFrame)
+
+	pos := model.Coord{ 300, 100 }
+	heading := float32(math.Pi / 6)
+	// 140 mm ahead and a little to the left
+	ahead := model.Coord{
+		pos.X + 140 * float32(math.Cos(float64(heading))) - 10 * float32(math.Sin(float64(heading))),
+		pos.Y + 140 * float32(math.Sin(float64(heading))) + 10 * float32(math.Cos(float64(heading))),
+	}
+
+	tests := []struct{
+		name string
+		w, h int
+		// Tag size, mm
+		size float32
+		found bool
+	}{
+		// The line following resolution is nowhere near enough
+		{ "Line following", 16, 32, 40, false },
+		// About 11 pixels across
+		{ "Small tag", 160, 120, 10, false },
+		{ "Fiducial", 160, 120, 40, true },
+		{ "High resolution", 320, 240, 20, true },
+	}
+
+	for _, test := range tests {
+		tag := model.ArenaTag{ ID: 613, Centre: ahead, Heading: 1.0, Size: test.size }
+		arena := &model.Arena{ Tags: map[int]model.ArenaTag{ tag.ID: tag } }
+
+		img := renderTag(full, test.w, test.h, tag, pos, heading)
+		fd := NewFiducials(cal)
+		tags := fd.find(img)
+
+		if !test.found {
+			if len(tags) != 0 {
+				t.Errorf("%s: found %v, expected nothing", test.name, tags)
+			}
+			continue
+		}
+
+		if len(tags) != 1 || tags[0].ID != tag.ID {
+			t.Errorf("%s: found %v, expected tag %d", test.name, tags, tag.ID)
+			continue
+		}
+
+		gotPos, gotHeading, err := arena.Locate(tags)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if d := gotPos.Sub(pos); math.Hypot(float64(d.X), float64(d.Y)) > 5 {
+			t.Errorf("%s: located at %v, expected %v", test.name, gotPos, pos)
+		}
+		if d := math.Abs(float64(gotHeading - heading)); d > 2 * math.Pi / 180 {
+			t.Errorf("%s: heading %v, expected %v", test.name, gotHeading, heading)
+		}
+	}
+}
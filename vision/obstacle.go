@@ -0,0 +1,285 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package vision
+
+import (
+	"image"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+)
+
+var obstacleTopic = telemetry.NewTopic("vision/obstacles", []Obstacle{})
+
+// An Obstacle is something standing on the floor in front of the robot.
+// Positions are in mm relative to the robot centre, with X forwards and Y
+// to the left.
+type Obstacle struct {
+	// Nearest point of the obstacle's base
+	X, Y float32
+	Distance float32
+	// Angle to the nearest point, anti-clockwise positive
+	Bearing float32
+	// Distance across the obstacle's visible base
+	Width float32
+}
+
+type ObstacleChange int
+const (
+	ObstacleAppeared ObstacleChange = iota
+	ObstacleMoved
+	ObstacleCleared
+)
+
+func (c ObstacleChange) String() string {
+	return [...]string{ "Appeared", "Moved", "Cleared" }[c]
+}
+
+// ObstacleEvent is sent when an obstacle comes into range, for each frame
+// while it stays there, and once it has gone
+type ObstacleEvent struct {
+	Change ObstacleChange
+	// Capture time of the frame
+	Time time.Time
+	// The nearest obstacle, and all of them nearest first. Both are empty
+	// for ObstacleCleared
+	Nearest Obstacle
+	Obstacles []Obstacle
+}
+
+const (
+	// Fraction of the frame, at the bottom, assumed to be floor
+	floorStrip = 0.15
+	// Fraction of floorStrip that must match for the floor to be relearnt
+	floorMatch = 0.5
+	// Pixels within this many levels of the floor are floor
+	floorTolerance = 25
+	// Pixels this much brighter than the floor are taken to be the line
+	// painted on it, and aren't obstacles
+	lineContrast = 60
+	// Consecutive non-floor rows needed for an obstacle
+	obstacleRows = 2
+	// Columns are part of the same obstacle if their bases are this close
+	obstacleJoin = 50
+
+	// Frames an obstacle must be seen for before it's reported
+	obstacleFrames = 2
+	// Frames it must then be gone for before it's cleared
+	obstacleClearFrames = 5
+	obstacleEventQueue = 16
+)
+
+// Obstacles segments the floor from everything else in a full (uncropped)
+// frame, and publishes the []Obstacle standing on it, nearest first, under
+// "obstacles". It must come before any stage which crops the frame.
+//
+// The floor is learnt from the bottom of the frame, so it only works while
+// the robot isn't right up against something. Anything much brighter than
+// the floor looks like the line, so isn't seen.
+type Obstacles struct {
+	cal *camera.Calibration
+	maxRange float32
+
+	floor int
+	learnt bool
+
+	seen int
+	gone int
+	active bool
+	events chan ObstacleEvent
+}
+
+func (o *Obstacles) Name() string {
+	return "obstacles"
+}
+
+// Events returns the stream of ObstacleEvents. If they aren't read, the
+// oldest are dropped.
+func (o *Obstacles) Events() <-chan ObstacleEvent {
+	return o.events
+}
+
+// Learn the floor level from the most common brightness in the strip at the
+// bottom of the frame
+func (o *Obstacles) learnFloor(img *image.Gray) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	rows := int(math.Ceil(float64(h) * floorStrip))
+
+	var hist [256 / 8]int
+	for y := 0; y < rows; y++ {
+		for _, v := range img.Pix[img.Stride * y : img.Stride * y + w] {
+			hist[v / 8]++
+		}
+	}
+
+	mode := 0
+	for i, n := range hist {
+		if n > hist[mode] {
+			mode = i
+		}
+	}
+
+	// Take the mean of the pixels around the peak
+	lo, hi := mode * 8 - floorTolerance, mode * 8 + 8 + floorTolerance
+	sum, n := 0, 0
+	for y := 0; y < rows; y++ {
+		for _, v := range img.Pix[img.Stride * y : img.Stride * y + w] {
+			if int(v) >= lo && int(v) < hi {
+				sum += int(v)
+				n++
+			}
+		}
+	}
+
+	if n == 0 || float32(n) < floorMatch * float32(rows * w) {
+		// Probably not looking at the floor, keep the old level
+		return
+	}
+
+	if !o.learnt {
+		o.floor = sum / n
+		o.learnt = true
+	} else {
+		o.floor = (o.floor + sum / n) / 2
+	}
+}
+
+func (o *Obstacles) isFloor(img *image.Gray, x, y int) bool {
+	row := img.Pix[img.Stride * y : img.Stride * y + img.Bounds().Dx()]
+	d := int(row[x]) - o.floor
+	switch {
+	case d >= -floorTolerance && d <= floorTolerance:
+		return true
+	case d >= lineContrast:
+		return true
+	case d > 0:
+		// Could be the blurred edge of the line
+		for _, nx := range []int{ x - 1, x + 1 } {
+			if nx >= 0 && nx < len(row) && int(row[nx]) - o.floor >= lineContrast {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Find where each column stops being floor, and group neighbouring columns
+// into obstacles
+func (o *Obstacles) find(img *image.Gray) []Obstacle {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	var obstacles []Obstacle
+	var cur *Obstacle
+	var lastX, lastY float32
+	for x := 0; x < w; x++ {
+		u := (float32(x) + 0.5) / float32(w) - 0.5
+
+		base := -1
+		run := 0
+		for y := 0; y < h; y++ {
+			if o.isFloor(img, x, y) {
+				run = 0
+				continue
+			}
+			run++
+			if run >= obstacleRows {
+				base = y - run + 1
+				break
+			}
+		}
+
+		var fx, fy float32
+		ok := base >= 0
+		if ok {
+			fx, fy, ok = o.cal.ToFloor(u, float32(base) / float32(h))
+		}
+		dist := float32(math.Hypot(float64(fx), float64(fy)))
+		if !ok || dist > o.maxRange {
+			cur = nil
+			continue
+		}
+
+		if cur != nil && math.Hypot(float64(fx - lastX), float64(fy - lastY)) <= obstacleJoin {
+			cur.Width += float32(math.Hypot(float64(fx - lastX), float64(fy - lastY)))
+		} else {
+			obstacles = append(obstacles, Obstacle{ Distance: float32(math.Inf(1)) })
+			cur = &obstacles[len(obstacles) - 1]
+		}
+
+		if dist < cur.Distance {
+			cur.X, cur.Y = fx, fy
+			cur.Distance = dist
+			cur.Bearing = float32(math.Atan2(float64(fy), float64(fx)))
+		}
+		lastX, lastY = fx, fy
+	}
+
+	sort.Slice(obstacles, func(i, j int) bool { return obstacles[i].Distance < obstacles[j].Distance })
+
+	return obstacles
+}
+
+func (o *Obstacles) send(e ObstacleEvent) {
+	for {
+		select {
+		case o.events <- e:
+			return
+		default:
+		}
+
+		select {
+		case <-o.events:
+		default:
+		}
+	}
+}
+
+func (o *Obstacles) track(obstacles []Obstacle, t time.Time) {
+	if len(obstacles) == 0 {
+		o.seen = 0
+		o.gone++
+		if o.active && o.gone >= obstacleClearFrames {
+			o.active = false
+			o.send(ObstacleEvent{ Change: ObstacleCleared, Time: t })
+		}
+		return
+	}
+
+	o.gone = 0
+	o.seen++
+	e := ObstacleEvent{ Change: ObstacleMoved, Time: t, Nearest: obstacles[0], Obstacles: obstacles }
+	if !o.active {
+		if o.seen < obstacleFrames {
+			return
+		}
+		o.active = true
+		e.Change = ObstacleAppeared
+	}
+	o.send(e)
+}
+
+func (o *Obstacles) Process(f *Frame) error {
+	o.learnFloor(f.Gray)
+	if !o.learnt {
+		return nil
+	}
+
+	obstacles := o.find(f.Gray)
+	f.Results["obstacles"] = obstacles
+	obstacleTopic.Publish(obstacles)
+	o.track(obstacles, f.Time)
+
+	return nil
+}
+
+// NewObstacles makes an Obstacles stage for frames covering the whole camera
+// view. Obstacles further than maxRange mm are ignored.
+func NewObstacles(cal *camera.Calibration, maxRange float32) *Obstacles {
+	return &Obstacles{
+		cal: cal.WithCrop(camera.FullFrame),
+		maxRange: maxRange,
+		events: make(chan ObstacleEvent, obstacleEventQueue),
+	}
+}
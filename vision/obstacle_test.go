@@ -0,0 +1,206 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package vision
+
+import (
+	"image"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+)
+
+// A rectangle on the floor, mm relative to the robot centre
+type floorRect struct {
+	X0, Y0, X1, Y1 float32
+}
+
+func (r floorRect) Empty() bool {
+	return r.X0 >= r.X1 || r.Y0 >= r.Y1
+}
+
+// Project each point of 'r' into a w x h image with Calibration.ToImage,
+// calling 'fn' with the pixels it lands in
+func projectRect(cal *camera.Calibration, w, h int, r floorRect, fn func(x, y int)) {
+	const steps = 500
+	for i := 0; i < steps; i++ {
+		fx := r.X0 + (float32(i) + 0.5) / steps * (r.X1 - r.X0)
+		for j := 0; j < steps; j++ {
+			fy := r.Y0 + (float32(j) + 0.5) / steps * (r.Y1 - r.Y0)
+
+			u, v, ok := cal.ToImage(fx, fy)
+			x, y := int((u + 0.5) * float32(w)), int(v * float32(h))
+			if ok && x >= 0 && y >= 0 && x < w && y < h {
+				fn(x, y)
+			}
+		}
+	}
+}
+
+// renderBox draws a w x h full frame of the floor, with the line running
+// straight ahead if 'line' is set, and a dark box standing on 'box' if it
+// isn't empty. The box is taller than the camera can see over, so it covers
+// everything above its base.
+func renderBox(cal *camera.Calibration, w, h int, line bool, box floorRect) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = floorLevel
+	}
+
+	if line {
+		projectRect(cal, w, h, floorRect{ 0, -10, 600, 10 }, func(x, y int) {
+			img.Pix[img.Stride * y + x] = whiteLevel
+		})
+	}
+
+	if box.Empty() {
+		return img
+	}
+
+	// Row 0 is nearest
+	base := make([]int, w)
+	for x := range base {
+		base[x] = h
+	}
+	projectRect(cal, w, h, box, func(x, y int) {
+		if y < base[x] {
+			base[x] = y
+		}
+	})
+	for x := range base {
+		for y := base[x]; y < h; y++ {
+			img.Pix[img.Stride * y + x] = blackLevel
+		}
+	}
+
+	return img
+}
+
+func TestObstacleFind(t *testing.T) {
+	cal := camera.Default()
+	full := cal.WithCrop(camera.FullFrame)
+	const w, h = 160, 120
+
+	tests := []struct{
+		name string
+		line bool
+		box floorRect
+		// Zero Width for no obstacle
+		want Obstacle
+	}{
+		{ "Line only", true, floorRect{}, Obstacle{} },
+		{
+			"Straight ahead",
+			false,
+			floorRect{ 150, -30, 250, 30 },
+			Obstacle{ X: 150, Distance: 150, Width: 60 },
+		},
+		{
+			"Over the line",
+			true,
+			floorRect{ 200, -40, 220, 40 },
+			Obstacle{ X: 200, Distance: 200, Width: 80 },
+		},
+		{
+			// A thin box, so there's little of its side to see
+			"To the left",
+			true,
+			floorRect{ 160, 30, 165, 90 },
+			Obstacle{ X: 160, Y: 30, Distance: 162.8, Bearing: 0.186, Width: 60 },
+		},
+		{ "Out of range", true, floorRect{ 450, -30, 500, 30 }, Obstacle{} },
+	}
+
+	for _, test := range tests {
+		o := NewObstacles(cal, 400)
+		img := renderBox(full, w, h, test.line, test.box)
+
+		o.learnFloor(img)
+		if !o.learnt || o.floor < floorLevel - 2 || o.floor > floorLevel + 2 {
+			t.Errorf("%s: learnt floor %d (%v), expected %d", test.name, o.floor, o.learnt, floorLevel)
+			continue
+		}
+
+		found := o.find(img)
+		if test.want.Width == 0 {
+			if len(found) != 0 {
+				t.Errorf("%s: found %v, expected nothing", test.name, found)
+			}
+			continue
+		}
+
+		if len(found) != 1 {
+			t.Errorf("%s: found %v, expected one obstacle", test.name, found)
+			continue
+		}
+
+		got := found[0]
+		if math.Hypot(float64(got.X - test.want.X), float64(got.Y - test.want.Y)) > 5 {
+			t.Errorf("%s: nearest point %v, %v, expected %v, %v", test.name, got.X, got.Y, test.want.X, test.want.Y)
+		}
+		if math.Abs(float64(got.Distance - test.want.Distance)) > 5 {
+			t.Errorf("%s: distance %v, expected %v", test.name, got.Distance, test.want.Distance)
+		}
+		if math.Abs(float64(got.Bearing - test.want.Bearing)) > 2 * math.Pi / 180 {
+			t.Errorf("%s: bearing %v, expected %v", test.name, got.Bearing, test.want.Bearing)
+		}
+		if math.Abs(float64(got.Width - test.want.Width)) > 10 {
+			t.Errorf("%s: width %v, expected %v", test.name, got.Width, test.want.Width)
+		}
+	}
+}
+
+func TestObstacleEvents(t *testing.T) {
+	cal := camera.Default()
+	full := cal.WithCrop(camera.FullFrame)
+	const w, h = 160, 120
+
+	far := renderBox(full, w, h, true, floorRect{ 250, -30, 300, 30 })
+	near := renderBox(full, w, h, true, floorRect{ 150, -30, 200, 30 })
+	clear := renderBox(full, w, h, true, floorRect{})
+
+	frames := []*image.Gray{ clear, far, far, near }
+	for i := 0; i < obstacleClearFrames; i++ {
+		frames = append(frames, clear)
+	}
+
+	o := NewObstacles(cal, 400)
+	start := time.Now()
+	for i, img := range frames {
+		f := &Frame{ Gray: img, Time: start.Add(time.Duration(i) * time.Second), Results: make(map[string]interface{}) }
+		if err := o.Process(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []struct{
+		change ObstacleChange
+		frame int
+		distance float32
+	}{
+		// Only once it's been seen for obstacleFrames
+		{ ObstacleAppeared, 2, 250 },
+		{ ObstacleMoved, 3, 150 },
+		{ ObstacleCleared, 3 + obstacleClearFrames, 0 },
+	}
+
+	var events []ObstacleEvent
+	for len(o.Events()) > 0 {
+		events = append(events, <-o.Events())
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Got events %v, expected %v", events, want)
+	}
+
+	for i, e := range events {
+		if e.Change != want[i].change || !e.Time.Equal(start.Add(time.Duration(want[i].frame) * time.Second)) {
+			t.Errorf("Event %d: %v at frame %v, expected %v at frame %d", i, e.Change, e.Time.Sub(start).Seconds(), want[i].change, want[i].frame)
+		}
+		if math.Abs(float64(e.Nearest.Distance - want[i].distance)) > 5 {
+			t.Errorf("Event %d: %v at %v, expected %v", i, e.Change, e.Nearest.Distance, want[i].distance)
+		}
+		if e.Change == ObstacleCleared && len(e.Obstacles) != 0 {
+			t.Errorf("Event %d: cleared with %v", i, e.Obstacles)
+		}
+	}
+}
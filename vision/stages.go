@@ -0,0 +1,170 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package vision
+
+import (
+	"image"
+	"sync"
+
+	"github.com/usedbytes/mini_mouse/bot/base/camera"
+	"github.com/usedbytes/mini_mouse/bot/plan/line/algo"
+	"github.com/usedbytes/mini_mouse/bot/tunable"
+)
+
+type crop struct {
+	r camera.Rect
+	gray image.Gray
+}
+
+func (c *crop) Name() string {
+	return "crop"
+}
+
+func (c *crop) Process(f *Frame) error {
+	// The frame is already a copy, so it's fine to share its pixels
+	src := f.Gray
+	rect := c.r.Pixels(src.Bounds()).Intersect(src.Bounds())
+	c.gray = image.Gray{ Stride: src.Stride, Rect: rect }
+	if !rect.Empty() {
+		c.gray.Pix = src.Pix[src.PixOffset(rect.Min.X, rect.Min.Y):]
+	}
+	f.Gray = &c.gray
+
+	if f.Colour != nil {
+		f.Colour = f.Colour.SubImage(c.r.Pixels(f.Colour.Bounds())).(*image.YCbCr)
+	}
+	return nil
+}
+
+// Crop keeps the region 'r' of a full camera frame, e.g. a Calibration's
+// Crop
+func Crop(r camera.Rect) Stage {
+	return &crop{ r: r }
+}
+
+// Downsample averages each 'factor' x 'factor' block into one pixel
+func Downsample(factor int) Stage {
+	return StageFunc("downsample", func(f *Frame) error {
+		if factor <= 1 {
+			return nil
+		}
+
+		src := f.Gray
+		w, h := src.Bounds().Dx() / factor, src.Bounds().Dy() / factor
+		dst := image.NewGray(image.Rect(0, 0, w, h))
+
+		n := factor * factor
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sum := 0
+				for dy := 0; dy < factor; dy++ {
+					row := src.Pix[src.Stride * (y * factor + dy):]
+					for dx := 0; dx < factor; dx++ {
+						sum += int(row[x * factor + dx])
+					}
+				}
+				dst.Pix[dst.Stride * y + x] = uint8(sum / n)
+			}
+		}
+
+		f.Gray = dst
+		return nil
+	})
+}
+
+// Blur applies a 3x3 box blur
+func Blur() Stage {
+	return StageFunc("blur", func(f *Frame) error {
+		src := f.Gray
+		w, h := src.Bounds().Dx(), src.Bounds().Dy()
+		dst := image.NewGray(image.Rect(0, 0, w, h))
+
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sum, n := 0, 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := x + dx, y + dy
+						if nx < 0 || ny < 0 || nx >= w || ny >= h {
+							continue
+						}
+						sum += int(src.Pix[src.Stride * ny + nx])
+						n++
+					}
+				}
+				dst.Pix[dst.Stride * y + x] = uint8(sum / n)
+			}
+		}
+
+		f.Gray = dst
+		return nil
+	})
+}
+
+// The algo.Threshold used by LineDetect: 0 RowContrast, 1 Otsu,
+// 2 AdaptiveRow or 3 Hysteresis. It's read every frame, so it can be changed
+// while the robot is running.
+var thresholdMethod = tunable.NewInt("vision/threshold", int(algo.AdaptiveRow), int(algo.RowContrast), int(algo.Hysteresis))
+
+// LineDetect thresholds the frame with the "vision/threshold" method and
+// follows the line through it, publishing an algo.Result under "line". Its
+// detector keeps the buffers from one frame to the next. The frame is left
+// thresholded, for debugging.
+type LineDetect struct {
+	lock sync.Mutex
+	detector algo.Detector
+	prefer algo.Branch
+}
+
+func (l *LineDetect) Name() string {
+	return "line"
+}
+
+func (l *LineDetect) Process(f *Frame) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.detector.Threshold = algo.Threshold(thresholdMethod.Int())
+
+	// The detector reuses its buffers, and Results outlive this frame
+	f.Results["line"] = l.detector.FindLine(f.Gray, l.prefer).Clone()
+	f.Gray = l.detector.Thresholded()
+	return nil
+}
+
+func (l *LineDetect) SetBranch(b algo.Branch) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.prefer = b
+}
+
+func (l *LineDetect) SetSmoothing(s float32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.detector.Smoothing = s
+}
+
+func (l *LineDetect) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.detector.Reset()
+}
+
+func NewLineDetect(smoothing float32) *LineDetect {
+	return &LineDetect{
+		detector: algo.Detector{ Smoothing: smoothing },
+		prefer: algo.Straight,
+	}
+}
+
+// Markers publishes []algo.Marker under "markers", for colour frames
+func Markers() Stage {
+	return StageFunc("markers", func(f *Frame) error {
+		if f.Colour != nil {
+			f.Results["markers"] = algo.FindMarkers(f.Colour)
+		}
+		return nil
+	})
+}
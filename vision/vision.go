@@ -0,0 +1,315 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package vision
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/usedbytes/mini_mouse/bot/telemetry"
+)
+
+var timingTopic = telemetry.NewTopic("vision/timings", []Timing{})
+
+// Frame is passed through each Stage of a Pipeline in turn. Stages may
+// replace Gray with a new image, but never see the camera's buffer.
+type Frame struct {
+	Gray *image.Gray
+	Colour *image.YCbCr
+	Time time.Time
+
+	// Detector outputs, by name
+	Results map[string]interface{}
+
+	// The copies of the camera's images, kept for the next frame
+	gray image.Gray
+	colour image.YCbCr
+}
+
+type Stage interface {
+	Name() string
+	Process(f *Frame) error
+}
+
+type stageFunc struct {
+	name string
+	fn func(f *Frame) error
+}
+
+func (s *stageFunc) Name() string {
+	return s.name
+}
+
+func (s *stageFunc) Process(f *Frame) error {
+	return s.fn(f)
+}
+
+// StageFunc makes a Stage from a function
+func StageFunc(name string, fn func(f *Frame) error) Stage {
+	return &stageFunc{ name: name, fn: fn }
+}
+
+type Timing struct {
+	Stage string
+	Duration time.Duration
+}
+
+// Output is the result of running one frame through the Pipeline
+type Output struct {
+	// Capture time of the frame
+	Time time.Time
+	Results map[string]interface{}
+	Timings []Timing
+	Total time.Duration
+	Err error
+}
+
+// Pipeline runs a list of Stages on its own goroutine, always working on the
+// newest frame submitted. If frames arrive faster than it can process them,
+// older ones are dropped.
+type Pipeline struct {
+	stages []Stage
+	in chan *Frame
+	done chan bool
+	stopOnce sync.Once
+	// Frames which have been processed or dropped, to be reused
+	spare chan *Frame
+
+	lock sync.Mutex
+	latest Output
+	dropped int
+	debug bool
+	debugImages map[string]*image.Gray
+}
+
+func cloneGray(img *image.Gray) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	ret := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		copy(ret.Pix[ret.Stride * y : ret.Stride * y + w], img.Pix[img.Stride * y:])
+	}
+	return ret
+}
+
+// copyGray copies src into dst, reusing dst's pixels if they're big enough
+func copyGray(dst, src *image.Gray) {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if cap(dst.Pix) < w * h {
+		dst.Pix = make([]uint8, w * h)
+	}
+	dst.Pix = dst.Pix[:w * h]
+	dst.Stride = w
+	dst.Rect = image.Rect(0, 0, w, h)
+
+	for y := 0; y < h; y++ {
+		copy(dst.Pix[w * y : w * y + w], src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y + y):])
+	}
+}
+
+func copyPlane(dst, src []uint8) []uint8 {
+	return append(dst[:0], src...)
+}
+
+// copyYCbCr copies src into dst, reusing dst's planes if they're big enough
+func copyYCbCr(dst, src *image.YCbCr) {
+	y, cb, cr := dst.Y, dst.Cb, dst.Cr
+	*dst = *src
+	dst.Y = copyPlane(y, src.Y)
+	dst.Cb = copyPlane(cb, src.Cb)
+	dst.Cr = copyPlane(cr, src.Cr)
+}
+
+// newFrame copies the camera's images into a spare frame if there is one
+func (p *Pipeline) newFrame(gray *image.Gray, colour *image.YCbCr, t time.Time) *Frame {
+	var f *Frame
+	select {
+	case f = <-p.spare:
+	default:
+		f = &Frame{}
+	}
+
+	copyGray(&f.gray, gray)
+	f.Gray = &f.gray
+	f.Colour = nil
+	if colour != nil {
+		copyYCbCr(&f.colour, colour)
+		f.Colour = &f.colour
+	}
+	f.Time = t
+	// Results are handed out in Output, so can't be reused
+	f.Results = make(map[string]interface{})
+
+	return f
+}
+
+// recycle keeps f to be reused by newFrame, if there's room
+func (p *Pipeline) recycle(f *Frame) {
+	select {
+	case p.spare <- f:
+	default:
+	}
+}
+
+// Submit queues a copy of a frame for processing, replacing any frame which
+// hasn't been started yet. It never blocks.
+func (p *Pipeline) Submit(gray *image.Gray, colour *image.YCbCr, t time.Time) {
+	f := p.newFrame(gray, colour, t)
+
+	for {
+		select {
+		case p.in <- f:
+			return
+		default:
+		}
+
+		// Throw away the stale frame and try again
+		select {
+		case stale := <-p.in:
+			p.recycle(stale)
+			p.lock.Lock()
+			p.dropped++
+			p.lock.Unlock()
+		default:
+		}
+	}
+}
+
+func (p *Pipeline) process(f *Frame) {
+	out := Output{
+		Time: f.Time,
+		Results: f.Results,
+		Timings: make([]Timing, 0, len(p.stages)),
+	}
+
+	p.lock.Lock()
+	debug := p.debug
+	p.lock.Unlock()
+
+	var images map[string]*image.Gray
+	if debug {
+		images = make(map[string]*image.Gray)
+	}
+
+	start := time.Now()
+	for _, s := range p.stages {
+		t := time.Now()
+		err := s.Process(f)
+		out.Timings = append(out.Timings, Timing{ s.Name(), time.Since(t) })
+		if err != nil {
+			out.Err = fmt.Errorf("%s: %v", s.Name(), err)
+			break
+		}
+
+		if debug && f.Gray != nil {
+			images[s.Name()] = cloneGray(f.Gray)
+		}
+	}
+	out.Total = time.Since(start)
+
+	timingTopic.Publish(out.Timings)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.latest = out
+	if debug {
+		p.debugImages = images
+	}
+}
+
+// Process runs a copy of a frame through the stages on the calling
+// goroutine, instead of Submitting it. This makes the results repeatable,
+// e.g. for replaying recordings, but the caller has to wait.
+func (p *Pipeline) Process(gray *image.Gray, colour *image.YCbCr, t time.Time) Output {
+	f := p.newFrame(gray, colour, t)
+	p.process(f)
+	p.recycle(f)
+	return p.Latest()
+}
+
+func (p *Pipeline) Start() {
+	go func() {
+		for {
+			select {
+			case f := <-p.in:
+				p.process(f)
+				p.recycle(f)
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the goroutine started by Start. It doesn't wait for the frame
+// being processed, and it's fine to call it if Start never was.
+func (p *Pipeline) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// Latest returns the output from the most recently processed frame
+func (p *Pipeline) Latest() Output {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.latest
+}
+
+// Dropped returns how many frames have been skipped because the pipeline
+// was busy
+func (p *Pipeline) Dropped() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.dropped
+}
+
+// SetDebug enables keeping a copy of the image after every stage
+func (p *Pipeline) SetDebug(debug bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.debug = debug
+	if !debug {
+		p.debugImages = nil
+	}
+}
+
+// DebugImage returns the image as it was after stage 'name', for the most
+// recent frame
+func (p *Pipeline) DebugImage(name string) (*image.Gray, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.debug {
+		return nil, fmt.Errorf("Debug not enabled")
+	}
+
+	img, ok := p.debugImages[name]
+	if !ok {
+		return nil, fmt.Errorf("No image for stage '%s'", name)
+	}
+
+	return img, nil
+}
+
+func (p *Pipeline) Stages() []string {
+	names := make([]string, 0, len(p.stages))
+	for _, s := range p.stages {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+func NewPipeline(stages ...Stage) *Pipeline {
+	return &Pipeline{
+		stages: stages,
+		in: make(chan *Frame, 1),
+		done: make(chan bool),
+		// One being filled, one queued and one being processed
+		spare: make(chan *Frame, 3),
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Brian Starkey <stark3y@gmail.com>
+package vision
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+// Fails the test if fn hasn't returned within a second
+func returns(t *testing.T, name string, fn func()) {
+	t.Helper()
+
+	done := make(chan bool)
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s didn't return", name)
+	}
+}
+
+func TestStop(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 32))
+
+	// Never started
+	p := NewPipeline()
+	returns(t, "Stop", p.Stop)
+
+	processed := make(chan time.Time, 4)
+	p = NewPipeline(StageFunc("count", func(f *Frame) error {
+		processed <- f.Time
+		return nil
+	}))
+	p.Start()
+
+	start := time.Now()
+	p.Submit(img, nil, start)
+	select {
+	case got := <-processed:
+		if !got.Equal(start) {
+			t.Errorf("Processed frame from %v, expected %v", got, start)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Frame wasn't processed")
+	}
+
+	returns(t, "Stop", p.Stop)
+	returns(t, "Second Stop", p.Stop)
+}